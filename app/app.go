@@ -0,0 +1,262 @@
+// Package app wires the database, helpers and routes together and owns the
+// server's lifecycle.
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	controller "restaurant_app/controllers"
+	"restaurant_app/database"
+	"restaurant_app/events"
+	"restaurant_app/helpers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
+	"restaurant_app/routes"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Config holds everything the app needs to start.
+type Config struct {
+	Port string
+	// How long in-flight requests get to finish once shutdown starts
+	ShutdownTimeout time.Duration
+	// How long /readyz reports shutting down before the server stops
+	// accepting connections, for the orchestrator to notice
+	DrainDelay time.Duration
+	// Where the restaurant's entities, sessions, signing keys, the audit log
+	// and the rest are kept: StorageMongo, StorageSQLite or StorageMemory
+	Storage string
+	// The SQLite database file, with StorageSQLite
+	SQLitePath string
+	// Under which name the event stream saves how far it got
+	EventStream string
+	// Whether every domain event is logged
+	LogEvents bool
+	// The addresses or CIDR ranges of the proxies whose X-Forwarded-For is
+	// believed. With none, a request's client is the address it came from.
+	TrustedProxies []string
+	Database       database.Config
+}
+
+const (
+	StorageMongo = "mongo"
+	// Everything lives in a SQLite file next to the app, and MongoDB is not
+	// needed. There are no migrations to run and no domain events.
+	StorageSQLite = "sqlite"
+	// Everything lives in process and is lost on restart, and MongoDB is not
+	// needed. There are no domain events.
+	StorageMemory = "memory"
+)
+
+// LoadConfig reads the configuration from the environment: PORT (8000),
+// SHUTDOWN_TIMEOUT (30s), SHUTDOWN_DRAIN_DELAY (5s), STORAGE_BACKEND (mongo),
+// SQLITE_PATH (restaurant.db), EVENT_STREAM_NAME (domain-events), LOG_EVENTS (false),
+// TRUSTED_PROXIES (none; comma separated) and the MONGODB_* settings of
+// database.LoadConfig.
+func LoadConfig() (Config, error) {
+	config := Config{
+		Port:            os.Getenv("PORT"),
+		ShutdownTimeout: 30 * time.Second,
+		DrainDelay:      5 * time.Second,
+		Storage:         os.Getenv("STORAGE_BACKEND"),
+		SQLitePath:      os.Getenv("SQLITE_PATH"),
+		EventStream:     os.Getenv("EVENT_STREAM_NAME"),
+		LogEvents:       os.Getenv("LOG_EVENTS") == "true",
+	}
+	if config.Port == "" {
+		config.Port = "8000"
+	}
+	if config.Storage == "" {
+		config.Storage = StorageMongo
+	}
+	if config.EventStream == "" {
+		config.EventStream = "domain-events"
+	}
+	if config.Storage != StorageMongo && config.Storage != StorageSQLite && config.Storage != StorageMemory {
+		return config, fmt.Errorf("invalid STORAGE_BACKEND %q", config.Storage)
+	}
+	if config.SQLitePath == "" {
+		config.SQLitePath = "restaurant.db"
+	}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			config.TrustedProxies = append(config.TrustedProxies, proxy)
+		}
+	}
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return config, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", value)
+		}
+		config.ShutdownTimeout = timeout
+	}
+	if value := os.Getenv("SHUTDOWN_DRAIN_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return config, fmt.Errorf("invalid SHUTDOWN_DRAIN_DELAY %q", value)
+		}
+		config.DrainDelay = delay
+	}
+
+	var err error
+	config.Database, err = database.LoadConfig()
+	return config, err
+}
+
+// App is a server with its storage open, ready to Run.
+type App struct {
+	config    Config
+	storage   *Storage
+	readiness *controller.Readiness
+	events    *events.Bus
+	server    *http.Server
+}
+
+// New opens the storage, sets up the repositories and builds the router.
+// Nothing touches the database before New is called.
+func New(ctx context.Context, config Config) (*App, error) {
+	// Without it no token could be signed
+	if err := helpers.CheckKeyEncryptionKey(); err != nil {
+		return nil, err
+	}
+	storage, err := OpenStorage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	repos := storage.Repositories
+	helpers.UseStorage(repos.Collections)
+	controller.UseStorage(repos.Collections)
+
+	readiness := &controller.Readiness{Storage: storage.Name(), Ping: storage.Ping, Database: storage.Database}
+	router, err := newRouter(repos, readiness, config.TrustedProxies)
+	if err != nil {
+		storage.Close(ctx)
+		return nil, err
+	}
+
+	bus := events.NewBus()
+	if config.LogEvents {
+		bus.Subscribe(events.LogEvents)
+	}
+
+	return &App{
+		config:    config,
+		storage:   storage,
+		readiness: readiness,
+		events:    bus,
+		server: &http.Server{
+			Addr:    ":" + config.Port,
+			Handler: router,
+		},
+	}, nil
+}
+
+// Events is the bus changes to orders, order items and invoices are published
+// on while the app runs. Subscribe before calling Run.
+func (app *App) Events() *events.Bus {
+	return app.events
+}
+
+func newRouter(repos *repository.Repositories, readiness *controller.Readiness, trustedProxies []string) (*gin.Engine, error) {
+	router := gin.New()
+	// Login throttling and the audit log go by c.ClientIP(), which only
+	// believes X-Forwarded-For from these
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	// Probes come every few seconds, so they are kept out of the request log
+	routes.HealthRoutes(router, readiness)
+	router.Use(gin.Logger())
+	router.Use(middleware.Audit(repos.Collections))
+	routes.JwksRoutes(router)
+	routes.UserRoutes(router, repos)
+	routes.DeviceRoutes(router, repos)
+	router.Use(middleware.Authentication())
+
+	routes.FoodRoutes(router, repos)
+	routes.MenuRoutes(router, repos)
+	routes.TableRoutes(router, repos)
+	routes.OrderRoutes(router, repos)
+	routes.OrderItemRoutes(router, repos)
+	routes.InvoiceRoutes(router, repos)
+	routes.ApiKeyRoutes(router)
+	routes.RestaurantRoutes(router)
+	routes.AuditRoutes(router)
+
+	return router, nil
+}
+
+// Run serves until SIGINT or SIGTERM. It then reports not ready for the drain
+// delay, or until a second signal, stops accepting connections, lets
+// in-flight requests finish within the shutdown timeout and closes the
+// databases before returning.
+func (app *App) Run() error {
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	helpers.StartKeyRotation(background)
+
+	// With other storage nothing changes in MongoDB to make events from
+	stopped := make(chan struct{})
+	close(stopped)
+	var eventsStopped <-chan struct{} = stopped
+	if app.config.Storage == StorageMongo {
+		eventsStopped = events.NewStream(app.storage.Database, app.events, app.config.EventStream).Start(background)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", app.server.Addr)
+		served <- app.server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		// The server never came up, so there is nothing to drain
+		stopBackground()
+		<-eventsStopped
+		app.storage.Close(context.Background())
+		return err
+	case received := <-signals:
+		log.Printf("Received %s, shutting down", received)
+	}
+
+	app.readiness.ShutDown()
+	select {
+	case <-time.After(app.config.DrainDelay):
+	case <-signals:
+		log.Print("Received a second signal, skipping the drain delay")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.ShutdownTimeout)
+	defer cancel()
+
+	err := app.server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Requests still running after %s were cut off: %v", app.config.ShutdownTimeout, err)
+	}
+	if serveErr := <-served; serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	stopBackground()
+	<-eventsStopped
+
+	if closeErr := app.storage.Close(ctx); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	log.Print("Shut down")
+	return err
+}
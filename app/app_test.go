@@ -0,0 +1,268 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	controller "restaurant_app/controllers"
+	"restaurant_app/database"
+	"restaurant_app/helpers"
+	"restaurant_app/migrations"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The handlers are run through the server's router against each storage.
+// The SQLite one uses a file of its own. The Mongo one uses the server at
+// MONGODB_URI, in a database of its own that is dropped afterwards, and is
+// skipped when there is none.
+
+func TestHandlersMemory(t *testing.T) {
+	testHandlers(t, repository.NewMemory())
+}
+
+func TestHandlersSQLite(t *testing.T) {
+	db, err := repository.OpenSQLite(filepath.Join(t.TempDir(), "restaurant.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	testHandlers(t, repository.NewSQLite(db))
+}
+
+func TestHandlersMongo(t *testing.T) {
+	config, err := database.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DatabaseName = "restaurant_app_test_" + primitive.NewObjectID().Hex()
+	config.ServerSelectionTimeout = 2 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := database.Connect(ctx, config)
+	if err != nil {
+		t.Skipf("MongoDB is not available at %s: %v", config.URI, err)
+	}
+	db := client.Database(config.DatabaseName)
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	if _, err := migrations.Up(ctx, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	testHandlers(t, repository.NewMongo(db))
+}
+
+// testHandlers creates, reads, updates and deletes every kind of entity as a
+// cross-site admin acting on a new restaurant, and checks that the staff of
+// another restaurant can't reach them.
+func testHandlers(t *testing.T, repos *repository.Repositories) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv(helpers.KeyEncryptionKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	helpers.UseStorage(repos.Collections)
+	controller.UseStorage(repos.Collections)
+
+	router, err := newRouter(repos, &controller.Readiness{Storage: "test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &testClient{t: t, router: router}
+	api.token = staffToken(t, repos, models.RoleAdmin, "")
+
+	restaurant := api.call(http.MethodPost, "/restaurants", gin.H{"name": "Test restaurant"}, "", http.StatusOK)
+	api.restaurantId = restaurant["restaurant_id"].(string)
+
+	menuId := api.create("/menus", gin.H{"name": "Lunch", "category": "Mains"})
+	api.update("/menus/"+menuId, "/menus/"+menuId, gin.H{"name": "Dinner"}, "name", "Dinner")
+
+	foodId := api.create("/foods", gin.H{"name": "Pizza", "price": 10, "food_image": "pizza.png", "menu_id": menuId})
+	api.update("/foods/"+foodId, "/foods/"+foodId, gin.H{"price": 12.5}, "price", 12.5)
+
+	tableId := api.create("tables", gin.H{"number_of_guests": 2, "table_number": 1})
+	api.update("/table/"+tableId, "/tables/"+tableId, gin.H{"number_of_guests": 4}, "number_of_guests", float64(4))
+
+	orderId := api.create("orders", gin.H{"table_id": tableId, "order_date": time.Now().Format(time.RFC3339)})
+	api.update("/order/"+orderId, "/orders/"+orderId, gin.H{"table_id": tableId}, "table_id", tableId)
+
+	created := api.call(http.MethodPost, "orderItems", gin.H{
+		"Table_id":    tableId,
+		"Order_items": []gin.H{{"quantity": "M", "unit_price": 10, "food_id": foodId}},
+	}, "", http.StatusOK)
+	insertedIds := created["InsertedIDs"].([]interface{})
+	if len(insertedIds) != 1 {
+		t.Fatalf("created order items %v, want 1", insertedIds)
+	}
+	orderItemId := insertedIds[0].(string)
+	api.update("/orderItems/"+orderItemId, "/orderItems/"+orderItemId, gin.H{"quantity": "L"}, "quantity", "L")
+	itemOrderId := api.read("/orderItems/" + orderItemId)["order_id"].(string)
+
+	invoiceId := api.create("/invoices", gin.H{"order_id": itemOrderId, "payment_method": "CARD", "payment_status": "PENDING"})
+	api.update("/invoices/"+invoiceId, "/invoices/"+invoiceId, gin.H{"payment_method": "CASH"}, "Payment_method", "CASH")
+
+	userId := api.create("/users/signup", gin.H{
+		"first_name":    "Wendy",
+		"last_name":     "Waiter",
+		"Password":      "waiterpw1",
+		"email":         "wendy@example.com",
+		"phone":         "5550100",
+		"restaurant_id": api.restaurantId,
+	})
+	api.call(http.MethodPost, "/users/"+userId+"/approve", gin.H{"role": models.RoleWaiter}, "", http.StatusOK)
+	api.update("/users/"+userId, "/users/"+userId, gin.H{"first_name": "Wanda"}, "first_name", "Wanda")
+
+	other := api.call(http.MethodPost, "/restaurants", gin.H{"name": "Other restaurant"}, "", http.StatusOK)
+	outsider := &testClient{t: t, router: router, token: staffToken(t, repos, models.RoleManager, other["restaurant_id"].(string))}
+	for _, path := range []string{"/menus/" + menuId, "/foods/" + foodId, "/tables/" + tableId, "/orders/" + orderId, "/orderItems/" + orderItemId, "/invoices/" + invoiceId, "/users/" + userId} {
+		outsider.call(http.MethodGet, path, nil, "", http.StatusNotFound)
+	}
+	outsider.call(http.MethodPatch, "/foods/"+foodId, gin.H{"price": 1}, `"0"`, http.StatusNotFound)
+	outsider.call(http.MethodDelete, "/foods/"+foodId, nil, "", http.StatusNotFound)
+	if foods := outsider.read("/foods")["food_items"].([]interface{}); len(foods) != 0 {
+		t.Fatalf("the other restaurant lists %d foods", len(foods))
+	}
+	outsider.restaurantId = api.restaurantId
+	outsider.call(http.MethodGet, "/foods/"+foodId, nil, "", http.StatusForbidden)
+
+	// Deleted in the order references allow
+	api.delete("/invoices/"+invoiceId, "/invoices/"+invoiceId)
+	api.delete("/orderItems/"+orderItemId, "/orderItems/"+orderItemId)
+	api.delete("/orders/"+itemOrderId, "/orders/"+itemOrderId)
+	api.delete("/orders/"+orderId, "/orders/"+orderId)
+	api.delete("/tables/"+tableId, "/tables/"+tableId)
+	api.delete("/foods/"+foodId, "/foods/"+foodId)
+	api.delete("/menus/"+menuId, "/menus/"+menuId)
+	api.delete("/users/"+userId, "/users/"+userId)
+}
+
+// staffToken stores a user of the role at restaurantId, or a cross-site one
+// when it is empty, and signs an access token for them, as a login does once
+// the password and second factor are checked.
+func staffToken(t *testing.T, repos *repository.Repositories, role string, restaurantId string) string {
+	id := primitive.NewObjectID()
+	firstName, lastName := "Sam", "Staff"
+	email := "staff-" + id.Hex() + "@example.com"
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user := models.User{
+		ID:            id,
+		User_id:       id.Hex(),
+		First_name:    &firstName,
+		Last_name:     &lastName,
+		Email:         &email,
+		Role:          &role,
+		Restaurant_id: restaurantId,
+		Totp_enabled:  true,
+		Created_at:    now,
+		Updated_at:    now,
+	}
+	if err := repos.Users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	token, refreshToken, err := helpers.GenerateAllTokens(email, firstName, lastName, user.User_id, role, restaurantId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := helpers.CreateSession(user, refreshToken, "test", "192.0.2.1", "go test"); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testClient calls the router as an admin acting on restaurantId.
+type testClient struct {
+	t            *testing.T
+	router       *gin.Engine
+	token        string
+	restaurantId string
+}
+
+// call sends body as JSON, with ifMatch unless it is empty, and fails the
+// test unless the response has status. It returns the response's JSON object.
+func (api *testClient) call(method string, path string, body interface{}, ifMatch string, status int) map[string]interface{} {
+	api.t.Helper()
+	response := api.send(method, path, body, ifMatch)
+	if response.Code != status {
+		api.t.Fatalf("%s %s answered %d, want %d: %s", method, path, response.Code, status, response.Body)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &decoded); err != nil {
+		api.t.Fatalf("%s %s answered %s: %v", method, path, response.Body, err)
+	}
+	return decoded
+}
+
+func (api *testClient) send(method string, path string, body interface{}, ifMatch string) *httptest.ResponseRecorder {
+	api.t.Helper()
+	var encoded bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&encoded).Encode(body); err != nil {
+			api.t.Fatal(err)
+		}
+	}
+	request := httptest.NewRequest(method, "/"+strings.TrimPrefix(path, "/"), &encoded)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("token", api.token)
+	if api.restaurantId != "" {
+		request.Header.Set(helpers.RestaurantHeader, api.restaurantId)
+	}
+	if ifMatch != "" {
+		request.Header.Set("If-Match", ifMatch)
+	}
+	response := httptest.NewRecorder()
+	api.router.ServeHTTP(response, request)
+	return response
+}
+
+// create returns the id of what a POST to path created.
+func (api *testClient) create(path string, body interface{}) string {
+	api.t.Helper()
+	created := api.call(http.MethodPost, path, body, "", http.StatusOK)
+	id, ok := created["InsertedID"].(string)
+	if !ok {
+		api.t.Fatalf("POST %s answered %v without an id", path, created)
+	}
+	return id
+}
+
+func (api *testClient) read(path string) map[string]interface{} {
+	api.t.Helper()
+	return api.call(http.MethodGet, path, nil, "", http.StatusOK)
+}
+
+// update patches path with the ETag read from readPath, then checks that
+// readPath shows field at want.
+func (api *testClient) update(path string, readPath string, body interface{}, field string, want interface{}) {
+	api.t.Helper()
+	etag := api.send(http.MethodGet, readPath, nil, "").Header().Get("ETag")
+	if etag == "" {
+		api.t.Fatalf("GET %s sent no ETag", readPath)
+	}
+	api.call(http.MethodPatch, path, body, etag, http.StatusOK)
+	// The ETag is now stale
+	api.call(http.MethodPatch, path, body, etag, http.StatusPreconditionFailed)
+
+	if got := api.read(readPath)[field]; got != want {
+		api.t.Fatalf("GET %s has %s %v after the update, want %v", readPath, field, got, want)
+	}
+}
+
+// delete deletes path and checks that readPath no longer finds it.
+func (api *testClient) delete(path string, readPath string) {
+	api.t.Helper()
+	api.call(http.MethodDelete, path, nil, "", http.StatusOK)
+	api.call(http.MethodGet, readPath, nil, "", http.StatusNotFound)
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"restaurant_app/database"
+	"restaurant_app/migrations"
+	"restaurant_app/repository"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Storage is where the server keeps everything, as Config.Storage picks. The
+// server and the commands that write to its data open it the same way.
+type Storage struct {
+	Repositories *repository.Repositories
+	// The MongoDB database with StorageMongo, otherwise nil
+	Client   *mongo.Client
+	Database *mongo.Database
+	// The SQLite database with StorageSQLite, otherwise nil
+	SQLite *sql.DB
+}
+
+// OpenStorage opens the storage of config. Only StorageMongo connects to
+// MongoDB.
+func OpenStorage(ctx context.Context, config Config) (*Storage, error) {
+	switch config.Storage {
+	case StorageSQLite:
+		sqlite, err := repository.OpenSQLite(config.SQLitePath)
+		if err != nil {
+			return nil, fmt.Errorf("opening SQLite database %s: %w", config.SQLitePath, err)
+		}
+		return &Storage{Repositories: repository.NewSQLite(sqlite), SQLite: sqlite}, nil
+	case StorageMemory:
+		return &Storage{Repositories: repository.NewMemory()}, nil
+	}
+
+	client, err := database.Connect(ctx, config.Database)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	db := client.Database(config.Database.DatabaseName)
+
+	// Migrations are applied separately with cmd/migrate; /readyz reports
+	// not ready until they are
+	if pending, err := migrations.Pending(ctx, db); err != nil {
+		log.Printf("Failed to check for pending migrations: %v", err)
+	} else if pending > 0 {
+		log.Printf("%d database migrations are pending; run \"go run ./cmd/migrate up\"", pending)
+	}
+	return &Storage{Repositories: repository.NewMongo(db), Client: client, Database: db}, nil
+}
+
+// Name is how readiness checks report the storage.
+func (storage *Storage) Name() string {
+	switch {
+	case storage.Client != nil:
+		return "mongodb"
+	case storage.SQLite != nil:
+		return "sqlite"
+	}
+	return "memory"
+}
+
+// Ping checks that the storage answers.
+func (storage *Storage) Ping(ctx context.Context) error {
+	switch {
+	case storage.Client != nil:
+		return storage.Client.Ping(ctx, readpref.Primary())
+	case storage.SQLite != nil:
+		return storage.SQLite.PingContext(ctx)
+	}
+	return nil
+}
+
+func (storage *Storage) Close(ctx context.Context) error {
+	if storage.SQLite != nil {
+		if err := storage.SQLite.Close(); err != nil {
+			log.Printf("Failed to close the SQLite database: %v", err)
+			return err
+		}
+	}
+	if storage.Client != nil {
+		if err := storage.Client.Disconnect(ctx); err != nil {
+			log.Printf("Failed to disconnect from MongoDB: %v", err)
+			return err
+		}
+	}
+	return nil
+}
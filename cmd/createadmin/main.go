@@ -0,0 +1,117 @@
+// Command createadmin creates a cross-site admin. Sign-ups through the API
+// wait for a manager or admin to approve them, so the first admin of a new
+// deployment is created here, by whoever runs the server. It stores the admin
+// where the server would, by STORAGE_BACKEND and the other settings of
+// app.LoadConfig.
+//
+// The password is read from standard input unless -password is given. Once an
+// admin exists, another is only created with -another.
+//
+//	go run ./cmd/createadmin -email admin@example.com -first-name Ada -last-name Admin -phone +15550000000 [-password secret] [-another]
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"restaurant_app/app"
+	controller "restaurant_app/controllers"
+	"restaurant_app/models"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func main() {
+	var email, firstName, lastName, phone, password string
+	var another bool
+	flag.StringVar(&email, "email", "", "email the admin logs in with")
+	flag.StringVar(&firstName, "first-name", "", "first name of the admin")
+	flag.StringVar(&lastName, "last-name", "", "last name of the admin")
+	flag.StringVar(&phone, "phone", "", "phone number of the admin")
+	flag.StringVar(&password, "password", "", "password of the admin; read from standard input when empty")
+	flag.BoolVar(&another, "another", false, "create the admin even if there is one already")
+	flag.Parse()
+
+	if password == "" {
+		var err error
+		if password, err = readPassword(); err != nil {
+			log.Fatalf("Failed to read the password: %v", err)
+		}
+	}
+
+	role := models.RoleAdmin
+	user := models.User{
+		First_name: &firstName,
+		Last_name:  &lastName,
+		Password:   &password,
+		Email:      &email,
+		Phone:      &phone,
+		Role:       &role,
+	}
+	// Held to the same rules as a sign-up
+	if err := validator.New().Struct(user); err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := app.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Storage == app.StorageMemory {
+		log.Fatal("STORAGE_BACKEND is memory, which an admin would not outlive")
+	}
+
+	ctx := context.Background()
+	storage, err := app.OpenStorage(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+	users := storage.Repositories.Users
+
+	hasAdmin, err := users.HasAdmin(ctx)
+	if err != nil {
+		log.Fatalf("Failed to check for existing admins: %v", err)
+	}
+	if hasAdmin && !another {
+		log.Fatal("an admin exists already; pass -another to create one more")
+	}
+	emailTaken, err := users.EmailTaken(ctx, email)
+	if err != nil {
+		log.Fatalf("Failed to check for existing email: %v", err)
+	}
+	if emailTaken {
+		log.Fatalf("email %s is already in use", email)
+	}
+
+	hash := controller.HashPassword(password)
+	user.Password = &hash
+	// Admins work across restaurants, so the admin belongs to none
+	user.Restaurant_id = ""
+	user.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user.Updated_at = user.Created_at
+	user.ID = primitive.NewObjectID()
+	user.User_id = user.ID.Hex()
+	if err := users.Create(ctx, user); err != nil {
+		log.Fatalf("Failed to create the admin: %v", err)
+	}
+	fmt.Printf("Created admin %s (%s); they set up a second factor at their first login\n", email, user.User_id)
+}
+
+// readPassword reads one line, so the password stays out of the shell
+// history and the process list.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
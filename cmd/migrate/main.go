@@ -0,0 +1,88 @@
+// Command migrate applies and undoes the database migrations. It reads the
+// same MONGODB_* settings as the server.
+//
+//	go run ./cmd/migrate up [version]    apply pending migrations, up to version if given
+//	go run ./cmd/migrate down [version]  undo the newest migration, or all above version
+//	go run ./cmd/migrate status          list migrations and whether they are applied
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"restaurant_app/database"
+	"restaurant_app/migrations"
+	"strconv"
+)
+
+const usage = "usage: migrate up [version] | down [version] | status"
+
+func main() {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		log.Fatal(usage)
+	}
+	command := os.Args[1]
+	if command != "up" && command != "down" && command != "status" {
+		log.Fatal(usage)
+	}
+
+	version := -1
+	if len(os.Args) == 3 {
+		parsed, err := strconv.Atoi(os.Args[2])
+		if err != nil || parsed < 0 {
+			log.Fatalf("invalid version %q", os.Args[2])
+		}
+		version = parsed
+	}
+	if command == "status" && version != -1 {
+		log.Fatal(usage)
+	}
+
+	config, err := database.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := database.Connect(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	db := client.Database(config.DatabaseName)
+
+	switch command {
+	case "up":
+		if version == -1 {
+			version = 0
+		}
+		applied, err := migrations.Up(ctx, db, version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Applied %d migrations", len(applied))
+	case "down":
+		if version == -1 {
+			if version, err = migrations.Previous(ctx, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+		undone, err := migrations.Down(ctx, db, version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Undid %d migrations", len(undone))
+	case "status":
+		states, err := migrations.Status(ctx, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.Applied_at != nil {
+				applied = "applied " + state.Applied_at.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-28s  %s\n", state.Version, applied, state.Description)
+		}
+	}
+}
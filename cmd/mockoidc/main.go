@@ -0,0 +1,246 @@
+// Command mockoidc is a stand-in identity provider for trying the OIDC login
+// locally. It signs in whoever is typed into its form, so never expose it.
+//
+//	go run ./cmd/mockoidc
+//	OIDC_ISSUER=http://localhost:9999 OIDC_CLIENT_ID=restaurant-app \
+//	OIDC_ROLE_MAPPING=admins=ADMIN,managers=MANAGER go run .
+//
+// Then open http://localhost:8000/users/oidc/login.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const keyId = "mockoidc"
+
+// authorization is a code handed out by /authorize, waiting for /token.
+type authorization struct {
+	clientId      string
+	redirectUri   string
+	nonce         string
+	codeChallenge string
+	claims        jwt.MapClaims
+	expiresAt     time.Time
+}
+
+var (
+	issuer     = envOrDefault("MOCK_OIDC_ISSUER", "http://localhost:9999")
+	address    = envOrDefault("MOCK_OIDC_ADDR", ":9999")
+	signingKey *rsa.PrivateKey
+
+	codes = struct {
+		sync.Mutex
+		authorizations map[string]authorization
+	}{authorizations: map[string]authorization{}}
+)
+
+var loginForm = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock identity provider</title>
+<h1>Mock identity provider</h1>
+<form method="get" action="/authorize">
+{{range $name, $values := .Query}}<input type="hidden" name="{{$name}}" value="{{index $values 0}}">
+{{end}}<p><label>Email <input name="email" value="admin@example.com"></label>
+<p><label>Name <input name="name" value="Ada Admin"></label>
+<p><label>Groups <input name="groups" value="admins"></label> (comma separated)
+<p><label>Restaurant id <input name="restaurant"></label>
+<p><label><input type="checkbox" name="mfa" value="1"> Passed a second factor</label>
+<p><button name="login" value="1">Sign in</button>
+</form>`))
+
+func main() {
+	var err error
+	signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discovery)
+	http.HandleFunc("/authorize", authorize)
+	http.HandleFunc("/token", token)
+	http.HandleFunc("/jwks", jwks)
+
+	log.Printf("Mock identity provider listening on %s as %s", address, issuer)
+	log.Fatal(http.ListenAndServe(address, nil))
+}
+
+func discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize shows the sign-in form, then redirects back with a code for
+// whoever was entered.
+func authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("login") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginForm.Execute(w, map[string]url.Values{"Query": query})
+		return
+	}
+
+	redirectUri, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectUri.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	email := query.Get("email")
+	firstName, lastName, _ := strings.Cut(query.Get("name"), " ")
+	groups := []string{}
+	for _, group := range strings.Split(query.Get("groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	claims := jwt.MapClaims{
+		"sub":            "mock|" + email,
+		"email":          email,
+		"email_verified": true,
+		"name":           query.Get("name"),
+		"given_name":     firstName,
+		"family_name":    lastName,
+		"groups":         groups,
+	}
+	if restaurant := query.Get("restaurant"); restaurant != "" {
+		claims["restaurant_id"] = restaurant
+	}
+	claims["amr"] = []string{"pwd"}
+	if query.Get("mfa") != "" {
+		claims["amr"] = []string{"pwd", "mfa"}
+	}
+
+	code := randomString()
+	codes.Lock()
+	codes.authorizations[code] = authorization{
+		clientId:      query.Get("client_id"),
+		redirectUri:   query.Get("redirect_uri"),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		claims:        claims,
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	codes.Unlock()
+
+	callback := redirectUri.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectUri.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token. Any client secret is accepted, but
+// the PKCE verifier and redirect URI must match.
+func token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	codes.Lock()
+	auth, found := codes.authorizations[r.PostForm.Get("code")]
+	delete(codes.authorizations, r.PostForm.Get("code"))
+	codes.Unlock()
+
+	clientId, _, hasBasicAuth := r.BasicAuth()
+	if !hasBasicAuth {
+		clientId = r.PostForm.Get("client_id")
+	}
+	if !found || time.Now().After(auth.expiresAt) || clientId != auth.clientId || r.PostForm.Get("redirect_uri") != auth.redirectUri {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if auth.codeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.codeChallenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+	}
+
+	claims := jwt.MapClaims{}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+	now := time.Now()
+	claims["iss"] = issuer
+	claims["aud"] = auth.clientId
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = keyId
+	signedIdToken, err := idToken.SignedString(signingKey)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signedIdToken,
+	})
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	publicKey := signingKey.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomString() string {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,375 @@
+// Command seed fills the database with a demo restaurant: menus, foods,
+// tables, staff and weeks of paid orders with their items and invoices. It
+// stores them where the server would, by STORAGE_BACKEND and the other
+// settings of app.LoadConfig.
+//
+// The same -seed and -until give the same data, ids included, so demos and
+// load tests can be repeated on a fresh database; -until defaults to a fixed
+// day rather than today for that reason. Seeding twice into one database
+// fails, since the ids exist already. The restaurant is stored last, so a
+// seed that fails part way leaves no restaurant behind for its data.
+//
+//	go run ./cmd/seed [-seed 1] [-weeks 4] [-orders-per-day 40] [-tables 12] [-staff 8] [-until 2024-06-30] [-password demo-password]
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"restaurant_app/app"
+	controller "restaurant_app/controllers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultUntil is a fixed day, so runs on different days give the same data.
+const defaultUntil = "2024-06-30"
+
+type options struct {
+	seed         int64
+	weeks        int
+	ordersPerDay int
+	tables       int
+	staff        int
+	until        time.Time
+	password     string
+	name         string
+}
+
+func main() {
+	var opts options
+	var until string
+	flag.Int64Var(&opts.seed, "seed", 1, "random seed; the same seed and -until give the same data")
+	flag.IntVar(&opts.weeks, "weeks", 4, "weeks of order history")
+	flag.IntVar(&opts.ordersPerDay, "orders-per-day", 40, "average orders a day")
+	flag.IntVar(&opts.tables, "tables", 12, "number of tables")
+	flag.IntVar(&opts.staff, "staff", 8, "number of staff users, one of them the manager")
+	flag.StringVar(&until, "until", defaultUntil, "last day of history, as 2006-01-02")
+	flag.StringVar(&opts.password, "password", "demo-password", "password of every staff user")
+	flag.StringVar(&opts.name, "name", "Demo Bistro", "restaurant name")
+	flag.Parse()
+
+	if opts.weeks < 0 || opts.ordersPerDay < 0 || opts.tables < 1 || opts.staff < 1 || len(opts.password) < 6 {
+		log.Fatal("need -weeks and -orders-per-day of 0 or more, at least one table and one staff user, and a password of 6 characters or more")
+	}
+	parsed, err := time.Parse("2006-01-02", until)
+	if err != nil {
+		log.Fatalf("invalid -until %q", until)
+	}
+	opts.until = parsed
+
+	config, err := app.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Storage == app.StorageMemory {
+		log.Fatal("STORAGE_BACKEND is memory, which a seed would not outlive")
+	}
+
+	ctx := context.Background()
+	storage, err := app.OpenStorage(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+
+	s := &seeder{
+		opts:  opts,
+		rand:  rand.New(rand.NewSource(opts.seed)),
+		repos: storage.Repositories,
+	}
+	if err := s.run(ctx, storage.Repositories.Collections.Collection("restaurant")); err != nil {
+		log.Fatalf("%v; the database may have been seeded already", err)
+	}
+}
+
+// seeder draws everything from one random source, in a fixed order, so the
+// same seed makes the same restaurant.
+type seeder struct {
+	opts         options
+	rand         *rand.Rand
+	repos        *repository.Repositories
+	restaurantId string
+
+	foods  []models.Food
+	tables []models.Table
+	counts map[string]int
+}
+
+// objectId draws an id from the seed rather than the clock, so ids repeat
+// along with everything else.
+func (s *seeder) objectId() primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint64(id[:8], s.rand.Uint64())
+	binary.BigEndian.PutUint32(id[8:], s.rand.Uint32())
+	return id
+}
+
+// start is when the history begins, and when everything else was created.
+func (s *seeder) start() time.Time {
+	return s.opts.until.AddDate(0, 0, -7*s.opts.weeks)
+}
+
+// restaurant draws the restaurant, which run stores once everything that
+// belongs to it is.
+func (s *seeder) restaurant() models.Restaurant {
+	address := "1 Market Street"
+	restaurant := models.Restaurant{
+		ID:         s.objectId(),
+		Name:       &s.opts.name,
+		Address:    &address,
+		Created_at: s.start(),
+		Updated_at: s.start(),
+	}
+	restaurant.Restaurant_id = restaurant.ID.Hex()
+	s.restaurantId = restaurant.Restaurant_id
+	return restaurant
+}
+
+func (s *seeder) run(ctx context.Context, restaurants repository.Collection) error {
+	s.counts = map[string]int{}
+	restaurant := s.restaurant()
+	steps := []struct {
+		what string
+		seed func(ctx context.Context) error
+	}{
+		{"menus and foods", s.menus},
+		{"tables", s.seedTables},
+		{"staff", s.seedStaff},
+		{"orders", s.orders},
+	}
+	for _, step := range steps {
+		if err := step.seed(ctx); err != nil {
+			return fmt.Errorf("seeding %s: %w", step.what, err)
+		}
+	}
+	if err := restaurants.Insert(ctx, restaurant); err != nil {
+		return fmt.Errorf("seeding the restaurant: %w", err)
+	}
+	log.Printf("Seeded restaurant %s (%s): %d menus, %d foods, %d tables, %d staff, %d orders, %d order items, %d invoices",
+		s.opts.name, s.restaurantId, s.counts["menu"], s.counts["food"], s.counts["table"], s.counts["user"],
+		s.counts["order"], s.counts["orderItem"], s.counts["invoice"])
+	return nil
+}
+
+// demoMenus are the dishes of the demo restaurant, with the price range each
+// is drawn from.
+var demoMenus = []struct {
+	name, category string
+	foods          []string
+	minPrice       float64
+	maxPrice       float64
+}{
+	{"Starters", "starter", []string{"Tomato Bruschetta", "Garlic Prawns", "Burrata Salad", "French Onion Soup", "Calamari Fritti", "Chicken Wings"}, 6, 13},
+	{"Mains", "main", []string{"Margherita Pizza", "Steak Frites", "Mushroom Risotto", "Grilled Salmon", "Chicken Parmigiana", "Lamb Tagine", "Veggie Burger", "Seafood Linguine"}, 14, 32},
+	{"Desserts", "dessert", []string{"Tiramisu", "Creme Brulee", "Chocolate Fondant", "Lemon Tart", "Affogato"}, 5, 10},
+	{"Drinks", "drink", []string{"Espresso", "Fresh Lemonade", "Sparkling Water", "House Red", "House White", "Craft Lager", "Iced Tea"}, 2.5, 9},
+}
+
+func (s *seeder) menus(ctx context.Context) error {
+	created := s.start()
+	for _, demo := range demoMenus {
+		menu := models.Menu{
+			ID:            s.objectId(),
+			Name:          demo.name,
+			Category:      demo.category,
+			Created_at:    created,
+			Updated_at:    created,
+			Restaurant_id: s.restaurantId,
+		}
+		menu.Menu_id = menu.ID.Hex()
+		if err := s.repos.Menus.Create(ctx, menu); err != nil {
+			return err
+		}
+		s.counts["menu"]++
+
+		for _, name := range demo.foods {
+			name := name
+			// Priced to the half unit, like a real menu
+			price := math.Round((demo.minPrice+s.rand.Float64()*(demo.maxPrice-demo.minPrice))*2) / 2
+			image := "/images/" + strings.ReplaceAll(strings.ToLower(name), " ", "-") + ".jpg"
+			food := models.Food{
+				ID:            s.objectId(),
+				Name:          &name,
+				Price:         &price,
+				Food_image:    &image,
+				Created_at:    created,
+				Updated_at:    created,
+				Menu_id:       &menu.Menu_id,
+				Restaurant_id: s.restaurantId,
+			}
+			food.Food_id = food.ID.Hex()
+			if err := s.repos.Foods.Create(ctx, food); err != nil {
+				return err
+			}
+			s.foods = append(s.foods, food)
+			s.counts["food"]++
+		}
+	}
+	return nil
+}
+
+func (s *seeder) seedTables(ctx context.Context) error {
+	for i := 0; i < s.opts.tables; i++ {
+		number := i + 1
+		guests := []int{2, 2, 4, 4, 6, 8}[s.rand.Intn(6)]
+		table := models.Table{
+			ID:              s.objectId(),
+			Number_of_guest: &guests,
+			Table_number:    &number,
+			Created_at:      s.start(),
+			Updated_at:      s.start(),
+			Table_status:    models.TableFree,
+			Restaurant_id:   s.restaurantId,
+		}
+		table.Table_id = table.ID.Hex()
+		if err := s.repos.Tables.Create(ctx, table); err != nil {
+			return err
+		}
+		s.tables = append(s.tables, table)
+		s.counts["table"]++
+	}
+	return nil
+}
+
+var (
+	firstNames = []string{"Ana", "Ben", "Chloe", "Dev", "Elena", "Farid", "Grace", "Hugo", "Ines", "Jonas", "Kemi", "Liam", "Mei", "Nico", "Olga", "Priya"}
+	lastNames  = []string{"Silva", "Okafor", "Martin", "Patel", "Rossi", "Haddad", "Kim", "Dubois", "Novak", "Moreau", "Tanaka", "Walsh"}
+	// After the manager, staff take these roles in turn
+	staffRoles = []string{models.RoleWaiter, models.RoleKitchen, models.RoleWaiter, models.RoleCashier}
+)
+
+func (s *seeder) seedStaff(ctx context.Context) error {
+	// Every user has the same password, so it is hashed once
+	password := controller.HashPassword(s.opts.password)
+	domain := strings.ReplaceAll(strings.ToLower(s.opts.name), " ", "-") + ".test"
+
+	for i := 0; i < s.opts.staff; i++ {
+		role := models.RoleManager
+		if i > 0 {
+			role = staffRoles[(i-1)%len(staffRoles)]
+		}
+		firstName := firstNames[s.rand.Intn(len(firstNames))]
+		lastName := lastNames[s.rand.Intn(len(lastNames))]
+		// Numbered, so drawing the same name twice still gives unique logins
+		email := fmt.Sprintf("%s.%s%d@%s", strings.ToLower(firstName), strings.ToLower(lastName), i+1, domain)
+		phone := fmt.Sprintf("+1555%07d", s.rand.Intn(1000)*10000+i)
+
+		user := models.User{
+			ID:            s.objectId(),
+			First_name:    &firstName,
+			Last_name:     &lastName,
+			Password:      &password,
+			Email:         &email,
+			Phone:         &phone,
+			Role:          &role,
+			Restaurant_id: s.restaurantId,
+			Created_at:    s.start(),
+			Updated_at:    s.start(),
+		}
+		user.User_id = user.ID.Hex()
+		if err := s.repos.Users.Create(ctx, user); err != nil {
+			return err
+		}
+		if i == 0 {
+			log.Printf("Manager login: %s with password %q", email, s.opts.password)
+		}
+		s.counts["user"]++
+	}
+	return nil
+}
+
+// orders makes each day's orders, busier on weekends, spread over lunch and
+// dinner. Every one has been paid.
+func (s *seeder) orders(ctx context.Context) error {
+	quantities := []string{"S", "M", "M", "L"}
+	methods := []string{"CARD", "CARD", "CARD", "CASH"}
+
+	for day := s.start(); day.Before(s.opts.until.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+		count := s.opts.ordersPerDay
+		if weekday := day.Weekday(); weekday == time.Friday || weekday == time.Saturday {
+			count = count * 3 / 2
+		}
+		// Give or take a fifth
+		if spread := count / 5; spread > 0 {
+			count += s.rand.Intn(2*spread+1) - spread
+		}
+
+		for i := 0; i < count; i++ {
+			// Two thirds at dinner, from 18:00, the rest at lunch, from 12:00
+			hour := 12
+			if s.rand.Intn(3) > 0 {
+				hour = 18
+			}
+			orderedAt := day.Add(time.Duration(hour)*time.Hour + time.Duration(s.rand.Intn(4*60*60))*time.Second)
+			paidAt := orderedAt.Add(time.Duration(30+s.rand.Intn(60)) * time.Minute)
+
+			table := s.tables[s.rand.Intn(len(s.tables))]
+			order := models.Order{
+				ID:            s.objectId(),
+				Order_Date:    orderedAt,
+				Created_at:    orderedAt,
+				Updated_at:    paidAt,
+				Table_id:      &table.Table_id,
+				Order_status:  models.OrderPaid,
+				Restaurant_id: s.restaurantId,
+			}
+			order.Order_id = order.ID.Hex()
+
+			var orderItems []models.OrderItem
+			for n := 1 + s.rand.Intn(5); n > 0; n-- {
+				food := s.foods[s.rand.Intn(len(s.foods))]
+				quantity := quantities[s.rand.Intn(len(quantities))]
+				orderItem := models.OrderItem{
+					ID:            s.objectId(),
+					Quantity:      &quantity,
+					Unit_price:    food.Price,
+					Created_at:    orderedAt,
+					Updated_at:    orderedAt,
+					Food_id:       &food.Food_id,
+					Order_id:      order.Order_id,
+					Restaurant_id: s.restaurantId,
+				}
+				orderItem.Order_item_id = orderItem.ID.Hex()
+				orderItems = append(orderItems, orderItem)
+			}
+
+			paymentMethod := methods[s.rand.Intn(len(methods))]
+			paymentStatus := "PAID"
+			invoice := models.Invoice{
+				ID:               s.objectId(),
+				Order_id:         order.Order_id,
+				Payment_method:   &paymentMethod,
+				Payment_status:   &paymentStatus,
+				Payment_due_date: paidAt,
+				Created_at:       paidAt,
+				Updated_at:       paidAt,
+				Restaurant_id:    s.restaurantId,
+			}
+			invoice.Invoice_id = invoice.ID.Hex()
+
+			if err := s.repos.Orders.Create(ctx, order); err != nil {
+				return err
+			}
+			if err := s.repos.OrderItems.CreateMany(ctx, orderItems); err != nil {
+				return err
+			}
+			if err := s.repos.Invoices.Create(ctx, invoice); err != nil {
+				return err
+			}
+			s.counts["order"]++
+			s.counts["orderItem"] += len(orderItems)
+			s.counts["invoice"]++
+		}
+	}
+	return nil
+}
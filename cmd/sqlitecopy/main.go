@@ -0,0 +1,55 @@
+// Command sqlitecopy copies the restaurant's entities, sessions, signing keys,
+// audit log and everything else the server keeps from MongoDB into a new
+// SQLite database, to move a deployment to STORAGE_BACKEND=sqlite. It reads
+// the same MONGODB_* settings as the server, and SQLITE_PATH unless a path
+// is given. Stop the server first so nothing changes during the copy.
+//
+//	go run ./cmd/sqlitecopy [path]
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"restaurant_app/database"
+	"restaurant_app/repository"
+)
+
+func main() {
+	if len(os.Args) > 2 {
+		log.Fatal("usage: sqlitecopy [path]")
+	}
+	path := os.Getenv("SQLITE_PATH")
+	if len(os.Args) == 2 {
+		path = os.Args[1]
+	}
+	if path == "" {
+		path = "restaurant.db"
+	}
+
+	config, err := database.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := database.Connect(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	sqlite, err := repository.OpenSQLite(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	copied, err := repository.CopyFromMongo(ctx, client.Database(config.DatabaseName), sqlite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for collection, count := range copied {
+		log.Printf("Copied %d %s documents", count, collection)
+	}
+	log.Printf("Copied into %s", path)
+}
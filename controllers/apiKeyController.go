@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+
+func GetApiKeys() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		// Decoded into the model so the key hash is never sent back
+		allApiKeys := []models.ApiKey{}
+		if err := apiKeyCollection.Find(ctx, tenantScope(c, bson.M{}), repository.FindOptions{}, &allApiKeys); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing api keys"})
+			return
+		}
+		c.JSON(http.StatusOK, allApiKeys)
+	}
+}
+
+// CreateApiKey issues a key for a machine client. The key itself is only
+// part of this response; afterwards just its hash is known.
+func CreateApiKey() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var apiKey models.ApiKey
+
+		if err := c.BindJSON(&apiKey); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(apiKey)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+		for _, scope := range apiKey.Scopes{
+			if !helpers.ValidScope(scope){
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid scope " + scope + `, expected e.g. "invoice:read"`})
+				return
+			}
+		}
+
+		apiKey.ID = primitive.NewObjectID()
+		apiKey.Api_key_id = apiKey.ID.Hex()
+		apiKey.Created_by = c.GetString("uid")
+		// Keys of a cross-site admin who has not picked a restaurant are cross-site too
+		apiKey.Restaurant_id = c.GetString("restaurantId")
+		if apiKey.Restaurant_id == "" && *apiKey.Role != models.RoleAdmin{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pick a restaurant with the X-Restaurant-Id header"})
+			return
+		}
+		apiKey.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		apiKey.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		apiKey.Last_used_at = nil
+		apiKey.Revoked_at = nil
+
+		key, keyHash, err := helpers.GenerateApiKey(apiKey.Api_key_id)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "api key was not created"})
+			return
+		}
+		apiKey.Key_hash = keyHash
+
+		insertErr := apiKeyCollection.Insert(ctx, apiKey)
+		if insertErr != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "api key was not created"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"api_key": key, "details": apiKey})
+	}
+}
+
+func RevokeApiKey() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		apiKeyId := c.Param("api_key_id")
+
+		var updateObj primitive.D
+
+		now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "revoked_at", Value: now})
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: now})
+
+		result, err := apiKeyCollection.UpdateOne(
+			ctx,
+			tenantScope(c, bson.M{"api_key_id": apiKeyId, "revoked_at": nil}),
+			bson.D{{Key: "$set", Value: updateObj}},
+			false,
+		)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "api key revocation failed"})
+			return
+		}
+		if result.MatchedCount == 0{
+			c.JSON(http.StatusNotFound, gin.H{"error": "active api key was not found"})
+			return
+		}
+		helpers.ForgetApiKey(apiKeyId)
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GetAuditEntries lists the audit log, newest first, one page at a time.
+// Optional query parameters: user_id, entity, entity_id, method, route,
+// status and from/to as RFC3339 times.
+func GetAuditEntries() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		recordPerPage, err := strconv.Atoi(c.DefaultQuery("recordPerPage", "50"))
+		if err != nil || recordPerPage < 1{
+			recordPerPage = 50
+		}
+		if recordPerPage > 500{
+			recordPerPage = 500
+		}
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1{
+			page = 1
+		}
+
+		filter := tenantScope(c, bson.M{})
+		for _, field := range []string{"user_id", "entity", "entity_id", "route"}{
+			if value := c.Query(field); value != ""{
+				filter[field] = value
+			}
+		}
+		if method := c.Query("method"); method != ""{
+			filter["method"] = strings.ToUpper(method)
+		}
+		if status := c.Query("status"); status != ""{
+			code, err := strconv.Atoi(status)
+			if err != nil{
+				c.JSON(http.StatusBadRequest, gin.H{"error": "status must be a number"})
+				return
+			}
+			filter["status"] = code
+		}
+
+		createdAt := bson.M{}
+		for param, operator := range map[string]string{"from": "$gte", "to": "$lte"}{
+			value := c.Query(param)
+			if value == ""{
+				continue
+			}
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil{
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC3339 time"})
+				return
+			}
+			createdAt[operator] = at
+		}
+		if len(createdAt) > 0{
+			filter["created_at"] = createdAt
+		}
+
+		totalCount, err := auditCollection.Count(ctx, filter)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing the audit log"})
+			return
+		}
+
+		opts := repository.FindOptions{
+			Sort: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+			Skip: int64((page - 1) * recordPerPage),
+			Limit: int64(recordPerPage),
+		}
+		allEntries := []models.AuditEntry{}
+		if err := auditCollection.Find(ctx, filter, opts, &allEntries); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing the audit log"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"total_count": totalCount,
+			"page": page,
+			"record_per_page": recordPerPage,
+			"audit_items": allEntries,
+		})
+	}
+}
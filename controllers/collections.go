@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"restaurant_app/repository"
+)
+
+// Collections the handlers still use directly. The restaurant's entities
+// are reached through the repositories each handler is given.
+var (
+	apiKeyCollection        repository.Collection
+	auditCollection         repository.Collection
+	deviceCollection        repository.Collection
+	passwordResetCollection repository.Collection
+	restaurantCollection    repository.Collection
+)
+
+// UseStorage points the handlers at the collections of the configured
+// storage. The app calls it once storage is open, before any route is served.
+func UseStorage(collections repository.Collections){
+	apiKeyCollection = collections.Collection("apiKey")
+	auditCollection = collections.Collection("audit")
+	deviceCollection = collections.Collection("device")
+	passwordResetCollection = collections.Collection("passwordReset")
+	restaurantCollection = collections.Collection("restaurant")
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// setETag sends the version of the entity the response is about.
+func setETag(c *gin.Context, version int64){
+	c.Header("ETag", helpers.ETag(version))
+}
+
+// requireIfMatch returns the version the client last saw, from If-Match, so
+// an update can't overwrite changes it never saw. It responds 428 without
+// the header, 400 when it is malformed and 412 for a weak tag, which never
+// matches. The version is nil for "*".
+func requireIfMatch(c *gin.Context) (*int64, bool){
+	header := c.GetHeader("If-Match")
+	if header == ""{
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "send the ETag you last read in an If-Match header"})
+		return nil, false
+	}
+	version, anyVersion, err := helpers.ParseIfMatch(header)
+	if err == helpers.ErrWeakIfMatch{
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match needs the ETag itself, not a weak tag"})
+		return nil, false
+	}
+	if err != nil{
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if anyVersion{
+		return nil, true
+	}
+	return &version, true
+}
+
+// updateIfMatch updates the entity if it is still at version, or whatever
+// version it is at when version is nil. It never creates one.
+func updateIfMatch[T any](ctx context.Context, store repository.Store[T], restaurantId string, id string, version *int64, set bson.D) (repository.UpdateResult, error){
+	if version != nil{
+		return store.UpdateVersion(ctx, restaurantId, id, *version, set)
+	}
+	result, err := store.Update(ctx, restaurantId, id, set)
+	if err == nil && result.MatchedCount == 0{
+		return result, repository.ErrNotFound
+	}
+	return result, err
+}
+
+// respondUpdated answers a successful update, with the ETag of the new
+// version when the client named the one it replaced.
+func respondUpdated(c *gin.Context, version *int64, result repository.UpdateResult){
+	if version != nil{
+		setETag(c, *version+1)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// respondUpdateError answers for an update of an entity that failed: 404
+// when there is none, 412 when someone else changed it first, otherwise 500
+// with msg.
+func respondUpdateError(c *gin.Context, err error, entity string, msg string){
+	switch err{
+	case repository.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": entity + " was not found"})
+	case repository.ErrVersionConflict:
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": entity + " was changed by someone else since you read it; fetch it again and retry"})
+	default:
+		respondTransactionError(c, err, msg)
+	}
+}
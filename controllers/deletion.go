@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"restaurant_app/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// refusal is why an entity can't be deleted or restored as things stand,
+// such as other entities still referring to it. It is answered with 409.
+type refusal string
+
+func (r refusal) Error() string{
+	return string(r)
+}
+
+// refuseIfAny refuses with reason when an entity of store that is not
+// deleted has field set to id.
+func refuseIfAny[T any](ctx context.Context, store repository.Store[T], restaurantId string, field string, id string, reason string) error{
+	found, err := store.AnyWith(ctx, restaurantId, field, id)
+	if err != nil{
+		return err
+	}
+	if found{
+		return refusal(reason)
+	}
+	return nil
+}
+
+// softDelete marks the entity deleted by the caller, once guard, when there
+// is one, allows it. Both happen in one transaction, along with whatever
+// guard changes. It answers failures itself.
+func softDelete[T any](c *gin.Context, transactions repository.Transactions, store repository.Store[T], restaurantId string, id string, entity string, guard func(ctx context.Context) error) bool{
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	err := transactions.InTransaction(ctx, func(ctx context.Context) error{
+		if guard != nil{
+			if err := guard(ctx); err != nil{
+				return err
+			}
+		}
+		return store.Delete(ctx, restaurantId, id, c.GetString("uid"))
+	})
+	if err != nil{
+		respondDeletionError(c, err, entity, entity + " was not deleted")
+		return false
+	}
+	return true
+}
+
+// restoreDeleted restores a deleted entity, then lets check refuse, which
+// undoes the restore, when something the entity refers to is gone.
+func restoreDeleted[T any](c *gin.Context, transactions repository.Transactions, store repository.Store[T], restaurantId string, id string, entity string, check func(ctx context.Context, restored T) error) bool{
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	err := transactions.InTransaction(ctx, func(ctx context.Context) error{
+		if err := store.Restore(ctx, restaurantId, id); err != nil{
+			return err
+		}
+		if check == nil{
+			return nil
+		}
+		restored, err := store.Get(ctx, restaurantId, id)
+		if err != nil{
+			return err
+		}
+		return check(ctx, restored)
+	})
+	if err != nil{
+		respondDeletionError(c, err, "deleted " + entity, entity + " was not restored")
+		return false
+	}
+	return true
+}
+
+// purgeDeleted removes a deleted entity for good.
+func purgeDeleted[T any](c *gin.Context, store repository.Store[T], restaurantId string, id string, entity string) bool{
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	if err := store.Purge(ctx, restaurantId, id); err != nil{
+		respondDeletionError(c, err, "deleted " + entity, entity + " was not purged")
+		return false
+	}
+	return true
+}
+
+// parentGone refuses when a lookup of something an entity refers to found
+// nothing, or returns its error.
+func parentGone(err error, reason string) error{
+	if err == repository.ErrNotFound{
+		return refusal(reason)
+	}
+	return err
+}
+
+// respondDeletionError answers 404 when there is no such entity, 409 for a
+// refusal or a restore that would repeat a unique value, such as the order of
+// a live invoice, otherwise like respondTransactionError.
+func respondDeletionError(c *gin.Context, err error, entity string, msg string){
+	var reason refusal
+	switch {
+	case err == repository.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": entity + " was not found"})
+	case errors.As(err, &reason):
+		c.JSON(http.StatusConflict, gin.H{"error": string(reason)})
+	case errors.Is(err, repository.ErrDuplicate):
+		c.JSON(http.StatusConflict, gin.H{"error": entity + " clashes with one that is not deleted; delete that first"})
+	default:
+		respondTransactionError(c, err, msg)
+	}
+}
@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type DeviceAuthenticateRequest struct{
+	Device_credential	*string		`json:"device_credential" validate:"required"`
+}
+
+type PinLoginRequest struct{
+	User_id				*string		`json:"user_id" validate:"required"`
+	Pin					*string		`json:"pin" validate:"required,numeric,min=4,max=6"`
+}
+
+type TerminalStaffFormat struct{
+	User_id				string		`json:"user_id"`
+	First_name			*string		`json:"first_name"`
+	Last_name			*string		`json:"last_name"`
+	Role				*string		`json:"role"`
+}
+
+func GetDevices() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		allDevices := []models.Device{}
+		if err := deviceCollection.Find(ctx, tenantScope(c, bson.M{}), repository.FindOptions{}, &allDevices); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing devices"})
+			return
+		}
+		c.JSON(http.StatusOK, allDevices)
+	}
+}
+
+// RegisterDevice adds a shared terminal. The credential in the response is
+// entered on the terminal once and is not shown again.
+func RegisterDevice() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var device models.Device
+
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
+		if err := c.BindJSON(&device); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(device)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		device.ID = primitive.NewObjectID()
+		device.Device_id = device.ID.Hex()
+		device.Restaurant_id = restaurantId
+		device.Registered_by = c.GetString("uid")
+		device.Active_user_id = nil
+		device.Active_token_id = nil
+		device.Last_activity_at = nil
+		device.Revoked_at = nil
+		device.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		device.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+
+		credential, secretHash, err := helpers.GenerateDeviceCredential(device.Device_id)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "device was not registered"})
+			return
+		}
+		device.Secret_hash = secretHash
+
+		insertErr := deviceCollection.Insert(ctx, device)
+		if insertErr != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "device was not registered"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"device_credential": credential, "details": device})
+	}
+}
+
+func RevokeDevice() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		deviceId := c.Param("device_id")
+
+		var updateObj primitive.D
+
+		now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "revoked_at", Value: now})
+		updateObj = append(updateObj, bson.E{Key: "active_user_id", Value: nil})
+		updateObj = append(updateObj, bson.E{Key: "active_token_id", Value: nil})
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: now})
+
+		result, err := deviceCollection.UpdateOne(
+			ctx,
+			tenantScope(c, bson.M{"device_id": deviceId, "revoked_at": nil}),
+			bson.D{{Key: "$set", Value: updateObj}},
+			false,
+		)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "device revocation failed"})
+			return
+		}
+		if result.MatchedCount == 0{
+			c.JSON(http.StatusNotFound, gin.H{"error": "active device was not found"})
+			return
+		}
+		helpers.ForgetDevice(deviceId)
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// AuthenticateDevice trades the device credential for a device token, which
+// the terminal then uses for PIN logins.
+func AuthenticateDevice() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var request DeviceAuthenticateRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		device, err := helpers.ValidateDeviceCredential(*request.Device_credential)
+		if err == helpers.ErrInvalidDevice{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid device credential"})
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the device"})
+			return
+		}
+
+		deviceToken, err := helpers.GenerateDeviceToken(device.Device_id)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"device_token": deviceToken, "device_id": device.Device_id})
+	}
+}
+
+// GetTerminalStaff lists who can log in with a PIN, for the terminal's
+// user picker.
+func GetTerminalStaff(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		staff, err := users.PinStaff(ctx, c.GetString("restaurantId"))
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing staff"})
+			return
+		}
+
+		allStaff := []TerminalStaffFormat{}
+		for _, user := range staff{
+			if !pinLoginAllowed(user){
+				continue
+			}
+			allStaff = append(allStaff, TerminalStaffFormat{
+				User_id: user.User_id,
+				First_name: user.First_name,
+				Last_name: user.Last_name,
+				Role: user.Role,
+			})
+		}
+		c.JSON(http.StatusOK, allStaff)
+	}
+}
+
+// PinLogin switches the terminal to another member of staff. The token it
+// returns only works on this device, until the next PIN login there, until
+// the terminal has been idle for too long or until it expires.
+func PinLogin(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request PinLoginRequest
+		deviceId := c.GetString("deviceId")
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		throttleKey := helpers.PinThrottleKey(*request.User_id)
+		deviceKey := helpers.PinDeviceThrottleKey(deviceId)
+		retryAfter, err := helpers.LoginRetryAfter(throttleKey, deviceKey)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+			return
+		}
+		if retryAfter > 0{
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many PIN attempts, try again later"})
+			return
+		}
+
+		incorrect := gin.H{"error": "PIN is incorrect"}
+
+		foundUser, err := users.Get(ctx, c.GetString("restaurantId"), *request.User_id)
+		if err != nil || foundUser.Pin_hash == nil || !pinLoginAllowed(foundUser){
+			c.JSON(http.StatusUnauthorized, incorrect)
+			return
+		}
+		if foundUser.Pin_locked_at != nil{
+			c.JSON(http.StatusForbidden, gin.H{"error": "PIN login is locked, log in with your password to unlock it"})
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(*foundUser.Pin_hash), []byte(*request.Pin)) != nil{
+			if err := helpers.RecordLoginFailure(throttleKey, deviceKey); err != nil{
+				log.Printf("Failed to record PIN failure: %v", err)
+			}
+			if err := lockPinAfterTooManyFailures(ctx, users, foundUser.User_id, throttleKey); err != nil{
+				log.Printf("Failed to lock PIN login: %v", err)
+			}
+			c.JSON(http.StatusUnauthorized, incorrect)
+			return
+		}
+		// The device's failures keep counting, so that one terminal can't
+		// go on guessing with a PIN it knows in between
+		helpers.ResetLoginFailures(throttleKey)
+
+		token, tokenId, err := helpers.GenerateTerminalToken(*foundUser.Email, *foundUser.First_name, *foundUser.Last_name, foundUser.User_id, roleOf(foundUser), foundUser.Restaurant_id, deviceId)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+			return
+		}
+		if err := helpers.StartTerminalSession(deviceId, foundUser.User_id, tokenId); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start the terminal session"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Login successful",
+			"token": token,
+			"expires_in": int(helpers.TERMINAL_SESSION_TTL.Seconds()),
+			"idle_timeout": int(helpers.TERMINAL_IDLE_TIMEOUT.Seconds()),
+		})
+	}
+}
+
+// LockTerminal ends the current PIN session, e.g. when a waiter walks away.
+func LockTerminal() gin.HandlerFunc{
+	return func(c *gin.Context){
+		if err := helpers.LockDevice(c.GetString("deviceId")); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock the terminal"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Terminal locked"})
+	}
+}
+
+// lockPinAfterTooManyFailures locks the user's PIN login once their PIN
+// throttle locks. Unlike the throttle, the lock stays until they log in with
+// their password.
+func lockPinAfterTooManyFailures(ctx context.Context, users repository.Users, userId string, throttleKey string) error{
+	locked, err := helpers.LoginLocked(throttleKey)
+	if err != nil || !locked{
+		return err
+	}
+
+	var updateObj primitive.D
+
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "pin_locked_at", Value: now})
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: now})
+
+	if _, err := users.Update(ctx, "", userId, updateObj); err != nil{
+		return err
+	}
+	log.Printf("PIN login locked for user %s", userId)
+	return helpers.ResetLoginFailures(throttleKey)
+}
+
+// pinLoginAllowed keeps accounts that must use a second factor, and
+// deactivated ones, off the shared terminals.
+func pinLoginAllowed(user models.User) bool{
+	return user.Deactivated_at == nil && user.Role != nil && !helpers.TotpRequired(*user.Role)
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// pinRouter serves PIN login for a terminal of restaurantId, as
+// DeviceAuthentication would, and password login.
+func pinRouter(repos *repository.Repositories, deviceId string, restaurantId string) *gin.Engine {
+	router := gin.New()
+	router.POST("/terminal/pin-login", func(c *gin.Context) {
+		c.Set("deviceId", deviceId)
+		c.Set("restaurantId", restaurantId)
+	}, PinLogin(repos.Users))
+	router.POST("/users/login", Login(repos.Users))
+	return router
+}
+
+// outwaitThrottle moves every recorded failure back in time, as if the
+// attempts had been spread out, so the throttle's delay has passed but the
+// failures still count.
+func outwaitThrottle(t *testing.T, collections repository.Collections) {
+	t.Helper()
+	_, err := collections.Collection("loginAttempt").UpdateMany(
+		context.Background(),
+		bson.M{},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_failure", Value: time.Now().Add(-10 * time.Minute)}}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinLoginLocksUntilPasswordLogin(t *testing.T) {
+	repos := useMemoryStorage(t)
+	user := createUser(t, repos.Users, models.RoleWaiter, "restaurant-1", "waiterpw1", "1234")
+	router := pinRouter(repos, "device-1", "restaurant-1")
+
+	pinLogin := func(pin string, want int) {
+		t.Helper()
+		if status, body := post(t, router, "/terminal/pin-login", gin.H{"user_id": user.User_id, "pin": pin}); status != want {
+			t.Fatalf("PIN login with %s answered %d, want %d: %v", pin, status, want, body)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		pinLogin("9999", http.StatusUnauthorized)
+	}
+	// Right away, even the right PIN has to wait
+	pinLogin("1234", http.StatusTooManyRequests)
+
+	for i := 3; i < 5; i++ {
+		outwaitThrottle(t, repos.Collections)
+		pinLogin("9999", http.StatusUnauthorized)
+	}
+	locked, err := repos.Users.Get(context.Background(), "", user.User_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked.Pin_locked_at == nil {
+		t.Fatal("PIN login is not locked after 5 wrong PINs")
+	}
+
+	// The lock outlasts the throttle
+	outwaitThrottle(t, repos.Collections)
+	pinLogin("1234", http.StatusForbidden)
+
+	if status, body := post(t, router, "/users/login", gin.H{"email": *user.Email, "password": "waiterpw1"}); status != http.StatusOK {
+		t.Fatalf("password login answered %d: %v", status, body)
+	}
+	pinLogin("1234", http.StatusOK)
+}
+
+func TestPinLoginThrottlesTheDevice(t *testing.T) {
+	repos := useMemoryStorage(t)
+	router := pinRouter(repos, "device-1", "restaurant-1")
+
+	// Four guesses each at the PINs of five colleagues stay under every
+	// user's lock but lock the terminal
+	for i := 0; i < 5; i++ {
+		user := createUser(t, repos.Users, models.RoleWaiter, "restaurant-1", "waiterpw1", "1234")
+		for j := 0; j < 4; j++ {
+			outwaitThrottle(t, repos.Collections)
+			if status, body := post(t, router, "/terminal/pin-login", gin.H{"user_id": user.User_id, "pin": "9999"}); status != http.StatusUnauthorized {
+				t.Fatalf("wrong PIN answered %d: %v", status, body)
+			}
+		}
+	}
+
+	user := createUser(t, repos.Users, models.RoleWaiter, "restaurant-1", "waiterpw1", "1234")
+	outwaitThrottle(t, repos.Collections)
+	if status, body := post(t, router, "/terminal/pin-login", gin.H{"user_id": user.User_id, "pin": "1234"}); status != http.StatusTooManyRequests {
+		t.Fatalf("the locked terminal answered %d: %v", status, body)
+	}
+	if locked, err := helpers.LoginLocked(helpers.PinDeviceThrottleKey("device-1")); err != nil || !locked {
+		t.Fatalf("the terminal is not locked (%v)", err)
+	}
+
+	// Another terminal is unaffected
+	if status, body := post(t, pinRouter(repos, "device-2", "restaurant-1"), "/terminal/pin-login", gin.H{"user_id": user.User_id, "pin": "1234"}); status != http.StatusOK {
+		t.Fatalf("another terminal answered %d: %v", status, body)
+	}
+}
@@ -5,26 +5,19 @@ import (
 	"fmt"
 	"math"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 
-var foodCollection *mongo.Collection = database.OpenCollection(database.Client, "food")
 
-var validate validator.New()
-
-
-func GetFoods() gin.HandlerFunc {
+func GetFoods(foods repository.Foods) gin.HandlerFunc {
     return func(c *gin.Context) {
         // Context with timeout for database operations
         ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
@@ -42,69 +35,57 @@ func GetFoods() gin.HandlerFunc {
         }
 
         startIndex := (page - 1) * recordPerPage
-		startIndex, err = strconv.Atoi(c.Query("startIndex"))
-
-        // MongoDB aggregation pipeline
-        matchStage := bson.D{{Key: "$match", Value: bson.D{{}}}} // Adjust this to filter your documents if needed
-
-        // We will now use the groupStage to count documents
-        groupStage := bson.D{
-            {Key: "$group", Value: bson.D{
-                {Key: "_id", Value: nil}, // Grouping without a specific field to count all
-                {Key: "total_count", Value: bson.D{{Key: "$sum", Value: 1}}}, {Key: "data", Value: bson.D{{Key: "$push", Value: "$$ROOT"}}},
-            }},
+        if c.Query("startIndex") != "" {
+            startIndex, err = strconv.Atoi(c.Query("startIndex"))
+            if err != nil || startIndex < 0 {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "startIndex must be a positive number"})
+                return
+            }
         }
 
-        // Projection stage to shape the output, including a pagination mechanism on a field "data"
-        projectStage := bson.D{
-            {Key: "$project", Value: bson.D{
-                {Key: "_id", Value: 0},
-                {Key: "total_count", Value: 1}, // Include total count in the output
-                {Key: "food_items", Value: bson.D{{Key: "$slice", Value: []interface{}{"$data", startIndex, recordPerPage}}}}, // Paginate "data" array
-            }}}
-        // Build the pipeline with all stages
-        pipeline := mongo.Pipeline{matchStage, groupStage, projectStage}
-
-        // Execute the aggregation query
-        result, err := foodCollection.Aggregate(ctx, pipeline)
+        allFoods, totalCount, err := foods.Page(ctx, restaurantOf(c), startIndex, recordPerPage)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute query:"})
             return
         }
 
-        var allFoods []bson.M
-        if err := result.All(ctx, &allFoods); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode results"})
-            return
-        }
-
-        c.JSON(http.StatusOK, allFoods[0])
+        c.JSON(http.StatusOK, gin.H{"total_count": totalCount, "food_items": allFoods})
     }
 }
 
-func GetFood() gin.HandlerFunc {
+func GetFood(foods repository.Foods) gin.HandlerFunc {
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		foodId := c.Param("food_id")
-		var food models.Food
 
-		err := foodCollection.FindOne(ctx, bson.M{"food_id": foodId}).Decode(&food)
+		food, err := foods.Get(ctx, restaurantOf(c), foodId)
 		defer cancel()
 
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"Error": "food item was not found"})
+			return
+		}
 		if err!= nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"Error": "Error occured while fetching the food item"})
+			return
 		}
+		setETag(c, food.Version)
 		c.JSON(http.StatusOK, food)
 
 	}
 }
 
-func CreateFood() gin.HandlerFunc{
+func CreateFood(foods repository.Foods, menus repository.Menus) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		var menu models.Menu
+		defer cancel()
 		var food models.Food
 
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
 		if err := c.BindJSON(&food); err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error":err.Error()})
 			return
@@ -115,7 +96,7 @@ func CreateFood() gin.HandlerFunc{
 			return
 		}
 		// To confirm the menu exist before creating the food
-		err := menuCollection.FindOne(ctx, bson.M{"menu_id": food.Menu_id}).Decode(&menu)
+		_, err := menus.Get(ctx, restaurantId, *food.Menu_id)
 		if err!= nil{
 			msg := fmt.Sprintf("menu was not found")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
@@ -125,17 +106,21 @@ func CreateFood() gin.HandlerFunc{
 		food.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		food.ID = primitive.NewObjectID()
 		food.Food_id = food.ID.Hex()
+		food.Restaurant_id = restaurantId
+		// Versions and deletion are managed by the server only
+		food.Version = 0
+		food.Deleted_at = nil
+		food.Deleted_by = nil
 		var num = toFixed(*food.Price, 2)
 		food.Price = &num
 
-		result, insertErr := foodCollection.InsertOne(ctx, food)
+		insertErr := foods.Create(ctx, food)
 		if insertErr!= nil{
 			msg := fmt.Sprintf("Food item was not created")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 			return
 		}
-		defer cancel()
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": food.ID})
 
 	}
 }
@@ -149,16 +134,20 @@ func toFixed(num float64, precision int) float64{
 	return float64(round(num*output)) /  output
 }
 
-func UpdateFood() gin.HandlerFunc{
+func UpdateFood(foods repository.Foods, menus repository.Menus) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var menu models.Menu
 		var food models.Food
 		foodID := c.Param("food_id")
 
-		if err := c.BindJSON(&menu); err != nil {
+		version, ok := requireIfMatch(c)
+		if !ok{
+			return
+		}
+
+		if err := c.BindJSON(&food); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
@@ -169,7 +158,8 @@ func UpdateFood() gin.HandlerFunc{
 		}
 
 		if food.Price != nil {
-			updateObj = append(updateObj, bson.E{Key: "food_price", Value: food.Price})
+			var num = toFixed(*food.Price, 2)
+			updateObj = append(updateObj, bson.E{Key: "price", Value: num})
 		}
 
 		if food.Food_image != nil {
@@ -177,30 +167,63 @@ func UpdateFood() gin.HandlerFunc{
 		}
 
 		if food.Menu_id != nil {
-			err := menuCollection.FindOne(ctx, bson.M{"menu_id": food.Menu_id}).Decode(&menu)
-			defer cancel()
+			_, err := menus.Get(ctx, restaurantOf(c), *food.Menu_id)
 			if err!= nil{
 				msg := fmt.Sprintf("message: Menu was not found")
 				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 				return
 			}
-			updateObj = append(updateObj, bson.E{Key: "menu", Value: food.Price})
+			updateObj = append(updateObj, bson.E{Key: "menu_id", Value: food.Menu_id})
 		}
 		
 		food.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: food.Updated_at})
 
-		
-		filter := bson.M{"food_id": foodID}
-
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
-
-		result, err := foodCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: updateObj}}, &opts)
+		result, err := updateIfMatch[models.Food](ctx, foods, restaurantOf(c), foodID, version, updateObj)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            respondUpdateError(c, err, "food", err.Error())
             return
         }
-		c.JSON(http.StatusOK, result)
+		respondUpdated(c, version, result)
+	}
+}
+
+// DeleteFood soft deletes a food no order item is for. Deleting an ordered
+// food would take its name and price off the order.
+func DeleteFood(transactions repository.Transactions, foods repository.Foods, orderItems repository.OrderItems) gin.HandlerFunc{
+	return func(c *gin.Context){
+		foodId := c.Param("food_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.Food](c, transactions, foods, restaurantId, foodId, "food", func(ctx context.Context) error{
+			return refuseIfAny[models.OrderItem](ctx, orderItems, restaurantId, "food_id", foodId, "the food is on order items; delete them first")
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Food deleted"})
+		}
+	}
+}
+
+// RestoreFood restores a deleted food whose menu is still there.
+func RestoreFood(transactions repository.Transactions, foods repository.Foods, menus repository.Menus) gin.HandlerFunc{
+	return func(c *gin.Context){
+		restored := restoreDeleted[models.Food](c, transactions, foods, restaurantOf(c), c.Param("food_id"), "food", func(ctx context.Context, food models.Food) error{
+			if food.Menu_id == nil{
+				return nil
+			}
+			_, err := menus.Get(ctx, food.Restaurant_id, *food.Menu_id)
+			return parentGone(err, "the food's menu is deleted; restore it first")
+		})
+		if restored{
+			c.JSON(http.StatusOK, gin.H{"message": "Food restored"})
+		}
+	}
+}
+
+func PurgeFood(foods repository.Foods) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.Food](c, foods, restaurantOf(c), c.Param("food_id"), "food"){
+			c.JSON(http.StatusOK, gin.H{"message": "Food purged"})
+		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"restaurant_app/migrations"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How long a readiness check waits for a dependency before calling it down
+const dependencyTimeout = 2 * time.Second
+
+// Readiness is what Readyz reports on. The app calls ShutDown as soon as a
+// graceful shutdown starts, so traffic is sent elsewhere before the server
+// stops accepting it.
+type Readiness struct{
+	// The name the storage is reported by, and how to check it answers
+	Storage			string
+	Ping			func(ctx context.Context) error
+	// The MongoDB database migrations are checked on, nil for storage that
+	// has none
+	Database		*mongo.Database
+	shuttingDown	atomic.Bool
+}
+
+func (readiness *Readiness) ShutDown(){
+	readiness.shuttingDown.Store(true)
+}
+
+// DependencyStatus is how one dependency fared in a readiness check. Errors
+// are kept vague since the endpoint is public; the details are logged.
+type DependencyStatus struct{
+	Name			string		`json:"name"`
+	Status			string		`json:"status"`
+	Latency_ms		float64		`json:"latency_ms"`
+	Detail			string		`json:"detail,omitempty"`
+}
+
+// Healthz tells whether the process is alive. It checks no dependency, so a
+// database outage doesn't get the service restarted.
+func Healthz() gin.HandlerFunc{
+	return func(c *gin.Context){
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Readyz tells whether the service can take traffic: the storage answers,
+// every migration is applied and no shutdown has started.
+func Readyz(readiness *Readiness) gin.HandlerFunc{
+	return func(c *gin.Context){
+		checks := make([]DependencyStatus, 1, 2)
+		if readiness.Database != nil{
+			checks = checks[:2]
+		}
+
+		// Checked side by side, so a dead database costs one timeout
+		var wg sync.WaitGroup
+		wg.Add(len(checks))
+		go func(){
+			defer wg.Done()
+			checks[0] = checkDependency(c.Request.Context(), readiness.Storage, func(ctx context.Context) (string, error){
+				return "", readiness.Ping(ctx)
+			})
+		}()
+		if len(checks) == 2{
+			go func(){
+				defer wg.Done()
+				checks[1] = checkDependency(c.Request.Context(), "migrations", func(ctx context.Context) (string, error){
+					pending, err := migrations.Pending(ctx, readiness.Database)
+					if err != nil{
+						return "", err
+					}
+					if pending > 0{
+						return fmt.Sprintf("%d of %d pending", pending, migrations.Latest()), errMigrationsPending
+					}
+					return fmt.Sprintf("at version %d", migrations.Latest()), nil
+				})
+			}()
+		}
+		wg.Wait()
+
+		status := "ready"
+		for _, check := range checks{
+			if check.Status != "up"{
+				status = "not ready"
+			}
+		}
+		if readiness.shuttingDown.Load(){
+			status = "shutting down"
+		}
+
+		code := http.StatusOK
+		if status != "ready"{
+			code = http.StatusServiceUnavailable
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(code, gin.H{"status": status, "checks": checks})
+	}
+}
+
+var errMigrationsPending = errors.New("migrations are pending")
+
+func checkDependency(ctx context.Context, name string, check func(ctx context.Context) (string, error)) DependencyStatus{
+	ctx, cancel := context.WithTimeout(ctx, dependencyTimeout)
+	defer cancel()
+
+	started := time.Now()
+	detail, err := check(ctx)
+	dependency := DependencyStatus{
+		Name:		name,
+		Status:		"up",
+		Latency_ms:	float64(time.Since(started).Microseconds()) / 1000,
+		Detail:		detail,
+	}
+	if err != nil{
+		dependency.Status = "down"
+		if err != errMigrationsPending{
+			log.Printf("Readiness check of %s failed: %v", name, err)
+			dependency.Detail = "check failed"
+		}
+	}
+	return dependency
+}
@@ -2,18 +2,16 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type InvoiceViewFormat struct{
@@ -25,48 +23,46 @@ type InvoiceViewFormat struct{
 	Table_number		interface{}
 	Payment_due_date	time.Time
 	Order_details		interface{}
+	Version				int64
 }
 
-var invoiceCollection *mongo.Collection = database.OpenCollection(database.Client, "invoice")
 
-
-func GetInvoices() gin.HandlerFunc{
+func GetInvoices(invoices repository.Invoices) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		result, err := invoiceCollection.Find(context.TODO(), bson.M{})
+		allInvoices, err := invoices.List(ctx, restaurantOf(c))
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing invoice items"})
-		}
-
-		var allInvoices []bson.M
-		if err = result.All(ctx, &allInvoices); err != nil {
-			log.Fatal(err)
+			return
 		}
 		c.JSON(http.StatusOK, allInvoices)
 	}
 }
 
-func GetInvoice() gin.HandlerFunc {
+func GetInvoice(invoices repository.Invoices, orderItems repository.OrderItems) gin.HandlerFunc {
     return func(c *gin.Context) {
         var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
         defer cancel() // This ensures that the context is always cancelled.
 
         invoiceId := c.Param("invoice_id")
 
-        var invoice models.Invoice
-        err := invoiceCollection.FindOne(ctx, bson.M{"invoice_id": invoiceId}).Decode(&invoice)
+        invoice, err := invoices.Get(ctx, restaurantOf(c), invoiceId)
+        if err == repository.ErrNotFound {
+            c.JSON(http.StatusNotFound, gin.H{"error": "invoice was not found"})
+            return
+        }
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "error occurred while listing invoice item"})
             return // Ensure to return after sending the response.
         }
 
         var invoiceView InvoiceViewFormat
-        allOrderItems, err := ItemsByOrder(invoice.Order_id)
+        allOrderItems, err := orderItems.ByOrder(ctx, invoice.Restaurant_id, invoice.Order_id)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return // Handle errors returned by ItemsByOrder.
+            return // Handle errors returned by ByOrder.
         }
 
         // Check if order items were found and manage the nil slice if not.
@@ -85,30 +81,35 @@ func GetInvoice() gin.HandlerFunc {
 
         invoiceView.Invoice_id = invoice.Invoice_id
         invoiceView.Payment_status = *&invoice.Payment_status
-        invoiceView.Payment_due = allOrderItems[0]["payment_due"]
-        invoiceView.Table_number = allOrderItems[0]["table_number"]
-        invoiceView.Order_details = allOrderItems[0]["order_items"]
+        invoiceView.Payment_due = allOrderItems[0].Payment_due
+        invoiceView.Table_number = allOrderItems[0].Table_number
+        invoiceView.Order_details = allOrderItems[0].Order_items
+        invoiceView.Version = invoice.Version
 
+        setETag(c, invoice.Version)
         c.JSON(http.StatusOK, invoiceView)
     }
 }
 
 
-func CreateInvoice() gin.HandlerFunc{
+func CreateInvoice(transactions repository.Transactions, invoices repository.Invoices, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		var invoice models.Invoice
 
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
 		if err := c.BindJSON(&invoice); err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 		
-		var order models.Order 
-
-		err := orderCollection.FindOne(ctx, bson.M{"order_id": invoice.Order_id}).Decode(&order)
+		order, err := orders.Get(ctx, restaurantId, invoice.Order_id)
 		if err != nil{
 			msg := fmt.Sprintf("Order was not found")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
@@ -124,6 +125,11 @@ func CreateInvoice() gin.HandlerFunc{
 		invoice.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		invoice.ID = primitive.NewObjectID()
 		invoice.Invoice_id = invoice.ID.Hex()
+		invoice.Restaurant_id = restaurantId
+		// Versions and deletion are managed by the server only
+		invoice.Version = 0
+		invoice.Deleted_at = nil
+		invoice.Deleted_by = nil
 
 		validationErr := validate.Struct(invoice)
 		if validationErr != nil {
@@ -131,17 +137,34 @@ func CreateInvoice() gin.HandlerFunc{
 			return
 		}
 
-		result, insertErr := invoiceCollection.InsertOne(ctx, invoice)
-		if insertErr != nil{
+		insertErr := transactions.InTransaction(ctx, func(ctx context.Context) error{
+			if err := refuseIfAny[models.Invoice](ctx, invoices, restaurantId, "order_id", invoice.Order_id, "the order has an invoice already"); err != nil{
+				return err
+			}
+			if err := invoices.Create(ctx, invoice); err != nil{
+				return err
+			}
+			return billOrder(ctx, orders, tables, order, *invoice.Payment_status)
+		})
+		var reason refusal
+		switch {
+		case errors.As(insertErr, &reason):
+			c.JSON(http.StatusConflict, gin.H{"error": string(reason)})
+			return
+		case errors.Is(insertErr, repository.ErrDuplicate):
+			// Another invoice for the order was created meanwhile
+			c.JSON(http.StatusConflict, gin.H{"error": "the order has an invoice already"})
+			return
+		case insertErr != nil:
 			msg := fmt.Sprintf("invoice item was not created")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			respondTransactionError(c, insertErr, msg)
 			return
 		}
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": invoice.ID})
 	}
 }
 
-func UpdateInvoice() gin.HandlerFunc{
+func UpdateInvoice(transactions repository.Transactions, invoices repository.Invoices, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout( context.Background(), 100*time.Second)
 		defer cancel()
@@ -149,13 +172,16 @@ func UpdateInvoice() gin.HandlerFunc{
 		var invoice models.Invoice
 		invoiceId := c.Param("invoice_id")
 
+		version, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+
 		if err := c.BindJSON(&invoice); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		filter := bson.M{"invoice_id": invoiceId}
-
 		var updateObj primitive.D
 
 		if invoice.Payment_method != nil{
@@ -164,33 +190,123 @@ func UpdateInvoice() gin.HandlerFunc{
 		}
 
 		if invoice.Payment_status != nil{
-			updateObj = append(updateObj, bson.E{Key: "updated_at", Value: invoice.Payment_method})
+			updateObj = append(updateObj, bson.E{Key: "payment_status", Value: invoice.Payment_status})
 		}
 
 		invoice.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: invoice.Updated_at})
 
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
-
-		status := "PENDING"
-		if invoice.Payment_status == nil {
-			invoice.Payment_status = &status
-		}
-
-		result, err :=invoiceCollection.UpdateOne(
-			ctx,
-			filter,
-			bson.D{
-				{Key: "$set", Value: updateObj},
-			},
-			&opts,
-		)
+		var result repository.UpdateResult
+		err := transactions.InTransaction(ctx, func(ctx context.Context) error{
+			var err error
+			result, err = updateIfMatch[models.Invoice](ctx, invoices, restaurantOf(c), invoiceId, version, updateObj)
+			if err != nil || invoice.Payment_status == nil{
+				return err
+			}
+
+			// The order follows the payment status of its invoice
+			updated, err := invoices.Get(ctx, restaurantOf(c), invoiceId)
+			if err != nil{
+				return err
+			}
+			order, err := orders.Get(ctx, updated.Restaurant_id, updated.Order_id)
+			if err == repository.ErrNotFound{
+				return nil
+			}
+			if err != nil{
+				return err
+			}
+			return billOrder(ctx, orders, tables, order, *updated.Payment_status)
+		})
 		if err != nil{
 			msg := fmt.Sprintf("invoice ite update failed")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			respondUpdateError(c, err, "invoice", msg)
 			return
 		}
-		c.JSON(http.StatusOK, result)
+		respondUpdated(c, version, result)
+	}
+}
+
+// billOrder moves an order along with the payment status of its invoice and
+// frees its table once it is paid.
+func billOrder(ctx context.Context, orders repository.Orders, tables repository.Tables, order models.Order, paymentStatus string) error{
+	status := models.OrderBilled
+	if paymentStatus == "PAID"{
+		status = models.OrderPaid
+	}
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "order_status", Value: status})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	_, err := orders.Update(ctx, order.Restaurant_id, order.Order_id, updateObj)
+	if err != nil || status != models.OrderPaid || order.Table_id == nil{
+		return err
+	}
+	return releaseTable(ctx, tables, orders, order.Restaurant_id, *order.Table_id, order.Order_id)
+}
+
+// DeleteInvoice soft deletes an unpaid invoice, reopening its order.
+func DeleteInvoice(transactions repository.Transactions, invoices repository.Invoices, orders repository.Orders) gin.HandlerFunc{
+	return func(c *gin.Context){
+		invoiceId := c.Param("invoice_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.Invoice](c, transactions, invoices, restaurantId, invoiceId, "invoice", func(ctx context.Context) error{
+			invoice, err := invoices.Get(ctx, restaurantId, invoiceId)
+			if err != nil{
+				return err
+			}
+			if invoice.Payment_status != nil && *invoice.Payment_status == "PAID"{
+				return refusal("paid invoices can't be deleted")
+			}
+			return reopenOrder(ctx, orders, invoice)
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Invoice deleted"})
+		}
+	}
+}
+
+// RestoreInvoice restores a deleted invoice of an order that is still there,
+// billing the order again.
+func RestoreInvoice(transactions repository.Transactions, invoices repository.Invoices, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
+	return func(c *gin.Context){
+		restored := restoreDeleted[models.Invoice](c, transactions, invoices, restaurantOf(c), c.Param("invoice_id"), "invoice", func(ctx context.Context, invoice models.Invoice) error{
+			order, err := orders.Get(ctx, invoice.Restaurant_id, invoice.Order_id)
+			if err != nil{
+				return parentGone(err, "the invoice's order is deleted; restore it first")
+			}
+			paymentStatus := ""
+			if invoice.Payment_status != nil{
+				paymentStatus = *invoice.Payment_status
+			}
+			return billOrder(ctx, orders, tables, order, paymentStatus)
+		})
+		if restored{
+			c.JSON(http.StatusOK, gin.H{"message": "Invoice restored"})
+		}
 	}
-}
\ No newline at end of file
+}
+
+func PurgeInvoice(invoices repository.Invoices) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.Invoice](c, invoices, restaurantOf(c), c.Param("invoice_id"), "invoice"){
+			c.JSON(http.StatusOK, gin.H{"message": "Invoice purged"})
+		}
+	}
+}
+
+// reopenOrder takes an order back to open once its invoice is gone.
+func reopenOrder(ctx context.Context, orders repository.Orders, invoice models.Invoice) error{
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "order_status", Value: models.OrderOpen})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	_, err := orders.Update(ctx, invoice.Restaurant_id, invoice.Order_id, updateObj)
+	return err
+}
@@ -0,0 +1,22 @@
+package controller
+
+import (
+	"net/http"
+	"restaurant_app/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJWKS publishes the public keys that verify our tokens, for services
+// that check tokens themselves.
+func GetJWKS() gin.HandlerFunc{
+	return func(c *gin.Context){
+		jwks, err := helpers.JWKS()
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while loading signing keys"})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=600")
+		c.JSON(http.StatusOK, jwks)
+	}
+}
@@ -3,63 +3,64 @@ package controller
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var menuCollection *mongo.Collection = database.OpenCollection(database.Client, "menu")
-
 var validate = validator.New()
 
 
-func GetMenus() gin.HandlerFunc{
+func GetMenus(menus repository.Menus) gin.HandlerFunc{
 	return func(c *gin.Context){
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		result, err := menuCollection.Find(context.TODO(), bson.M{})
-		defer cancel()
+		allMenus, err := menus.List(ctx, restaurantOf(c))
 		if err!= nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing the menu items"})
 			return
 		}
-		var allMenus []bson.M
-		if err = result.All(ctx, &allMenus); err!= nil{
-			log.Fatal(err)
-		}
 		c.JSON(http.StatusOK, allMenus)
 	}
 }
 
-func GetMenu() gin.HandlerFunc {
+func GetMenu(menus repository.Menus) gin.HandlerFunc {
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		menuId := c.Param("menu_id")
-		var menu models.Menu
 
-		err := menuCollection.FindOne(ctx, bson.M{"menu_id": menuId}).Decode(&menu)
+		menu, err := menus.Get(ctx, restaurantOf(c), menuId)
 		defer cancel()
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "menu was not found"})
+			return
+		}
 		if err!= nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the menu"})
+			return
 		}
+		setETag(c, menu.Version)
 		c.JSON(http.StatusOK, menu)
 	}
 }
 
-func CreateMenu() gin.HandlerFunc{
+func CreateMenu(menus repository.Menus) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 		var menu models.Menu
 
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
 		if err := c.BindJSON(&menu); err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
@@ -75,16 +76,21 @@ func CreateMenu() gin.HandlerFunc{
 		menu.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		menu.ID = primitive.NewObjectID()
 		menu.Menu_id = menu.ID.Hex()
+		menu.Restaurant_id = restaurantId
+		// Versions and deletion are managed by the server only
+		menu.Version = 0
+		menu.Deleted_at = nil
+		menu.Deleted_by = nil
 
 
-		result, insertErr := menuCollection.InsertOne(ctx, menu)
+		insertErr := menus.Create(ctx, menu)
 		if insertErr != nil{
 			msg := fmt.Sprintf("Menu item was not created")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 			return
 		}
 		defer cancel()
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": menu.ID})
 		defer cancel()
 	}
 }
@@ -94,11 +100,16 @@ func inTimeSpan(start, end, check time.Time) bool {
 }
 
 
-func UpdateMenu(menuCollection *mongo.Collection) gin.HandlerFunc {
+func UpdateMenu(menus repository.Menus) gin.HandlerFunc {
     return func(c *gin.Context) {
         ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
         defer cancel()
 
+        version, ok := requireIfMatch(c)
+        if !ok {
+            return
+        }
+
         var menu models.Menu
         if err := c.BindJSON(&menu); err != nil {
             c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -106,7 +117,6 @@ func UpdateMenu(menuCollection *mongo.Collection) gin.HandlerFunc {
         }
 
         menuId := c.Param("menu_id")
-        filter := bson.M{"menu_id": menuId}
 
         updateObj := primitive.D{}
         if menu.Start_Date != nil && menu.End_Date != nil {
@@ -122,15 +132,43 @@ func UpdateMenu(menuCollection *mongo.Collection) gin.HandlerFunc {
         menu.Updated_at = time.Now()
         updateObj = append(updateObj, bson.E{Key: "updated_at", Value: menu.Updated_at})
 
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
-
-        result, err := menuCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: updateObj}}, &opts)
+        result, err := updateIfMatch[models.Menu](ctx, menus, restaurantOf(c), menuId, version, updateObj)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+            respondUpdateError(c, err, "menu", err.Error())
             return
         }
 
-        c.JSON(http.StatusOK, result)
+        respondUpdated(c, version, result)
     }
 }
+
+// DeleteMenu soft deletes a menu no food is on any more.
+func DeleteMenu(transactions repository.Transactions, menus repository.Menus, foods repository.Foods) gin.HandlerFunc{
+	return func(c *gin.Context){
+		menuId := c.Param("menu_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.Menu](c, transactions, menus, restaurantId, menuId, "menu", func(ctx context.Context) error{
+			return refuseIfAny[models.Food](ctx, foods, restaurantId, "menu_id", menuId, "the menu still has foods; delete them or move them to another menu first")
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Menu deleted"})
+		}
+	}
+}
+
+func RestoreMenu(transactions repository.Transactions, menus repository.Menus) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if restoreDeleted[models.Menu](c, transactions, menus, restaurantOf(c), c.Param("menu_id"), "menu", nil){
+			c.JSON(http.StatusOK, gin.H{"message": "Menu restored"})
+		}
+	}
+}
+
+func PurgeMenu(menus repository.Menus) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.Menu](c, menus, restaurantOf(c), c.Param("menu_id"), "menu"){
+			c.JSON(http.StatusOK, gin.H{"message": "Menu purged"})
+		}
+	}
+}
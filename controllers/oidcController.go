@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// oidcStateCookie holds the state of the login the browser started, so that
+// nobody can have someone else's browser finish a login of theirs.
+const oidcStateCookie = "oidc_state"
+
+// OidcLogin sends the user to the company identity provider.
+func OidcLogin() gin.HandlerFunc{
+	return func(c *gin.Context){
+		authorizationUrl, state, err := helpers.StartOidcLogin()
+		if err == helpers.ErrOidcDisabled{
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start the OIDC login"})
+			return
+		}
+		setOidcStateCookie(c, state, int(helpers.OidcLoginTTL.Seconds()))
+		c.Redirect(http.StatusFound, authorizationUrl)
+	}
+}
+
+// setOidcStateCookie sets the state cookie, or clears it with a negative
+// maxAge. The provider redirects back from another site, so it is Lax.
+func setOidcStateCookie(c *gin.Context, state string, maxAge int){
+	secure := strings.HasPrefix(helpers.OIDC_REDIRECT_URL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, "/users/oidc", "", secure, true)
+}
+
+// OidcCallback is where the identity provider sends the user back, in the
+// browser that started the login. The user is provisioned or updated from the
+// ID token and gets the usual tokens, or an mfa token for the TOTP step when
+// their role needs a second factor the provider does not vouch for.
+func OidcCallback(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		if providerErr := c.Query("error"); providerErr != ""{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "The identity provider refused the login: " + providerErr})
+			return
+		}
+
+		state := c.Query("state")
+		browserState, _ := c.Cookie(oidcStateCookie)
+		setOidcStateCookie(c, "", -1)
+		if browserState == "" || subtle.ConstantTimeCompare([]byte(browserState), []byte(state)) != 1{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login, start again"})
+			return
+		}
+
+		identity, err := helpers.FinishOidcLogin(ctx, state, c.Query("code"))
+		switch err{
+		case nil:
+		case helpers.ErrOidcDisabled:
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		case helpers.ErrInvalidOidcLogin:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login, start again"})
+			return
+		case helpers.ErrOidcNoRole:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Your account has no role in this application"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete the OIDC login"})
+			return
+		}
+
+		foundUser, status, msg := provisionOidcUser(ctx, users, identity)
+		if msg != ""{
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		if foundUser.Deactivated_at != nil{
+			c.JSON(http.StatusForbidden, gin.H{"error": "This account has been deactivated"})
+			return
+		}
+
+		if !identity.Mfa && askSecondFactor(c, foundUser){
+			return
+		}
+		issueLoginTokens(c, foundUser)
+	}
+}
+
+// provisionOidcUser finds the user an identity belongs to, by subject or else
+// by verified email, and brings their name, role and restaurant in line with
+// the identity provider. Unknown users are created on their first login.
+func provisionOidcUser(ctx context.Context, users repository.Users, identity *helpers.OidcIdentity) (models.User, int, string){
+	foundUser, err := users.GetByOidcSubject(ctx, identity.Subject)
+	if err == repository.ErrNotFound && identity.Email != ""{
+		foundUser, err = users.GetByEmail(ctx, identity.Email)
+		if err == nil && !identity.EmailVerified{
+			return foundUser, http.StatusConflict, "An account with this email already exists"
+		}
+	}
+	isNew := err == repository.ErrNotFound
+	if err != nil && !isNew{
+		return foundUser, http.StatusInternalServerError, "error occured while fetching the user"
+	}
+	if isNew && identity.Email == ""{
+		return foundUser, http.StatusForbidden, "The identity provider did not share an email address"
+	}
+
+	// The provider's restaurant wins; without one, users keep their own
+	restaurantId := foundUser.Restaurant_id
+	if identity.RestaurantId != ""{
+		err := helpers.CheckRestaurant(identity.RestaurantId)
+		if err == helpers.ErrUnknownRestaurant{
+			return foundUser, http.StatusForbidden, "Your restaurant is not known to this application"
+		}
+		if err != nil{
+			return foundUser, http.StatusInternalServerError, "Failed to check the restaurant"
+		}
+		restaurantId = identity.RestaurantId
+	}
+	if restaurantId == "" && identity.Role != models.RoleAdmin{
+		return foundUser, http.StatusForbidden, "Your account is not assigned to a restaurant"
+	}
+
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+
+	if isNew{
+		foundUser.ID = primitive.NewObjectID()
+		foundUser.User_id = foundUser.ID.Hex()
+		foundUser.Email = &identity.Email
+		foundUser.Created_at = now
+	}
+	foundUser.Oidc_subject = &identity.Subject
+	foundUser.First_name = &identity.FirstName
+	foundUser.Last_name = &identity.LastName
+	foundUser.Role = &identity.Role
+	foundUser.Restaurant_id = restaurantId
+	foundUser.Updated_at = now
+
+	if isNew{
+		if err := users.Create(ctx, foundUser); err != nil{
+			return foundUser, http.StatusInternalServerError, "Failed to create user"
+		}
+		return foundUser, http.StatusOK, ""
+	}
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "oidc_subject", Value: foundUser.Oidc_subject})
+	updateObj = append(updateObj, bson.E{Key: "first_name", Value: foundUser.First_name})
+	updateObj = append(updateObj, bson.E{Key: "last_name", Value: foundUser.Last_name})
+	updateObj = append(updateObj, bson.E{Key: "role", Value: foundUser.Role})
+	updateObj = append(updateObj, bson.E{Key: "restaurant_id", Value: foundUser.Restaurant_id})
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: foundUser.Updated_at})
+
+	_, err = users.UpdateVersion(ctx, "", foundUser.User_id, foundUser.Version, updateObj)
+	if err == repository.ErrVersionConflict{
+		return foundUser, http.StatusConflict, "user was changed meanwhile; log in again"
+	}
+	if err != nil{
+		return foundUser, http.StatusInternalServerError, "user update failed"
+	}
+	return foundUser, http.StatusOK, ""
+}
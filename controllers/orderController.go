@@ -2,67 +2,66 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var orderCollection *mongo.Collection = database.OpenCollection(database.Client, "order")
-var validate validator.New()
-
-func GetOrders() gin.HandlerFunc{
+func GetOrders(orders repository.Orders) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 
-		result, err := orderCollection.Find(context.TODO(), bson.M{})
+		allOrders, err := orders.List(ctx, restaurantOf(c))
 		defer cancel()
 		if err!= nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while lisitng orders"})
-		}
-
-		var allOrders []bson.M
-		if err = result.All(ctx, &allOrders); err != nil {
-			log.Fatal(err)
+			return
 		}
 		c.JSON(http.StatusOK, allOrders)
 	}
 
 }
 
-func GetOrder() gin.HandlerFunc{
+func GetOrder(orders repository.Orders) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		orderId := c.Param("order_id")
-		var order models.Order
 
-		err := orderCollection.FindOne(ctx, bson.M{"order_id": orderId}).Decode(&order)
+		order, err := orders.Get(ctx, restaurantOf(c), orderId)
 		defer cancel()
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "order was not found"})
+			return
+		}
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the order item"})
+			return
 		}
+		setETag(c, order.Version)
 		c.JSON(http.StatusOK, order)
 
 	}
 }
 
-func CreateOrder() gin.HandlerFunc{
+func CreateOrder(transactions repository.Transactions, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var table models.Table
 		var order models.Order
 
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
 		if err := c.BindJSON(&order); err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
@@ -71,10 +70,10 @@ func CreateOrder() gin.HandlerFunc{
 		validationErr := validate.Struct(order)
 		if validationErr != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
 		}
 		if order.Table_id != nil{
-			err := tableCollection.FindOne(ctx, bson.M{"table_id": order.Table_id}).Decode(&table)
-			defer cancel()
+			_, err := tables.Get(ctx, restaurantId, *order.Table_id)
 			if err != nil{
 				msg := fmt.Sprintf("message: Table was not found")
 				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
@@ -87,86 +86,178 @@ func CreateOrder() gin.HandlerFunc{
 
 		order.ID = primitive.NewObjectID()
 		order.Order_id = order.ID.Hex()
-
-		result, insertErr := orderCollection.InsertOne(ctx, order)
+		order.Order_status = models.OrderOpen
+		order.Restaurant_id = restaurantId
+		// Versions and deletion are managed by the server only
+		order.Version = 0
+		order.Deleted_at = nil
+		order.Deleted_by = nil
+
+		insertErr := transactions.InTransaction(ctx, func(ctx context.Context) error{
+			if err := orders.Create(ctx, order); err != nil{
+				return err
+			}
+			return occupyTable(ctx, tables, restaurantId, *order.Table_id)
+		})
 
 		if insertErr != nil{
 			msg := fmt.Sprintf("order items was not created")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			respondTransactionError(c, insertErr, msg)
 			return
 		}
-		defer cancel()
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": order.ID})
 
 	}
 }
 
-func UpdateOrder() gin.HandlerFunc{
+func UpdateOrder(transactions repository.Transactions, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var table models.Table
 		var order models.Order
 
 		var updateObj primitive.D
 
 		orderId := c.Param("order_id")
-		filter := bson.M{"order_id": orderId}
+
+		version, ok := requireIfMatch(c)
+		if !ok{
+			return
+		}
 
 		if err := c.BindJSON(&order); err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		if order.Table_id != nil{
-			err := menuCollection.FindOne(ctx, bson.M{"table_id": order.Table_id}).Decode(&table)
-			defer cancel()
+			// The table must be at the order's restaurant, which a cross-site
+			// admin doesn't name
+			previous, err := orders.Get(ctx, restaurantOf(c), orderId)
+			if err == nil{
+				_, err = tables.Get(ctx, previous.Restaurant_id, *order.Table_id)
+			}
 			if err != nil{
-				msg := fmt.Sprintf("message: Menu was not found")
+				msg := fmt.Sprintf("message: Table was not found")
 				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 				return
 			}
-			updateObj = append(updateObj, bson.E{Key: "menu", Value: order.Table_id})
+			updateObj = append(updateObj, bson.E{Key: "table_id", Value: order.Table_id})
 		}
 		order.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
         updateObj = append(updateObj, bson.E{Key: "updated_at", Value: order.Updated_at})
 
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
+		var result repository.UpdateResult
+		err := transactions.InTransaction(ctx, func(ctx context.Context) error{
+			previous, err := orders.Get(ctx, restaurantOf(c), orderId)
+			if err != nil{
+				return err
+			}
+			result, err = updateIfMatch[models.Order](ctx, orders, restaurantOf(c), orderId, version, updateObj)
+			if err != nil{
+				return err
+			}
 
-		result, err :=orderCollection.UpdateOne(
-			ctx,
-			filter,
-			bson.D{
-				{Key: "$set", Value: updateObj},
-			},
-			&opts,
-		)
+			// Moving the order to another table frees the old one
+			if order.Table_id == nil || (previous.Table_id != nil && *previous.Table_id == *order.Table_id){
+				return nil
+			}
+			if err := occupyTable(ctx, tables, previous.Restaurant_id, *order.Table_id); err != nil{
+				return err
+			}
+			if previous.Table_id == nil{
+				return nil
+			}
+			return releaseTable(ctx, tables, orders, previous.Restaurant_id, *previous.Table_id, orderId)
+		})
 
 		if err!= nil{
 			msg := fmt.Sprintf("order item update failed")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			respondUpdateError(c, err, "order", msg)
 			return
 		}
 
-		defer cancel()
-		c.JSON(http.StatusOK, result)
+		respondUpdated(c, version, result)
 	}
 }
 
 
-func OrderItemOrderCreator(order models.Order) string{
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
+func OrderItemOrderCreator(ctx context.Context, orders repository.Orders, order models.Order) (string, error){
 	order.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 	order.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 	order.ID = primitive.NewObjectID()
 
 	order.Order_id = order.ID.Hex()
+	order.Order_status = models.OrderOpen
+
+	err := orders.Create(ctx, order)
+
+	return order.Order_id, err
+}
+
+// respondTransactionError answers for a transaction that failed, telling the
+// client when the database cannot run transactions at all.
+func respondTransactionError(c *gin.Context, err error, msg string){
+	if errors.Is(err, repository.ErrTransactionsUnsupported){
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+}
+
+// DeleteOrder soft deletes an order without items or an invoice, freeing its
+// table unless another order still holds it.
+func DeleteOrder(transactions repository.Transactions, orders repository.Orders, orderItems repository.OrderItems, invoices repository.Invoices, tables repository.Tables) gin.HandlerFunc{
+	return func(c *gin.Context){
+		orderId := c.Param("order_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.Order](c, transactions, orders, restaurantId, orderId, "order", func(ctx context.Context) error{
+			if err := refuseIfAny[models.OrderItem](ctx, orderItems, restaurantId, "order_id", orderId, "the order still has items; delete them first"); err != nil{
+				return err
+			}
+			if err := refuseIfAny[models.Invoice](ctx, invoices, restaurantId, "order_id", orderId, "the order has an invoice; delete it first"); err != nil{
+				return err
+			}
+			order, err := orders.Get(ctx, restaurantId, orderId)
+			if err != nil || order.Table_id == nil{
+				return err
+			}
+			return releaseTable(ctx, tables, orders, order.Restaurant_id, *order.Table_id, orderId)
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Order deleted"})
+		}
+	}
+}
 
-	orderCollection.InsertOne(ctx, order)
-	defer cancel()
+// RestoreOrder restores a deleted order whose table is still there, which it
+// occupies again unless the order was paid.
+func RestoreOrder(transactions repository.Transactions, orders repository.Orders, tables repository.Tables) gin.HandlerFunc{
+	return func(c *gin.Context){
+		restored := restoreDeleted[models.Order](c, transactions, orders, restaurantOf(c), c.Param("order_id"), "order", func(ctx context.Context, order models.Order) error{
+			if order.Table_id == nil{
+				return nil
+			}
+			if _, err := tables.Get(ctx, order.Restaurant_id, *order.Table_id); err != nil{
+				return parentGone(err, "the order's table is deleted; restore it first")
+			}
+			if order.Order_status == models.OrderPaid{
+				return nil
+			}
+			return occupyTable(ctx, tables, order.Restaurant_id, *order.Table_id)
+		})
+		if restored{
+			c.JSON(http.StatusOK, gin.H{"message": "Order restored"})
+		}
+	}
+}
 
-	return order.Order_id
-}
\ No newline at end of file
+func PurgeOrder(orders repository.Orders) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.Order](c, orders, restaurantOf(c), c.Param("order_id"), "order"){
+			c.JSON(http.StatusOK, gin.H{"message": "Order purged"})
+		}
+	}
+}
@@ -2,16 +2,15 @@ package controller
 
 import (
 	"context"
-	"log"
+	"errors"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type OrderItemPack struct{
@@ -19,53 +18,49 @@ type OrderItemPack struct{
 	Order_items []models.OrderItem
 }
 
-var orderItemCollection *mongo.Collection = database.OpenCollection(database.Client, "orderItem")
-
-func GetOrderItems() gin.HandlerFunc{
+func GetOrderItems(orderItems repository.OrderItems) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		result, err := orderItemCollection.Find(context.TODO(), bson.M{})
+		allOrderItems, err := orderItems.List(ctx, restaurantOf(c))
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occurred while listing order items"})
 			return
 		}
-		var allOrderItems []bson.M
-		err = result.All(ctx, &allOrderItems)
-		if err != nil{
-			log.Fatal(err)
-			return
-		}
 		c.JSON(http.StatusOK, allOrderItems)
 	}
 }
 
-func GetOrderItem() gin.HandlerFunc{
+func GetOrderItem(orderItems repository.OrderItems) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		orderItemId := c.Param("order_item_id")
-		var orderItem models.OrderItem
 
-		err := orderItemCollection.FindOne(ctx, bson.M{"order_item_id": orderItemId}).Decode(&orderItem)
+		orderItem, err := orderItems.Get(ctx, restaurantOf(c), orderItemId)
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "order item was not found"})
+			return
+		}
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while lisitng ordered item"})
 			return
 		}
+		setETag(c, orderItem.Version)
 		c.JSON(http.StatusOK, orderItem)
 	}
 }
 
-func GetOrderItemsByOrder() gin.HandlerFunc{
+func GetOrderItemsByOrder(orderItems repository.OrderItems) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		orderId := c.Param("order_id")
 		
-		allOrderItems, err := ItemsByOrder(orderId)
+		allOrderItems, err := orderItems.ByOrder(ctx, restaurantOf(c), orderId)
 
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing order items by order ID"})
@@ -76,135 +71,51 @@ func GetOrderItemsByOrder() gin.HandlerFunc{
 }
 
 
-func ItemsByOrder(id string) (OrderItems []primitive.M, err error){
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
-	matchStage := bson.D{{Key: "$match", Value: bson.D{
-		{Key: "order_id", Value: id}}}}
-	lookupFoodStage := bson.D{{Key: "$lookup", Value: bson.D{
-		{Key: "from", Value: "food"},
-		{Key: "localField", Value: "food_id"},
-		{Key: "foreignField", Value: "food_id"},
-		{Key: "as", Value: "food"},
-	}}}
-	unwindFoodStage := bson.D{{Key: "$unwind", Value: bson.D{
-		{Key: "path", Value: "$food"},
-		{Key: "preserveNullAndEmptyArrays", Value: true},
-	}}}
-
-	lookupOrderStage := bson.D{{Key: "$lookup", Value: bson.D{
-		{Key: "from", Value: "order"},
-		{Key: "localField", Value: "order_id"},
-		{Key: "foreignField", Value: "order_id"},
-		{Key: "as", Value: "order"},
-	}}}
-	unwindOrderStage := bson.D{{Key: "$unwind", Value: bson.D{
-		{Key: "path", Value: "$order"},
-		{Key: "preserveNullAndEmptyArrays", Value: true},
-	}}}
-
-	lookupTableStage := bson.D{{Key: "$lookup", Value: bson.D{
-		{Key: "from", Value: "table"},
-		{Key: "localField", Value: "order.table_id"},
-		{Key: "foreignField", Value: "order.table_id"},
-		{Key: "as", Value: "table"}
-	}}}
-	unwindTableStage := bson.D{{Key: "$unwind", Value: bson.D{
-		{Key: "path", Value: "$table"},
-		{Key: "preserveNullAndEmptyArrays", Value: true},
-	}}}
-
-
-	projectStage := bson.D{{Key: "$project", Value: bson.M{
-		"id": 0,
-		"amount": "$food.price",
-		"total_count": 1,
-		"food_name": "$food.name",
-		"food_image": "$food.food_image",
-		"table_number": "$table.table_number",
-		"table_id": "$table.table_id",
-		"order_id": "$order.order_id",
-		"quantity": 1, // Corrected from "quanitity"
-	}}}
-	
-	groupStage := bson.D{
-		{Key: "$group", Value: bson.M{
-			"_id": bson.M{
-				"order_id": "$order_id",
-				"table_id": "$table_id",
-				"table_number": "$table_number",
-			},
-			"payment_due": bson.M{"$sum": "$amount"},
-			"total_count": bson.M{"$sum": 1},
-			"order_items": bson.M{"$push": "$$ROOT"},  // Correct usage
-		}},
-	}
-	
-	
-	projectStage2 := bson.D{{Key: "$project", Value: bson.M{
-		"id": 0,
-		"payment_due": 1,
-		"total_count": 1,
-		"table_number": "$_id.table_number",
-		"order_items": 1,
-	}}}
-	
-
-	// Combine all stages into a pipeline
-
-	pipeline := mongo.Pipeline{
-		matchStage,
-		lookupFoodStage,
-		unwindFoodStage,
-		lookupOrderStage,
-		unwindOrderStage,
-		lookupTableStage,
-		unwindTableStage,
-		projectStage,
-		groupStage,
-		projectStage2,
-	}
-
-	result, err := orderCollection.Aggregate(ctx, pipeline)
-	if err != nil {
-		return nil, err  // Handle error appropriately
-	}
-	defer result.Close(ctx)  // Ensure cursor is closed
-
-	var orderItems []primitive.M
-	err = result.All(ctx, &orderItems)
-	if err != nil {
-		return nil, err  // Handle error appropriately
-	}
-
-	return orderItems, nil
-
-}
-
-
-func CreateOrderItem() gin.HandlerFunc{
+func CreateOrderItem(transactions repository.Transactions, orderItems repository.OrderItems, orders repository.Orders, foods repository.Foods, tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var orderItemPack orderItemPack 
+		var orderItemPack OrderItemPack 
 		var order models.Order 
+
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
 		
 		err := c.BindJSON(&orderItemPack)
 		if err!= nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The table and every food have to belong to the same restaurant
+		if orderItemPack.Table_id != nil{
+			if _, err := tables.Get(ctx, restaurantId, *orderItemPack.Table_id); err != nil{
+				c.JSON(http.StatusBadRequest, gin.H{"error": "table was not found"})
+				return
+			}
+		}
+		for _, orderItem := range orderItemPack.Order_items{
+			if orderItem.Food_id == nil{
+				continue
+			}
+			if _, err := foods.Get(ctx, restaurantId, *orderItem.Food_id); err != nil{
+				c.JSON(http.StatusBadRequest, gin.H{"error": "food " + *orderItem.Food_id + " was not found"})
+				return
+			}
 		}
 
 		order.Order_Date, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 
-		orderItemsToBeInserted := []interface{}{}
+		orderItemsToBeInserted := []models.OrderItem{}
 		order.Table_id = orderItemPack.Table_id
-		order_Table_id = orderItemPack.Table_id
-		order_id := orderItemOrderCreator(order)
+		order.Restaurant_id = restaurantId
 
 		for _, orderItem := range orderItemPack.Order_items{
-			orderItem.Order_id = order_id
+			// Checked before the order exists, with a stand-in for its id
+			orderItem.Order_id = "pending"
 
 			validationErr := validate.Struct(orderItem)
 			if validationErr != nil{
@@ -212,41 +123,78 @@ func CreateOrderItem() gin.HandlerFunc{
 				return
 			}
 			orderItem.ID = primitive.NewObjectID()
+			// Versions and deletion are managed by the server only
+			orderItem.Version = 0
+			orderItem.Deleted_at = nil
+			orderItem.Deleted_by = nil
 			orderItem.Created_at = time.Now()
 			orderItem.Updated_at = time.Now() // Directly assign the current time
 
 			orderItem.Order_item_id = orderItem.ID.Hex()
+			orderItem.Restaurant_id = restaurantId
 
 			var num = toFixed(*orderItem.Unit_price, 2)
 			orderItem.Unit_price = &num
 			orderItemsToBeInserted = append(orderItemsToBeInserted, orderItem)
 
 		}
-		insertedOrderItems, err := orderItemCollection.InsertMany(ctx, orderItemsToBeInserted)
 
+		// The order, its items and its table change together or not at all
+		var insertedIds []primitive.ObjectID
+		err = transactions.InTransaction(ctx, func(ctx context.Context) error{
+			order_id, err := OrderItemOrderCreator(ctx, orders, order)
+			if err != nil{
+				return err
+			}
+
+			insertedIds = []primitive.ObjectID{}
+			for i := range orderItemsToBeInserted{
+				orderItemsToBeInserted[i].Order_id = order_id
+				insertedIds = append(insertedIds, orderItemsToBeInserted[i].ID)
+			}
+			if len(orderItemsToBeInserted) > 0{
+				if err := orderItems.CreateMany(ctx, orderItemsToBeInserted); err != nil{
+					return err
+				}
+			}
+
+			if order.Table_id == nil{
+				return nil
+			}
+			return occupyTable(ctx, tables, restaurantId, *order.Table_id)
+		})
 		if err != nil{
-			log.Fatal(err)
+			respondTransactionError(c, err, "order was not created")
+			return
 		}
 
-		c.JSON(http.StatusOk, insertedOrderItems)
+		c.JSON(http.StatusOK, gin.H{"InsertedIDs": insertedIds})
 	}
 }
 
-func UpdateOrderItem() gin.HandlerFunc{
+func UpdateOrderItem(transactions repository.Transactions, orderItems repository.OrderItems, orders repository.Orders, foods repository.Foods) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var orderItem = models.OrderItem
+		var orderItem models.OrderItem
 
 		orderItemId := c.Param("order_item_id")
 
-		filter := bson.M{"order_item_id": orderItemId}
+		version, ok := requireIfMatch(c)
+		if !ok{
+			return
+		}
+
+		if err := c.BindJSON(&orderItem); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		var updateObj primitive.D
 
 		if orderItem.Unit_price != nil{
-			updateObj = append(updateObj, bson.E{Key: "unit_price", Value: *&ordrItem.Unit_price})
+			updateObj = append(updateObj, bson.E{Key: "unit_price", Value: toFixed(*orderItem.Unit_price, 2)})
 		}
 
 		if orderItem.Quantity != nil{
@@ -258,23 +206,102 @@ func UpdateOrderItem() gin.HandlerFunc{
 		}
 
 		orderItem.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-		orderItem.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 
 		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: orderItem.Updated_at})
 
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
-
-		result, err := orderItemCollection.UpdateOne(
-			ctx,
-			filtet,
-			bson.D{{Key: "$set", Value: updateObj}}, &opts
-		)
-		if err != nil {
+		// The order is checked in the same transaction, so it can't be
+		// billed between the check and the update
+		var result repository.UpdateResult
+		err := transactions.InTransaction(ctx, func(ctx context.Context) error{
+			current, err := orderItems.Get(ctx, restaurantOf(c), orderItemId)
+			if err != nil{
+				return err
+			}
+			if err := requireOpenOrder(ctx, orders, current); err != nil{
+				return err
+			}
+			if orderItem.Food_id != nil{
+				if _, err := foods.Get(ctx, current.Restaurant_id, *orderItem.Food_id); err != nil{
+					return errFoodNotFound
+				}
+			}
+			result, err = updateIfMatch[models.OrderItem](ctx, orderItems, restaurantOf(c), orderItemId, version, updateObj)
+			return err
+		})
+		var reason refusal
+		switch {
+		case errors.Is(err, errFoodNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "food was not found"})
+			return
+		case errors.As(err, &reason):
+			c.JSON(http.StatusConflict, gin.H{"error": string(reason)})
+			return
+		case err != nil:
 			msg := "Order Item updated failed"
-            c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+            respondUpdateError(c, err, "order item", msg)
             return
         }
-        c.JSON(http.StatusOK, result)
+        respondUpdated(c, version, result)
+	}
+}
+
+var errFoodNotFound = errors.New("food was not found")
+
+// requireOpenOrder refuses changing the items of an order that was billed,
+// since its invoice has the total they add up to.
+func requireOpenOrder(ctx context.Context, orders repository.Orders, orderItem models.OrderItem) error{
+	order, err := orders.Get(ctx, orderItem.Restaurant_id, orderItem.Order_id)
+	if err != nil{
+		return parentGone(err, "the item's order is deleted; restore it first")
+	}
+	if order.Order_status != "" && order.Order_status != models.OrderOpen{
+		return refusal("the order has been billed, so its items can't change")
+	}
+	return nil
+}
+
+func DeleteOrderItem(transactions repository.Transactions, orderItems repository.OrderItems, orders repository.Orders) gin.HandlerFunc{
+	return func(c *gin.Context){
+		orderItemId := c.Param("order_item_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.OrderItem](c, transactions, orderItems, restaurantId, orderItemId, "order item", func(ctx context.Context) error{
+			orderItem, err := orderItems.Get(ctx, restaurantId, orderItemId)
+			if err != nil{
+				return err
+			}
+			return requireOpenOrder(ctx, orders, orderItem)
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Order item deleted"})
+		}
 	}
-}
\ No newline at end of file
+}
+
+// RestoreOrderItem restores a deleted item of an open order, if its food is
+// still there.
+func RestoreOrderItem(transactions repository.Transactions, orderItems repository.OrderItems, orders repository.Orders, foods repository.Foods) gin.HandlerFunc{
+	return func(c *gin.Context){
+		restored := restoreDeleted[models.OrderItem](c, transactions, orderItems, restaurantOf(c), c.Param("order_item_id"), "order item", func(ctx context.Context, orderItem models.OrderItem) error{
+			if err := requireOpenOrder(ctx, orders, orderItem); err != nil{
+				return err
+			}
+			if orderItem.Food_id == nil{
+				return nil
+			}
+			_, err := foods.Get(ctx, orderItem.Restaurant_id, *orderItem.Food_id)
+			return parentGone(err, "the item's food is deleted; restore it first")
+		})
+		if restored{
+			c.JSON(http.StatusOK, gin.H{"message": "Order item restored"})
+		}
+	}
+}
+
+func PurgeOrderItem(orderItems repository.OrderItems) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.OrderItem](c, orderItems, restaurantOf(c), c.Param("order_item_id"), "order item"){
+			c.JSON(http.StatusOK, gin.H{"message": "Order item purged"})
+		}
+	}
+}
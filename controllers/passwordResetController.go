@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PasswordResetRequest struct{
+	Email			*string		`json:"email" validate:"required,email"`
+}
+
+type PasswordResetConfirm struct{
+	Email			*string		`json:"email" validate:"required,email"`
+	Code			*string		`json:"code" validate:"required"`
+	Password		*string		`json:"password" validate:"required,min=6"`
+}
+
+const (
+	resetCodeTTL         = 15 * time.Minute
+	maxResetCodeAttempts = 5
+)
+
+// RequestPasswordReset sends a one-time code to the user. It answers the same
+// way whether or not the email exists, is throttled or the code could be
+// sent, so it can't be used to probe accounts; failures are only logged.
+func RequestPasswordReset(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request PasswordResetRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		response := gin.H{"message": "If the email is registered, a reset code has been sent"}
+
+		// Every request counts against the email and the client, whether
+		// or not the account exists
+		keys := []string{helpers.ResetThrottleKey(*request.Email), helpers.ResetClientThrottleKey(c.ClientIP())}
+		retryAfter, err := helpers.LoginRetryAfter(keys...)
+		if err != nil{
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+		if retryAfter > 0{
+			log.Printf("Password reset throttled for %s from %s", *request.Email, c.ClientIP())
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+		helpers.RecordLoginFailure(keys...)
+
+		foundUser, err := users.GetByEmail(ctx, *request.Email)
+		if err != nil || foundUser.Deactivated_at != nil{
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+
+		// Only the newest code is usable
+		now := time.Now()
+		_, err = passwordResetCollection.UpdateMany(
+			ctx,
+			bson.M{"user_id": foundUser.User_id, "used_at": nil},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: now}}}},
+		)
+		if err != nil{
+			log.Printf("Failed to create reset code: %v", err)
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+
+		code, codeHash, err := helpers.GenerateResetCode()
+		if err != nil{
+			log.Printf("Failed to create reset code: %v", err)
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+
+		var reset models.PasswordReset
+		reset.ID = primitive.NewObjectID()
+		reset.Password_reset_id = reset.ID.Hex()
+		reset.User_id = foundUser.User_id
+		reset.Code_hash = codeHash
+		reset.Created_at = now
+		reset.Expires_at = now.Add(resetCodeTTL)
+
+		insertErr := passwordResetCollection.Insert(ctx, reset)
+		if insertErr != nil{
+			log.Printf("Failed to create reset code: %v", insertErr)
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+
+		body := fmt.Sprintf("Your password reset code is %s. It expires in %d minutes.", code, int(resetCodeTTL.Minutes()))
+		if err := helpers.UserNotifier.Notify(*foundUser.Email, "Password reset", body); err != nil{
+			log.Printf("Failed to send reset code: %v", err)
+		}
+		c.JSON(http.StatusAccepted, response)
+	}
+}
+
+// ConfirmPasswordReset sets a new password when the code is valid, then ends
+// every session of the user.
+func ConfirmPasswordReset(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request PasswordResetConfirm
+		var reset models.PasswordReset
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		invalid := gin.H{"error": "reset code is invalid or has expired"}
+
+		foundUser, err := users.GetByEmail(ctx, *request.Email)
+		if err != nil || foundUser.Deactivated_at != nil{
+			c.JSON(http.StatusBadRequest, invalid)
+			return
+		}
+
+		filter := bson.M{
+			"user_id": foundUser.User_id,
+			"used_at": nil,
+			"expires_at": bson.M{"$gt": time.Now()},
+			"attempts": bson.M{"$lt": maxResetCodeAttempts},
+		}
+		opts := repository.FindOptions{Sort: bson.D{{Key: "created_at", Value: -1}}, Limit: 1}
+		var resets []models.PasswordReset
+		err = passwordResetCollection.Find(ctx, filter, opts, &resets)
+		if err != nil || len(resets) == 0{
+			c.JSON(http.StatusBadRequest, invalid)
+			return
+		}
+		reset = resets[0]
+
+		if !helpers.ResetCodeMatches(*request.Code, reset.Code_hash){
+			_, err = passwordResetCollection.UpdateOne(
+				ctx,
+				bson.M{"password_reset_id": reset.Password_reset_id},
+				bson.D{{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}}},
+				false,
+			)
+			if err != nil{
+				log.Printf("Failed to count reset attempt: %v", err)
+			}
+			c.JSON(http.StatusBadRequest, invalid)
+			return
+		}
+
+		// Claim the code so a concurrent request can't use it as well
+		result, err := passwordResetCollection.UpdateOne(
+			ctx,
+			bson.M{"password_reset_id": reset.Password_reset_id, "used_at": nil},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: time.Now()}}}},
+			false,
+		)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+		if result.MatchedCount == 0{
+			c.JSON(http.StatusBadRequest, invalid)
+			return
+		}
+
+		password := HashPassword(*request.Password)
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "password", Value: password})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		_, err = users.Update(ctx, "", foundUser.User_id, updateObj)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+
+		if err := helpers.RevokeUserTokens(foundUser.User_id); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Password was changed but sessions could not be revoked"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+	}
+}
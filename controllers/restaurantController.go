@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func GetRestaurants() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		allRestaurants := []models.Restaurant{}
+		if err := restaurantCollection.Find(ctx, bson.M{}, repository.FindOptions{}, &allRestaurants); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing restaurants"})
+			return
+		}
+		c.JSON(http.StatusOK, allRestaurants)
+	}
+}
+
+func GetRestaurant() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		restaurantId := c.Param("restaurant_id")
+		var restaurant models.Restaurant
+
+		err := restaurantCollection.FindOne(ctx, bson.M{"restaurant_id": restaurantId}, &restaurant)
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "restaurant was not found"})
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the restaurant"})
+			return
+		}
+		setETag(c, restaurant.Version)
+		c.JSON(http.StatusOK, restaurant)
+	}
+}
+
+func CreateRestaurant() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var restaurant models.Restaurant
+
+		if err := c.BindJSON(&restaurant); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(restaurant)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		restaurant.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		restaurant.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		restaurant.ID = primitive.NewObjectID()
+		restaurant.Restaurant_id = restaurant.ID.Hex()
+		// Versions are managed by the server only
+		restaurant.Version = 0
+
+		insertErr := restaurantCollection.Insert(ctx, restaurant)
+		if insertErr != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "restaurant was not created"})
+			return
+		}
+		c.JSON(http.StatusOK, restaurant)
+	}
+}
+
+func UpdateRestaurant() gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var restaurant models.Restaurant
+		restaurantId := c.Param("restaurant_id")
+
+		version, ok := requireIfMatch(c)
+		if !ok{
+			return
+		}
+
+		if err := c.BindJSON(&restaurant); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var updateObj primitive.D
+
+		if restaurant.Name != nil{
+			updateObj = append(updateObj, bson.E{Key: "name", Value: restaurant.Name})
+		}
+		if restaurant.Address != nil{
+			updateObj = append(updateObj, bson.E{Key: "address", Value: restaurant.Address})
+		}
+		restaurant.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: restaurant.Updated_at})
+
+		filter := bson.M{"restaurant_id": restaurantId}
+		if version != nil{
+			filter["version"] = *version
+			// Restaurants from before versions have none, which is version 0
+			if *version == 0{
+				filter["version"] = bson.M{"$in": bson.A{0, nil}}
+			}
+		}
+
+		result, err := restaurantCollection.UpdateOne(ctx, filter, bson.D{
+			{Key: "$set", Value: updateObj},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		}, false)
+		if err == nil && result.MatchedCount == 0{
+			err = repository.ErrNotFound
+			count, countErr := restaurantCollection.Count(ctx, bson.M{"restaurant_id": restaurantId})
+			if countErr != nil{
+				err = countErr
+			} else if count > 0{
+				err = repository.ErrVersionConflict
+			}
+		}
+		if err != nil{
+			respondUpdateError(c, err, "restaurant", "restaurant update failed")
+			return
+		}
+		if version != nil{
+			setETag(c, *version+1)
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// tenantScope limits a filter to the restaurant the request acts on. Only
+// cross-site users who have not picked a restaurant see every site.
+func tenantScope(c *gin.Context, filter bson.M) bson.M{
+	if restaurantId := c.GetString("restaurantId"); restaurantId != ""{
+		filter["restaurant_id"] = restaurantId
+	}
+	return filter
+}
+
+// restaurantOf returns the restaurant the request acts on. It is empty for
+// cross-site users who have not picked one, which repositories read as every
+// restaurant.
+func restaurantOf(c *gin.Context) string{
+	return c.GetString("restaurantId")
+}
+
+// requireRestaurant returns the restaurant new documents belong to. A
+// cross-site user has to pick one first, otherwise it responds 400.
+func requireRestaurant(c *gin.Context) (string, bool){
+	restaurantId := c.GetString("restaurantId")
+	if restaurantId == ""{
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pick a restaurant with the X-Restaurant-Id header"})
+		return "", false
+	}
+	return restaurantId, true
+}
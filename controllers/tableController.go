@@ -3,61 +3,63 @@ package controller
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
+	"restaurant_app/repository"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var tableCollection *mongo.Collection = database.OpenCollection(database.Client, "table")
-
-func GetTables() gin.HandlerFunc{
+func GetTables(tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		result, err := tableCollection.Find(context.TODO(), bson.M{})
+		allTables, err := tables.List(ctx, restaurantOf(c))
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occurred while listing table items"})
-		}
-		var allTables []bson.M 
-		if err := result.All(ctx, &allTables); err != nil{
-			log.Fatal(err)
+			return
 		}
 		c.JSON(http.StatusOK, allTables)
 	}
 }
 
-func GetTable() gin.HandlerFunc{
+func GetTable(tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		tableId := c.Param("table_id")
-		var table models.Table
 
-		err := tableCollection.FindOne(ctx, bson.M{"table_id": tableId}).Decode(&table)
+		table, err := tables.Get(ctx, restaurantOf(c), tableId)
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "table was not found"})
+			return
+		}
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the table"})
 			return
 		}
+		setETag(c, table.Version)
 		c.JSON(http.StatusOK, table)
 	}
 }
 
-func CreateTable() gin.HandlerFunc{
+func CreateTable(tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		var table models.Table
+
+		restaurantId, ok := requireRestaurant(c)
+		if !ok{
+			return
+		}
+
 		err := c.BindJSON(&table)
 		if err != nil{
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -75,18 +77,23 @@ func CreateTable() gin.HandlerFunc{
 
 		table.ID = primitive.NewObjectID()
 		table.Table_id = table.ID.Hex()
+		table.Restaurant_id = restaurantId
+		// Versions and deletion are managed by the server only
+		table.Version = 0
+		table.Deleted_at = nil
+		table.Deleted_by = nil
 
-		result, insertErr := tableCollection.InsertOne(ctx, table)
+		insertErr := tables.Create(ctx, table)
 		if insertErr != nil{
 			msg := fmt.Sprintf("Table Item was not created")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 			return 
 		}
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": table.ID})
 	}
 }
 
-func UpdateTable() gin.HandlerFunc{
+func UpdateTable(tables repository.Tables) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
@@ -94,7 +101,11 @@ func UpdateTable() gin.HandlerFunc{
 		var table models.Table 
 
 		tableId := c.Param("table_id")
-		filter := bson.M{"table_id": tableId}
+
+		version, ok := requireIfMatch(c)
+		if !ok{
+			return
+		}
 		
 		err := c.BindJSON(&table)
 		if err != nil{
@@ -113,18 +124,86 @@ func UpdateTable() gin.HandlerFunc{
             updateObj = append(updateObj, bson.E{Key: "table_number", Value: table.Table_number})
         }
 
+		// Staff can clear a table by hand, e.g. when guests leave without ordering
+		if table.Table_status != ""{
+			if table.Table_status != models.TableFree && table.Table_status != models.TableOccupied{
+				c.JSON(http.StatusBadRequest, gin.H{"error": "table_status must be FREE or OCCUPIED"})
+				return
+			}
+			updateObj = append(updateObj, bson.E{Key: "table_status", Value: table.Table_status})
+		}
 
-		table.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 
-		upsert := true
-        opts := options.UpdateOptions{Upsert: &upsert}
+		table.Updated_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: table.Updated_at})
 
-		result, err := tableCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: updateObj}}, &opts)
+		result, err := updateIfMatch[models.Table](ctx, tables, restaurantOf(c), tableId, version, updateObj)
 		if err != nil{
 			msg := fmt.Sprintf("table item updated failed")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			respondUpdateError(c, err, "table", msg)
 			return
 		}
-		c.JSON(http.StatusOK, result)
+		respondUpdated(c, version, result)
+	}
+}
+
+// occupyTable marks a table as having guests.
+func occupyTable(ctx context.Context, tables repository.Tables, restaurantId string, tableId string) error{
+	return setTableStatus(ctx, tables, restaurantId, tableId, models.TableOccupied)
+}
+
+// releaseTable frees a table once none of its orders but orderId is unpaid.
+func releaseTable(ctx context.Context, tables repository.Tables, orders repository.Orders, restaurantId string, tableId string, orderId string) error{
+	tableOrders, err := orders.ByTable(ctx, restaurantId, tableId)
+	if err != nil{
+		return err
+	}
+	for _, order := range tableOrders{
+		if order.Order_id != orderId && order.Order_status != models.OrderPaid{
+			return nil
+		}
+	}
+	return setTableStatus(ctx, tables, restaurantId, tableId, models.TableFree)
+}
+
+func setTableStatus(ctx context.Context, tables repository.Tables, restaurantId string, tableId string, status string) error{
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "table_status", Value: status})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	_, err := tables.Update(ctx, restaurantId, tableId, updateObj)
+	return err
+}
+
+// DeleteTable soft deletes a table no order was taken at.
+func DeleteTable(transactions repository.Transactions, tables repository.Tables, orders repository.Orders) gin.HandlerFunc{
+	return func(c *gin.Context){
+		tableId := c.Param("table_id")
+		restaurantId := restaurantOf(c)
+
+		deleted := softDelete[models.Table](c, transactions, tables, restaurantId, tableId, "table", func(ctx context.Context) error{
+			return refuseIfAny[models.Order](ctx, orders, restaurantId, "table_id", tableId, "orders were taken at the table; delete them first")
+		})
+		if deleted{
+			c.JSON(http.StatusOK, gin.H{"message": "Table deleted"})
+		}
 	}
-}
\ No newline at end of file
+}
+
+func RestoreTable(transactions repository.Transactions, tables repository.Tables) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if restoreDeleted[models.Table](c, transactions, tables, restaurantOf(c), c.Param("table_id"), "table", nil){
+			c.JSON(http.StatusOK, gin.H{"message": "Table restored"})
+		}
+	}
+}
+
+func PurgeTable(tables repository.Tables) gin.HandlerFunc{
+	return func(c *gin.Context){
+		if purgeDeleted[models.Table](c, tables, restaurantOf(c), c.Param("table_id"), "table"){
+			c.JSON(http.StatusOK, gin.H{"message": "Table purged"})
+		}
+	}
+}
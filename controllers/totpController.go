@@ -0,0 +1,358 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type TotpCodeRequest struct{
+	Code			*string		`json:"code" validate:"required"`
+}
+
+type MfaEnrollRequest struct{
+	Mfa_token		*string		`json:"mfa_token" validate:"required"`
+}
+
+type MfaLoginRequest struct{
+	Mfa_token		*string		`json:"mfa_token" validate:"required"`
+	Code			*string		`json:"code" validate:"required"`
+}
+
+// EnrollTotp starts enrollment for the logged in user. The returned secret
+// only becomes active once ActivateTotp sees a valid code for it.
+func EnrollTotp(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		foundUser, err := users.Get(ctx, "", c.GetString("uid"))
+		if err != nil{
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if foundUser.Totp_enabled{
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		enrollTotp(ctx, c, users, foundUser)
+	}
+}
+
+// EnrollTotpAtLogin is used when a role requires TOTP but the user has not
+// enrolled yet. The mfa token from Login stands in for the access token, and
+// LoginSecondFactor activates the secret.
+func EnrollTotpAtLogin(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request MfaEnrollRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		foundUser, _, ok := userFromMfaToken(ctx, users, *request.Mfa_token)
+		if !ok{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid mfa token"})
+			return
+		}
+		// Otherwise a stolen password would be enough to replace the secret
+		if foundUser.Totp_enabled{
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		enrollTotp(ctx, c, users, foundUser)
+	}
+}
+
+// ActivateTotp confirms enrollment with a code from the authenticator app.
+func ActivateTotp(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request TotpCodeRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, "", c.GetString("uid"))
+		if err != nil{
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if foundUser.Totp_secret == nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication has not been enrolled"})
+			return
+		}
+
+		// Shares its counter with LoginSecondFactor, so guesses can't be
+		// spread over both
+		throttleKey := "mfa:" + foundUser.User_id
+		retryAfter, err := helpers.LoginRetryAfter(throttleKey)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+			return
+		}
+		if retryAfter > 0{
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+			return
+		}
+
+		valid, err := verifySecondFactor(ctx, users, foundUser, *request.Code, false)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		if !valid{
+			helpers.RecordLoginFailure(throttleKey)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code is invalid"})
+			return
+		}
+		helpers.ResetLoginFailures(throttleKey)
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled"})
+	}
+}
+
+// DisableTotp turns the second factor off for users whose role does not
+// require it. A current code or recovery code is needed.
+func DisableTotp(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request TotpCodeRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, "", c.GetString("uid"))
+		if err != nil{
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if helpers.TotpRequired(roleOf(foundUser)){
+			c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for your role"})
+			return
+		}
+		if !foundUser.Totp_enabled{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+			return
+		}
+
+		valid, err := verifySecondFactor(ctx, users, foundUser, *request.Code, true)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		if !valid{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code is invalid"})
+			return
+		}
+
+		if err := clearTotp(ctx, users, foundUser.User_id); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// ResetUserTotp lets an admin clear the second factor of a user who lost
+// their device. They will be asked to enroll again at their next login.
+func ResetUserTotp(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		userId := c.Param("user_id")
+
+		_, err := users.Get(ctx, userScope(c, userId), userId)
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the user"})
+			return
+		}
+
+		if err := clearTotp(ctx, users, userId); err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+	}
+}
+
+// LoginSecondFactor finishes a login started by Login. It accepts a TOTP
+// code or one of the recovery codes and issues the usual tokens.
+func LoginSecondFactor(users repository.Users) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request MfaLoginRequest
+
+		if err := c.BindJSON(&request); err != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil{
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		foundUser, claims, ok := userFromMfaToken(ctx, users, *request.Mfa_token)
+		if !ok || foundUser.Totp_secret == nil{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid mfa token"})
+			return
+		}
+
+		// Six digits are quick to guess, so codes are throttled like passwords
+		throttleKey := "mfa:" + foundUser.User_id
+		retryAfter, err := helpers.LoginRetryAfter(throttleKey)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+			return
+		}
+		if retryAfter > 0{
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, try again later"})
+			return
+		}
+
+		valid, err := verifySecondFactor(ctx, users, foundUser, *request.Code, foundUser.Totp_enabled)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		if !valid{
+			helpers.RecordLoginFailure(throttleKey)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "code is invalid"})
+			return
+		}
+		helpers.ResetLoginFailures(throttleKey)
+
+		// The token is spent only now, so a mistyped code can be retried
+		err = helpers.ConsumeMfaToken(ctx, claims)
+		if err == helpers.ErrInvalidMfaToken{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid mfa token"})
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the mfa token"})
+			return
+		}
+
+		issueLoginTokens(c, foundUser)
+	}
+}
+
+func userFromMfaToken(ctx context.Context, users repository.Users, mfaToken string) (models.User, *helpers.SignedDetails, bool){
+	claims, err := helpers.CheckMfaToken(ctx, mfaToken)
+	if err != nil{
+		return models.User{}, nil, false
+	}
+	foundUser, err := users.Get(ctx, "", claims.Uid)
+	if err != nil || foundUser.Deactivated_at != nil{
+		return foundUser, nil, false
+	}
+	return foundUser, claims, true
+}
+
+func enrollTotp(ctx context.Context, c *gin.Context, users repository.Users, foundUser models.User){
+	secret, uri, err := helpers.GenerateTotpSecret(*foundUser.Email)
+	if err != nil{
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create secret"})
+		return
+	}
+	codes, codeHashes, err := helpers.GenerateRecoveryCodes()
+	if err != nil{
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "totp_secret", Value: secret})
+	updateObj = append(updateObj, bson.E{Key: "totp_enabled", Value: false})
+	updateObj = append(updateObj, bson.E{Key: "totp_last_step", Value: 0})
+	updateObj = append(updateObj, bson.E{Key: "recovery_codes", Value: codeHashes})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	// At the version checked for an enabled second factor
+	_, err = users.UpdateVersion(ctx, "", foundUser.User_id, foundUser.Version, updateObj)
+	if err == repository.ErrVersionConflict{
+		c.JSON(http.StatusConflict, gin.H{"error": "user was changed meanwhile; try again"})
+		return
+	}
+	if err != nil{
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enroll two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"otpauth_uri": uri,
+		"recovery_codes": codes,
+	})
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code when
+// allowRecovery is set, and consumes it. A valid TOTP code also activates a
+// pending enrollment.
+func verifySecondFactor(ctx context.Context, users repository.Users, foundUser models.User, code string, allowRecovery bool) (bool, error){
+	if step, ok := helpers.ValidateTotp(*foundUser.Totp_secret, code, foundUser.Totp_last_step); ok{
+		return users.AdvanceTotpStep(ctx, foundUser.User_id, step)
+	}
+
+	if !allowRecovery{
+		return false, nil
+	}
+	return users.UseRecoveryCode(ctx, foundUser.User_id, helpers.HashRecoveryCode(code))
+}
+
+func clearTotp(ctx context.Context, users repository.Users, userId string) error{
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "totp_secret", Value: nil})
+	updateObj = append(updateObj, bson.E{Key: "totp_enabled", Value: false})
+	updateObj = append(updateObj, bson.E{Key: "totp_last_step", Value: 0})
+	updateObj = append(updateObj, bson.E{Key: "recovery_codes", Value: nil})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	_, err := users.Update(ctx, "", userId, updateObj)
+	return err
+}
@@ -4,94 +4,179 @@ import (
 	"context"
 	"log"
 	"net/http"
-	"restaurant_app/database"
 	"restaurant_app/models"
 	"restaurant_app/helpers"
+	"restaurant_app/repository"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"github.com/go-playground/validator/v10"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var userCollection *mongo.Collection = database.OpenCollection(database.Client, "user")
-var validate validator.New()
+type RoleRequest struct{
+	Role				*string		`json:"role" validate:"required,eq=ADMIN|eq=MANAGER|eq=WAITER|eq=KITCHEN|eq=CASHIER"`
+}
+
+type UserUpdate struct{
+	First_name			*string		`json:"first_name" validate:"omitempty,min=2,max=100"`
+	Last_name			*string		`json:"last_name" validate:"omitempty,min=2,max=100"`
+	Phone				*string		`json:"phone" validate:"omitempty,min=2"`
+	Avatar				*string		`json:"avatar"`
+}
+
+type PasswordChange struct{
+	Old_password		*string		`json:"old_password" validate:"required"`
+	New_password		*string		`json:"new_password" validate:"required,min=6"`
+}
+
+// UserViewFormat is what the API returns for a user. Password hashes, tokens
+// and second factor secrets never leave the server.
+type UserViewFormat struct{
+	User_id				string		`json:"user_id"`
+	First_name			*string		`json:"first_name"`
+	Last_name			*string		`json:"last_name"`
+	Email				*string		`json:"email"`
+	Phone				*string		`json:"phone"`
+	Avatar				*string		`json:"avatar"`
+	Role				*string		`json:"role"`
+	Restaurant_id		string		`json:"restaurant_id"`
+	Totp_enabled		bool		`json:"totp_enabled"`
+	Deactivated_at		*time.Time	`json:"deactivated_at"`
+	Created_at			time.Time	`json:"created_at"`
+	Updated_at			time.Time	`json:"updated_at"`
+	Version				int64		`json:"version"`
+}
+
+// An empty Restaurant_id makes an admin cross-site.
+type RestaurantRequest struct{
+	Restaurant_id		*string		`json:"restaurant_id"`
+}
+
+type PinRequest struct{
+	Pin					*string		`json:"pin" validate:"required,numeric,min=4,max=6"`
+}
+
+type SessionViewFormat struct{
+	models.Session
+	Is_current			bool		`json:"is_current"`
+}
+
+// RefreshRequest sends back the refreshToken a login or refresh returned.
+type RefreshRequest struct{
+	Refresh_token		*string		`json:"refreshToken" validate:"required"`
+}
+
+// DeviceNameHeader names the device a login is made from, e.g. "Bar tablet".
+const DeviceNameHeader = "X-Device-Name"
 
+var dummyHashOnce sync.Once
+var dummyHash string
 
-func GetUsers() gin.HandlerFunc {
+// GetUsers lists staff one page at a time. Optional query parameters:
+// search (matched against name, email and phone), role, active (true/false)
+// and sort, e.g. "-created_at".
+func GetUsers(users repository.Users) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		// Handling pagination parameters
 		recordPerPage, err := strconv.Atoi(c.DefaultQuery("recordPerPage", "10"))
-		if err != nil {
+		if err != nil || recordPerPage < 1 {
 			recordPerPage = 10 // default value
 		}
+		if recordPerPage > 100 {
+			recordPerPage = 100
+		}
 
 		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
-		if err != nil {
+		if err != nil || page < 1 {
 			page = 1 // default value
 		}
 
 		startIndex := (page - 1) * recordPerPage
-		startIndex, err = strconv.Atoi(c.Query("startIndex"))
-
-		matchStage := bson.D{{Key: "$match", Value: bson.D{{}}}} // Adjust this to filter your documents if needed
 
+		query := repository.UserQuery{
+			RestaurantId: restaurantOf(c),
+			Search: strings.Fields(c.Query("search")),
+			Role: strings.ToUpper(c.Query("role")),
+			StartIndex: startIndex,
+			Limit: recordPerPage,
+		}
 
-        // Projection stage to shape the output, including a pagination mechanism on a field "data"
-        projectStage := bson.D{
-            {Key: "$project", Value: bson.D{
-                {Key: "_id", Value: 0},
-                {Key: "total_count", Value: 1}, // Include total count in the output
-                {Key: "food_items", Value: bson.D{{Key: "$slice", Value: []interface{}{"$data", startIndex, recordPerPage}}}}, // Paginate "data" array
-            }}}
-        // Build the pipeline with all stages
-        pipeline := mongo.Pipeline{matchStage, projectStage}
+		if active := c.Query("active"); active != "" {
+			isActive, err := strconv.ParseBool(active)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"})
+				return
+			}
+			query.Active = &isActive
+		}
 
-		result, err := userCollection.Aggregate(ctx, pipeline)
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute query:"})
-            return
-        }
+		query.SortField = strings.TrimPrefix(c.DefaultQuery("sort", "first_name"), "-")
+		if !repository.UserSortFields[query.SortField] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot sort by " + query.SortField})
+			return
+		}
+		query.SortDescending = strings.HasPrefix(c.Query("sort"), "-")
 
-        var allUsers []bson.M
-        if err = result.All(ctx, &allUsers); err != nil {
-            log.Fatal(err)
-            return
-        }
+		matchingUsers, totalCount, err := users.Search(ctx, query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute query:"})
+			return
+		}
 
-        c.JSON(http.StatusOK, allUsers[0])
+		allUsers := []UserViewFormat{}
+		for _, user := range matchingUsers {
+			allUsers = append(allUsers, userView(user))
+		}
 
+		c.JSON(http.StatusOK, gin.H{
+			"total_count": totalCount,
+			"page": page,
+			"record_per_page": recordPerPage,
+			"user_items": allUsers,
+		})
 	}
 }
 
-func GetUser() gin.HandlerFunc{
+func GetUser(users repository.Users) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
 		userId := c.Param("user_id")
 
-		var user models.User
-		
-		err := userCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user)
+		if !isSelfOr(c, userId, models.RoleAdmin, models.RoleManager){
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to perform this action"})
+			return
+		}
+
+		user, err := users.Get(ctx, userScope(c, userId), userId)
+		if err == repository.ErrNotFound{
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing user items"})
 			return
 		}
-		c.JSON(http.StatusOK, user)
+		setETag(c, user.Version)
+		c.JSON(http.StatusOK, userView(user))
 	}
 }
 
 
-func SignUp() gin.HandlerFunc{
+func SignUp(users repository.Users) gin.HandlerFunc{
 	return func(c *gin.Context){
 
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
 		var user models.User
 		// Convert the JSON data coming from postman to something golang can understand 
 		err := c. BindJSON(&user)
@@ -102,17 +187,17 @@ func SignUp() gin.HandlerFunc{
 		// Validate the data based on your Struct
 		validationErr := validate.Struct(user)
 		if validationErr != nil{
-			c.JSON(http.StatusBadRequest, gin.H{"error", validationErr.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
 			return
 		}
 		// You'll check if the email has already been used by another user
 
-		emailCount, err := userCollection.CountDocuments(ctx, bson.M{"email": user.Email})
+		emailTaken, err := users.EmailTaken(ctx, *user.Email)
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for existing email"})
 			return
 		}
-		if emailCount > 0 {
+		if emailTaken {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "email already in use"})
 			return
 		}
@@ -123,46 +208,70 @@ func SignUp() gin.HandlerFunc{
 
 
 		// You'll also check if the phone number has already been used
-		phoneCount, err = userCollection.CountDocuments(ctx, bson.M{"phone": user.phone})
+		phoneTaken, err := users.PhoneTaken(ctx, *user.Phone, "")
 		if err != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for existing phone numbers"})
 			return
 		}
-		if phoneCount > 0 {
+		if phoneTaken {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "phone number already in use"})
 			return
 		}
 		
+		// Anyone can sign up, so new accounts get no role, and with it no
+		// access, until a manager or admin of the restaurant they sign up at
+		// approves them. The first admin is created with cmd/createadmin.
+		err = helpers.CheckRestaurant(user.Restaurant_id)
+		if err == helpers.ErrUnknownRestaurant {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "restaurant_id must name an existing restaurant"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the restaurant"})
+			return
+		}
+		user.Role = nil
+
+		// Second factor and account state are managed by the server only
+		user.Totp_secret = nil
+		user.Totp_enabled = false
+		user.Recovery_codes = nil
+		user.Deactivated_at = nil
+
+		// Versions and deletion are managed by the server only
+		user.Version = 0
+		user.Deleted_at = nil
+		user.Deleted_by = nil
+
 		// Create some extra details for the user object - created_at, updated_at, ID
 		user.Created_at = time.Now()
 		user.Updated_at = time.Now()
-		user.ID = primitive.NewObjectID
+		user.ID = primitive.NewObjectID()
 		user.User_id = user.ID.Hex()
 
-		
-		// Generate token and refresh token (generate all tokens functions from helper)
-		token, refreshToken, _ := helper.GenerateAllToken(*user.Email, *user.First_name, *user.Last_name, *user.User_id)
-		user.Token = &token
-		user.Refresh_Token = &refresh
-
 		// If all ok, then you have insert this user into the user collection
-		resultInsertionNumber, insertErr := userCollection.InsertOne(ctx, user)
+		insertErr := users.Create(ctx, user)
+		// Another sign up took the email or phone since the checks above
+		if insertErr == repository.ErrDuplicate{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email or phone number already in use"})
+			return
+		}
 		if insertErr != nil{
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 			return
 		}
 
 		// Return status OK and send the result back
-		c.JSON(http.StatusOK, resultInsertionNumber)
+		c.JSON(http.StatusOK, gin.H{"InsertedID": user.ID})
 	}
 }
 
-func Login() gin.HandlerFunc {
+func Login(users repository.Users) gin.HandlerFunc {
     return func(c *gin.Context) {
         ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
         defer cancel()
 
-        var user, foundUser models.User
+        var user models.User
 
         // Convert the login data from JSON to a Go struct
         if err := c.BindJSON(&user); err != nil {
@@ -170,38 +279,805 @@ func Login() gin.HandlerFunc {
             return
         }
 
-        // Find the user by email
-        err := userCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&foundUser)
+        if user.Email == nil || user.Password == nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
+            return
+        }
+
+        // Refuse early while throttled, before spending time on bcrypt
+        accountKey := helpers.AccountThrottleKey(*user.Email)
+        clientKey := helpers.ClientThrottleKey(c.ClientIP())
+        retryAfter, err := helpers.LoginRetryAfter(accountKey, clientKey)
         if err != nil {
-            c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found or login incorrect"})
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+            return
+        }
+        if retryAfter > 0 {
+            c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+            c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, try again later"})
             return
         }
 
+        // Find the user by email. An unknown email gets the same answer, and
+        // the same bcrypt cost, as a wrong password.
+        foundUser, err := users.GetByEmail(ctx, *user.Email)
+        storedPassword := dummyPasswordHash()
+        if err == nil && foundUser.Password != nil {
+            storedPassword = *foundUser.Password
+        }
+
         // Verify the password
-        passwordIsValid, msg := VerifyPassword(user.Password, foundUser.Password)
-		if !passwordIsValid {
-			
-            c.JSON(http.StatusUnauthorized, gin.H{"error": msg})
+        passwordIsValid, _ := VerifyPassword(*user.Password, storedPassword)
+        if err != nil || !passwordIsValid {
+            if err := helpers.RecordLoginFailure(accountKey, clientKey); err != nil {
+                log.Printf("Failed to record login failure: %v", err)
+            }
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Login or password is incorrect"})
+            return
+        }
+        helpers.ResetLoginFailures(accountKey)
+        // The password is what unlocks PIN login after too many wrong PINs
+        if err := unlockPin(ctx, users, foundUser); err != nil {
+            log.Printf("Failed to unlock PIN login: %v", err)
+        }
+
+        if foundUser.Deactivated_at != nil {
+            c.JSON(http.StatusForbidden, gin.H{"error": "This account has been deactivated"})
+            return
+        }
+        if foundUser.Role == nil {
+            c.JSON(http.StatusForbidden, gin.H{"error": "This account is awaiting approval"})
             return
         }
 
-        // Generate tokens
-        token, refreshToken, err := helper.GenerateAllTokens(foundUser.Email, foundUser.FirstName, foundUser.LastName, foundUser.UserID)
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+        if askSecondFactor(c, foundUser) {
             return
         }
+        issueLoginTokens(c, foundUser)
+    }
+}
 
-        // Update tokens
-        helper.UpdateAllTokens(token, refreshToken, foundUser.UserID)
+// askSecondFactor answers with an mfa token for the TOTP step when the user
+// must pass it: managers and admins, and anyone who opted in. It returns
+// whether it answered.
+func askSecondFactor(c *gin.Context, foundUser models.User) bool {
+    if !foundUser.Totp_enabled && !helpers.TotpRequired(roleOf(foundUser)) {
+        return false
+    }
+    mfaToken, err := helpers.GenerateMfaToken(foundUser.User_id)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+        return true
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "message": "Second factor required",
+        "mfa_required": true,
+        "mfa_enrollment_required": !foundUser.Totp_enabled,
+        "mfa_token": mfaToken,
+    })
+    return true
+}
+
+// issueLoginTokens starts a new session for the user and sends its tokens
+// back as the response of a successful login. Clients name the device they
+// log in from with the X-Device-Name header.
+func issueLoginTokens(c *gin.Context, foundUser models.User) {
+    // Generate tokens
+    token, refreshToken, err := helpers.GenerateAllTokens(*foundUser.Email, *foundUser.First_name, *foundUser.Last_name, foundUser.User_id, roleOf(foundUser), foundUser.Restaurant_id)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+        return
+    }
 
-        // Return successful login data
-        c.JSON(http.StatusOK, gin.H{
-            "message": "Login successful",
-            "token": token,
-            "refreshToken": refreshToken,
-        })
+    deviceName := c.GetHeader(DeviceNameHeader)
+    if deviceName == "" {
+        deviceName = c.Request.UserAgent()
+    }
+    session, err := helpers.CreateSession(foundUser, refreshToken, deviceName, c.ClientIP(), c.Request.UserAgent())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start the session"})
+        return
     }
+
+    // Return successful login data
+    c.JSON(http.StatusOK, gin.H{
+        "message": "Login successful",
+        "token": token,
+        "refreshToken": refreshToken,
+        "session_id": session.Session_id,
+    })
+}
+
+// Refresh exchanges a refresh token for a new pair. Each refresh token can be
+// used once; presenting an already-rotated token of a session means it was
+// copied, so the session is revoked and the user has to log in again there.
+func Refresh(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request RefreshRequest
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		claims, msg := helpers.ValidateToken(*request.Refresh_token)
+		if msg != "" || claims.TokenType != helpers.RefreshTokenType {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+
+		session, err := helpers.GetSession(claims.Family)
+		if err == helpers.ErrSessionRevoked || (err == nil && session.User_id != claims.Uid) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the session"})
+			return
+		}
+
+		if session.Refresh_token_id != claims.Id {
+			// A token of the live session that is no longer current has been replayed
+			log.Printf("Refresh token reuse detected for user %s, revoking session %s", claims.Uid, session.Session_id)
+			helpers.RevokeSession(claims.Uid, session.Session_id)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used"})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, "", claims.Uid)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+
+		if foundUser.Deactivated_at != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+
+		token, refreshToken, err := helpers.GenerateFamilyTokens(*foundUser.Email, *foundUser.First_name, *foundUser.Last_name, foundUser.User_id, roleOf(foundUser), foundUser.Restaurant_id, claims.Family)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+			return
+		}
+
+		rotated, err := helpers.RotateSession(claims, refreshToken, c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tokens"})
+			return
+		}
+		if !rotated {
+			// Another request exchanged the same token in the meantime
+			log.Printf("Concurrent refresh token reuse detected for user %s, revoking session %s", foundUser.User_id, session.Session_id)
+			helpers.RevokeSession(foundUser.User_id, session.Session_id)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Token refreshed",
+			"token": token,
+			"refreshToken": refreshToken,
+		})
+	}
+}
+
+// Logout revokes the access token used for the call and ends its session, so
+// the session's refresh token cannot be used again either.
+func Logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.GetString("uid")
+
+		claims := &helpers.SignedDetails{Uid: userId}
+		claims.Id = c.GetString("tokenId")
+		claims.ExpiresAt = c.GetInt64("tokenExpiresAt")
+
+		if err := helpers.RevokeToken(claims); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+			return
+		}
+		if sessionId := c.GetString("sessionId"); sessionId != "" {
+			if _, err := helpers.RevokeSession(userId, sessionId); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Logout successful"})
+	}
+}
+
+// GetSessions lists the caller's active sessions. The one the request was
+// made with is flagged as current.
+func GetSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := helpers.ListSessions(c.GetString("uid"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while listing sessions"})
+			return
+		}
+
+		allSessions := []SessionViewFormat{}
+		for _, session := range sessions {
+			allSessions = append(allSessions, SessionViewFormat{
+				Session:    session,
+				Is_current: session.Session_id == c.GetString("sessionId"),
+			})
+		}
+		c.JSON(http.StatusOK, allSessions)
+	}
+}
+
+// RevokeSession ends one of the caller's sessions, e.g. on a lost tablet.
+func RevokeSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revoked, err := helpers.RevokeSession(c.GetString("uid"), c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "session revocation failed"})
+			return
+		}
+		if !revoked {
+			c.JSON(http.StatusNotFound, gin.H{"error": "active session was not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+	}
+}
+
+// RevokeUserSessions lets an admin end every session of a user, e.g. when a
+// member of staff leaves. Tokens issued before the call stop working at once.
+func RevokeUserSessions(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		userId := c.Param("user_id")
+
+		_, err := users.Get(ctx, userScope(c, userId), userId)
+		if err == repository.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occured while fetching the user"})
+			return
+		}
+
+		if err := helpers.RevokeUserTokens(userId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked"})
+	}
+}
+
+// UpdateUser changes the profile fields of a user. Users may edit their own
+// profile; admins may edit anyone's.
+func UpdateUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var update UserUpdate
+		userId := c.Param("user_id")
+
+		if !isSelfOr(c, userId, models.RoleAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to perform this action"})
+			return
+		}
+		version, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+		if err := c.BindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(update)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		var updateObj primitive.D
+
+		if update.First_name != nil {
+			updateObj = append(updateObj, bson.E{Key: "first_name", Value: update.First_name})
+		}
+		if update.Last_name != nil {
+			updateObj = append(updateObj, bson.E{Key: "last_name", Value: update.Last_name})
+		}
+		if update.Avatar != nil {
+			updateObj = append(updateObj, bson.E{Key: "avatar", Value: update.Avatar})
+		}
+		if update.Phone != nil {
+			phoneTaken, err := users.PhoneTaken(ctx, *update.Phone, userId)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for existing phone numbers"})
+				return
+			}
+			if phoneTaken {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "phone number already in use"})
+				return
+			}
+			updateObj = append(updateObj, bson.E{Key: "phone", Value: update.Phone})
+		}
+
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		_, err := updateIfMatch[models.User](ctx, users, userScope(c, userId), userId, version, updateObj)
+		if err == repository.ErrDuplicate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "phone number already in use"})
+			return
+		}
+		if err != nil {
+			respondUpdateError(c, err, "user", "user update failed")
+			return
+		}
+		user, err := users.Get(ctx, "", userId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "user update failed"})
+			return
+		}
+		setETag(c, user.Version)
+		c.JSON(http.StatusOK, userView(user))
+	}
+}
+
+// ChangePassword sets a new password for the logged in user after checking
+// the current one. Every session ends, including the caller's.
+func ChangePassword(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request PasswordChange
+		userId := c.GetString("uid")
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, "", userId)
+		if err != nil || foundUser.Password == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+
+		// A stolen access token must not allow guessing the password, so
+		// wrong guesses count against the account as at login
+		accountKey := helpers.AccountThrottleKey(*foundUser.Email)
+		retryAfter, err := helpers.LoginRetryAfter(accountKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+			return
+		}
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+			return
+		}
+
+		passwordIsValid, msg := VerifyPassword(*request.Old_password, *foundUser.Password)
+		if !passwordIsValid {
+			if err := helpers.RecordLoginFailure(accountKey); err != nil {
+				log.Printf("Failed to record login failure: %v", err)
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		helpers.ResetLoginFailures(accountKey)
+
+		password := HashPassword(*request.New_password)
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "password", Value: password})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		// At the version the old password was checked against
+		_, err = users.UpdateVersion(ctx, "", userId, foundUser.Version, updateObj)
+		if err == repository.ErrVersionConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": "user was changed meanwhile; try again"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "password update failed"})
+			return
+		}
+
+		if err := helpers.RevokeUserTokens(userId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Password was changed but sessions could not be revoked"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed, please log in again"})
+	}
+}
+
+// SetPin sets the PIN the logged in user enters on shared terminals.
+func SetPin(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request PinRequest
+		userId := c.GetString("uid")
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		// A lower cost than passwords so switching users stays quick; the
+		// PIN throttle limits guessing instead
+		pinHash, err := bcrypt.GenerateFromPassword([]byte(*request.Pin), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "pin update failed"})
+			return
+		}
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "pin_hash", Value: string(pinHash)})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		result, err := users.Update(ctx, "", userId, updateObj)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "pin update failed"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		helpers.ResetLoginFailures(helpers.PinThrottleKey(userId))
+		c.JSON(http.StatusOK, gin.H{"message": "PIN updated"})
+	}
+}
+
+// DeactivateUser blocks a user from logging in and ends their sessions. The
+// account and its history are kept.
+func DeactivateUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("user_id")
+
+		if userId == c.GetString("uid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot deactivate your own account"})
+			return
+		}
+
+		now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		if !setUserDeactivated(c, users, userId, &now) {
+			return
+		}
+		if err := helpers.RevokeUserTokens(userId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "User was deactivated but sessions could not be revoked"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User deactivated"})
+	}
+}
+
+func ReactivateUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !setUserDeactivated(c, users, c.Param("user_id"), nil) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User reactivated"})
+	}
+}
+
+func setUserDeactivated(c *gin.Context, users repository.Users, userId string, deactivatedAt *time.Time) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "deactivated_at", Value: deactivatedAt})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	result, err := users.Update(ctx, userScope(c, userId), userId, updateObj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user update failed"})
+		return false
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+		return false
+	}
+	return true
+}
+
+// isSelfOr reports whether the caller is the given user or has one of roles.
+func isSelfOr(c *gin.Context, userId string, roles ...string) bool {
+	if c.GetString("uid") == userId {
+		return true
+	}
+	role := c.GetString("role")
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func userView(user models.User) UserViewFormat {
+	return UserViewFormat{
+		User_id:        user.User_id,
+		First_name:     user.First_name,
+		Last_name:      user.Last_name,
+		Email:          user.Email,
+		Phone:          user.Phone,
+		Avatar:         user.Avatar,
+		Role:           user.Role,
+		Restaurant_id:  user.Restaurant_id,
+		Totp_enabled:   user.Totp_enabled,
+		Deactivated_at: user.Deactivated_at,
+		Created_at:     user.Created_at,
+		Updated_at:     user.Updated_at,
+		Version:        user.Version,
+	}
+}
+
+// UpdateUserRole lets an admin change the role of a user. The new role is
+// carried by the user's next access token.
+func UpdateUserRole(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request RoleRequest
+		userId := c.Param("user_id")
+
+		version, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "role", Value: request.Role})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		result, err := updateIfMatch[models.User](ctx, users, userScope(c, userId), userId, version, updateObj)
+		if err != nil {
+			respondUpdateError(c, err, "user", "user role update failed")
+			return
+		}
+		respondUpdated(c, version, result)
+	}
+}
+
+// ApproveUser gives a user who signed up a role, which lets them log in.
+// Managers approve the staff of their restaurant as waiters, kitchen staff
+// or cashiers; admins can approve any role.
+func ApproveUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request RoleRequest
+		userId := c.Param("user_id")
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		validationErr := validate.Struct(request)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+		if c.GetString("role") != models.RoleAdmin && (*request.Role == models.RoleAdmin || *request.Role == models.RoleManager) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can approve managers and admins"})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, restaurantOf(c), userId)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+		if foundUser.Role != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user has been approved already"})
+			return
+		}
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "role", Value: request.Role})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		// At the version read above, so two approvals can't both succeed
+		_, err = users.UpdateVersion(ctx, restaurantOf(c), userId, foundUser.Version, updateObj)
+		if err == repository.ErrVersionConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": "user was changed meanwhile; fetch it again and retry"})
+			return
+		}
+		if err != nil {
+			respondUpdateError(c, err, "user", "user approval failed")
+			return
+		}
+		setETag(c, foundUser.Version+1)
+		c.JSON(http.StatusOK, gin.H{"message": "User approved"})
+	}
+}
+
+// UpdateUserRestaurant lets a cross-site admin move a user to another
+// restaurant, or make an admin cross-site. The user's sessions are revoked so
+// no token keeps the old restaurant.
+func UpdateUserRestaurant(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request RestaurantRequest
+		userId := c.Param("user_id")
+
+		version, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Restaurant_id == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "restaurant_id is required"})
+			return
+		}
+
+		foundUser, err := users.Get(ctx, "", userId)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+
+		if *request.Restaurant_id == "" {
+			if roleOf(foundUser) != models.RoleAdmin {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "only admins can work across restaurants"})
+				return
+			}
+		} else {
+			err := helpers.CheckRestaurant(*request.Restaurant_id)
+			if err == helpers.ErrUnknownRestaurant {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "restaurant_id must name an existing restaurant"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the restaurant"})
+				return
+			}
+		}
+
+		var updateObj primitive.D
+
+		updateObj = append(updateObj, bson.E{Key: "restaurant_id", Value: *request.Restaurant_id})
+		Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+		_, err = updateIfMatch[models.User](ctx, users, "", userId, version, updateObj)
+		if err != nil {
+			respondUpdateError(c, err, "user", "user restaurant update failed")
+			return
+		}
+		if err := helpers.RevokeUserTokens(userId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "User was moved but sessions could not be revoked"})
+			return
+		}
+		if version != nil {
+			setETag(c, *version+1)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User restaurant updated"})
+	}
+}
+
+// userScope returns the restaurant a user is looked up in: the one the
+// request acts on, or any for users reaching their own account.
+func userScope(c *gin.Context, userId string) string {
+	if userId == c.GetString("uid") {
+		return ""
+	}
+	return restaurantOf(c)
+}
+
+// roleOf returns the role stored on the user, or an empty role for accounts
+// created before roles existed, which Authorize rejects everywhere.
+func roleOf(user models.User) string {
+	if user.Role == nil {
+		return ""
+	}
+	return *user.Role
+}
+
+// UnlockUser lets an admin clear the failed-login lock on an account.
+func UnlockUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		userId := c.Param("user_id")
+
+		foundUser, err := users.Get(ctx, userScope(c, userId), userId)
+		if err != nil || foundUser.Email == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user was not found"})
+			return
+		}
+
+		if err := helpers.ResetLoginFailures(helpers.AccountThrottleKey(*foundUser.Email)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+			return
+		}
+		if err := unlockPin(ctx, users, foundUser); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+	}
+}
+
+// unlockPin lets the user log in with their PIN again, when too many wrong
+// PINs locked it.
+func unlockPin(ctx context.Context, users repository.Users, user models.User) error {
+	if user.Pin_locked_at == nil {
+		return nil
+	}
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "pin_locked_at", Value: nil})
+	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
+
+	if _, err := users.Update(ctx, "", user.User_id, updateObj); err != nil {
+		return err
+	}
+	return helpers.ResetLoginFailures(helpers.PinThrottleKey(user.User_id))
+}
+
+// dummyPasswordHash is checked against when the email is unknown, so that a
+// miss takes as long as a wrong password.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash = HashPassword(primitive.NewObjectID().Hex())
+	})
+	return dummyHash
 }
 
 
@@ -219,4 +1095,43 @@ func VerifyPassword(userPassword, providedPassword string) (bool, string) {
         return false, "Login or password is incorrect"
     }
     return true, ""
-}
\ No newline at end of file
+}
+// DeleteUser soft deletes a user, ending their sessions. Their email and
+// phone stay taken until the user is purged.
+func DeleteUser(transactions repository.Transactions, users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("user_id")
+
+		if userId == c.GetString("uid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot delete your own account"})
+			return
+		}
+
+		if !softDelete[models.User](c, transactions, users, userScope(c, userId), userId, "user", nil) {
+			return
+		}
+		if err := helpers.RevokeUserTokens(userId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "User was deleted but sessions could not be revoked"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+	}
+}
+
+func RestoreUser(transactions repository.Transactions, users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("user_id")
+		if restoreDeleted[models.User](c, transactions, users, userScope(c, userId), userId, "user", nil) {
+			c.JSON(http.StatusOK, gin.H{"message": "User restored"})
+		}
+	}
+}
+
+func PurgeUser(users repository.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("user_id")
+		if purgeDeleted[models.User](c, users, userScope(c, userId), userId, "user") {
+			c.JSON(http.StatusOK, gin.H{"message": "User purged"})
+		}
+	}
+}
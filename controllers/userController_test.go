@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useMemoryStorage points the handlers and helpers at a new in-memory
+// storage and returns it, with a key-encryption key set so tokens can be
+// signed.
+func useMemoryStorage(t *testing.T) *repository.Repositories {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv(helpers.KeyEncryptionKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	repos := repository.NewMemory()
+	helpers.UseStorage(repos.Collections)
+	UseStorage(repos.Collections)
+	return repos
+}
+
+// createUser stores an approved user of the role at restaurantId with the
+// password and, unless it is empty, the PIN. The hashes use bcrypt's lowest
+// cost to keep the tests quick.
+func createUser(t *testing.T, users repository.Users, role string, restaurantId string, password string, pin string) models.User {
+	t.Helper()
+	id := primitive.NewObjectID()
+	firstName, lastName := "Test", "User"
+	email := "user-" + id.Hex() + "@example.com"
+	phone := id.Hex()
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user := models.User{
+		ID:            id,
+		User_id:       id.Hex(),
+		First_name:    &firstName,
+		Last_name:     &lastName,
+		Email:         &email,
+		Phone:         &phone,
+		Password:      hash(t, password),
+		Role:          &role,
+		Restaurant_id: restaurantId,
+		Created_at:    now,
+		Updated_at:    now,
+	}
+	if pin != "" {
+		user.Pin_hash = hash(t, pin)
+	}
+	if err := users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func hash(t *testing.T, secret string) *string {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := string(hashed)
+	return &encoded
+}
+
+// post sends body as JSON and returns the status and the response's JSON
+// object.
+func post(t *testing.T, router *gin.Engine, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := json.NewEncoder(&encoded).Encode(body); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, path, &encoded)
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("POST %s answered %s: %v", path, response.Body, err)
+	}
+	return response.Code, decoded
+}
+
+func TestRefreshReuseRevokesTheFamily(t *testing.T) {
+	repos := useMemoryStorage(t)
+	user := createUser(t, repos.Users, models.RoleWaiter, "restaurant-1", "waiterpw1", "")
+
+	router := gin.New()
+	router.POST("/users/login", Login(repos.Users))
+	router.POST("/users/refresh", Refresh(repos.Users))
+
+	login := func() (token string, refreshToken string) {
+		t.Helper()
+		status, body := post(t, router, "/users/login", gin.H{"email": *user.Email, "password": "waiterpw1"})
+		if status != http.StatusOK {
+			t.Fatalf("login answered %d: %v", status, body)
+		}
+		return body["token"].(string), body["refreshToken"].(string)
+	}
+	refresh := func(refreshToken string, want int) map[string]interface{} {
+		t.Helper()
+		status, body := post(t, router, "/users/refresh", gin.H{"refreshToken": refreshToken})
+		if status != want {
+			t.Fatalf("refresh answered %d, want %d: %v", status, want, body)
+		}
+		return body
+	}
+
+	token, first := login()
+	_, otherSession := login()
+
+	second := refresh(first, http.StatusOK)["refreshToken"].(string)
+	third := refresh(second, http.StatusOK)["refreshToken"].(string)
+
+	// Replaying a rotated token ends the session: the current refresh token
+	// and the session's access tokens stop working
+	refresh(first, http.StatusUnauthorized)
+	refresh(third, http.StatusUnauthorized)
+	claims, msg := helpers.ValidateToken(token)
+	if msg != "" {
+		t.Fatal(msg)
+	}
+	if err := helpers.CheckSession(claims.Family, "192.0.2.1"); err != helpers.ErrSessionRevoked {
+		t.Fatalf("the session's access token is still accepted: %v", err)
+	}
+
+	// Other logins of the user carry on
+	refresh(otherSession, http.StatusOK)
+}
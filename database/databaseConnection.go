@@ -4,40 +4,132 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-func DBinstance() *mongo.Client{
-	MongoDb := "mongodb://localhost:27017"
-	fmt.Print(MongoDb)
+// Config says where MongoDB is and how to talk to it. Zero pool sizes and
+// timeouts leave the driver defaults in place.
+type Config struct {
+	URI                    string
+	DatabaseName           string
+	MinPoolSize            uint64
+	MaxPoolSize            uint64
+	MaxConnIdleTime        time.Duration
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	SocketTimeout          time.Duration
+}
 
-	client, err := mongo.NewClient(options.Client().ApplyURI(MongoDb))
+// LoadConfig reads the connection settings from the environment:
+//
+//	MONGODB_URI                       mongodb://localhost:27017
+//	MONGODB_DATABASE                  vicDatabase, shared by every restaurant
+//	MONGODB_MIN_POOL_SIZE             driver default
+//	MONGODB_MAX_POOL_SIZE             driver default
+//	MONGODB_MAX_CONN_IDLE_TIME        driver default, e.g. 5m
+//	MONGODB_CONNECT_TIMEOUT           10s
+//	MONGODB_SERVER_SELECTION_TIMEOUT  10s
+//	MONGODB_SOCKET_TIMEOUT            driver default
+func LoadConfig() (Config, error){
+	config := Config{
+		URI:          envOrDefault("MONGODB_URI", "mongodb://localhost:27017"),
+		DatabaseName: envOrDefault("MONGODB_DATABASE", "vicDatabase"),
+	}
 
-	if err!= nil {
-		log.Fatal(err)
+	var err error
+	if config.MinPoolSize, err = uintFromEnv("MONGODB_MIN_POOL_SIZE", 0); err != nil{
+		return config, err
+	}
+	if config.MaxPoolSize, err = uintFromEnv("MONGODB_MAX_POOL_SIZE", 0); err != nil{
+		return config, err
+	}
+	if config.MaxPoolSize != 0 && config.MinPoolSize > config.MaxPoolSize{
+		return config, fmt.Errorf("MONGODB_MIN_POOL_SIZE %d is above MONGODB_MAX_POOL_SIZE %d", config.MinPoolSize, config.MaxPoolSize)
+	}
+	if config.MaxConnIdleTime, err = durationFromEnv("MONGODB_MAX_CONN_IDLE_TIME", 0); err != nil{
+		return config, err
+	}
+	if config.ConnectTimeout, err = durationFromEnv("MONGODB_CONNECT_TIMEOUT", 10*time.Second); err != nil{
+		return config, err
+	}
+	if config.ServerSelectionTimeout, err = durationFromEnv("MONGODB_SERVER_SELECTION_TIMEOUT", 10*time.Second); err != nil{
+		return config, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if config.SocketTimeout, err = durationFromEnv("MONGODB_SOCKET_TIMEOUT", 0); err != nil{
+		return config, err
+	}
+	return config, nil
+}
 
-	defer cancel()
+// Connect opens a client for the config and pings the primary, so a wrong
+// URI fails here rather than on the first request.
+func Connect(ctx context.Context, config Config) (*mongo.Client, error){
+	clientOptions := options.Client().ApplyURI(config.URI)
+	if config.MinPoolSize != 0{
+		clientOptions.SetMinPoolSize(config.MinPoolSize)
+	}
+	if config.MaxPoolSize != 0{
+		clientOptions.SetMaxPoolSize(config.MaxPoolSize)
+	}
+	if config.MaxConnIdleTime != 0{
+		clientOptions.SetMaxConnIdleTime(config.MaxConnIdleTime)
+	}
+	if config.ConnectTimeout != 0{
+		clientOptions.SetConnectTimeout(config.ConnectTimeout)
+	}
+	if config.ServerSelectionTimeout != 0{
+		clientOptions.SetServerSelectionTimeout(config.ServerSelectionTimeout)
+	}
+	if config.SocketTimeout != 0{
+		clientOptions.SetSocketTimeout(config.SocketTimeout)
+	}
 
-	err = client.Connect(ctx)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil{
+		return nil, err
+	}
 
-	if err!= nil{
-		log.Fatal(err)
+	if err := client.Ping(ctx, readpref.Primary()); err != nil{
+		client.Disconnect(context.Background())
+		return nil, err
 	}
-	fmt.Println("connected to mongodb")
-	return client
+	log.Printf("Connected to MongoDB, database %s", config.DatabaseName)
+	return client, nil
 }
 
+func envOrDefault(key, fallback string) string{
+	if value := os.Getenv(key); value != ""{
+		return value
+	}
+	return fallback
+}
 
-var Client *mongo.Client = DBinstance()
-
-
-func OpenCollection(client *mongo.Client, collectionName string) *mongo.Collection{
-	var collection *mongo.Collection = client.Database("vicDatabase").Collection(collectionName)
+func uintFromEnv(key string, fallback uint64) (uint64, error){
+	value := os.Getenv(key)
+	if value == ""{
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil{
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return parsed, nil
+}
 
-	return collection
-}
\ No newline at end of file
+func durationFromEnv(key string, fallback time.Duration) (time.Duration, error){
+	value := os.Getenv(key)
+	if value == ""{
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0{
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,103 @@
+// Package events turns changes to orders, order items and invoices into
+// domain events and hands them to whoever subscribed, such as kitchen
+// screens, analytics or notifications, so they need not poll.
+//
+// Events come from MongoDB change streams, which need a replica set. Each
+// event is delivered at least once: the stream's position is saved only
+// once every handler has taken the event, so a crash or a failing handler
+// means it is delivered again. Handlers that must not act twice can use
+// Event.Id to tell.
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restaurant_app/models"
+	"sync"
+	"time"
+)
+
+// Type is what happened, like "order.created".
+type Type string
+
+// Entities that are restored come back as created or added.
+const (
+	OrderCreated = Type("order.created")
+	OrderUpdated = Type("order.updated")
+	OrderDeleted = Type("order.deleted")
+
+	ItemAdded   = Type("item.added")
+	ItemUpdated = Type("item.updated")
+	ItemRemoved = Type("item.removed")
+
+	InvoiceCreated = Type("invoice.created")
+	InvoiceUpdated = Type("invoice.updated")
+	InvoicePaid    = Type("invoice.paid")
+	InvoiceDeleted = Type("invoice.deleted")
+)
+
+// Event is one change to an order, an order item or an invoice. Exactly one
+// of Order, Order_item and Invoice is set, as the entity was once changed.
+type Event struct {
+	// Id is unique to the event and the same each time it is delivered
+	Id            string
+	Type          Type
+	Occurred_at   time.Time
+	Restaurant_id string
+	Order_id      string
+	Order         *models.Order
+	Order_item    *models.OrderItem
+	Invoice       *models.Invoice
+}
+
+// Handler takes an event. Returning an error has it delivered again, to
+// every handler, after a pause.
+type Handler func(ctx context.Context, event Event) error
+
+// Bus hands events to the handlers that subscribed to their type.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[Type][]Handler
+	all      []Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: map[Type][]Handler{}}
+}
+
+// Subscribe has handler called with every event of types, or with every
+// event when no type is given. Handlers are called one at a time, in the
+// order events happened, so they should be quick.
+func (b *Bus) Subscribe(handler Handler, types ...Type) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(types) == 0 {
+		b.all = append(b.all, handler)
+		return
+	}
+	for _, eventType := range types {
+		b.handlers[eventType] = append(b.handlers[eventType], handler)
+	}
+}
+
+// Publish calls the handlers of event, stopping at the first that fails.
+func (b *Bus) Publish(ctx context.Context, event Event) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.all...), b.handlers[event.Type]...)
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, event); err != nil {
+			return fmt.Errorf("handling %s %s: %w", event.Type, event.Id, err)
+		}
+	}
+	return nil
+}
+
+// LogEvents logs every event, to see what the bus carries.
+func LogEvents(ctx context.Context, event Event) error {
+	log.Printf("Event %s %s for order %s", event.Type, event.Id, event.Order_id)
+	return nil
+}
@@ -0,0 +1,276 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"restaurant_app/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// positionCollection keeps, for each stream, the resume token of the last
+// change every handler took.
+const positionCollection = "eventStream"
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// Stream tails the order, orderItem and invoice collections and publishes
+// their changes on a bus.
+type Stream struct {
+	db   *mongo.Database
+	bus  *Bus
+	name string
+}
+
+// NewStream makes a stream that publishes on bus and saves its position
+// under name. Instances that share a name share a position, so each instance
+// that runs its own handlers needs its own name.
+func NewStream(db *mongo.Database, bus *Bus, name string) *Stream {
+	return &Stream{db: db, bus: bus, name: name}
+}
+
+// Start tails in the background until ctx is done, resuming after failures
+// from the last saved position. The returned channel is closed once it has
+// stopped.
+func (s *Stream) Start(ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.run(ctx)
+	}()
+	return stopped
+}
+
+func (s *Stream) run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		progressed, err := s.tail(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if isNotReplicaSet(err) {
+			log.Print("Not publishing events: change streams need MongoDB to run as a replica set")
+			return
+		}
+		if isHistoryLost(err) {
+			log.Printf("Event stream %s fell behind what MongoDB keeps; changes since it stopped are lost, resuming from now", s.name)
+			if err = s.forgetPosition(ctx); err == nil {
+				continue
+			}
+		}
+
+		if progressed {
+			delay = minRetryDelay
+		}
+		log.Printf("Event stream %s stopped, resuming in %s: %v", s.name, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// change is the part of a change stream event the stream reads.
+type change struct {
+	Id            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// tail publishes changes from the saved position until it fails, reporting
+// whether it got anywhere first.
+func (s *Stream) tail(ctx context.Context) (bool, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	token, err := s.position(ctx)
+	if err != nil {
+		return false, err
+	}
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+
+	// Purges are left out: the soft delete before them was the event
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"ns.coll":       bson.M{"$in": bson.A{"order", "orderItem", "invoice"}},
+		"operationType": bson.M{"$in": bson.A{"insert", "update"}},
+	}}}}
+	stream, err := s.db.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close(context.Background())
+
+	// Saved right away, so changes made before the first one that makes an
+	// event are not missed after a restart
+	if token == nil && stream.ResumeToken() != nil {
+		if err := s.savePosition(ctx, stream.ResumeToken()); err != nil {
+			return false, err
+		}
+	}
+
+	progressed := false
+	for stream.Next(ctx) {
+		var c change
+		if err := stream.Decode(&c); err != nil {
+			return progressed, err
+		}
+		events, err := toEvents(c)
+		if err != nil {
+			return progressed, err
+		}
+		for _, event := range events {
+			if err := s.bus.Publish(ctx, event); err != nil {
+				return progressed, err
+			}
+		}
+		if err := s.savePosition(ctx, stream.ResumeToken()); err != nil {
+			return progressed, err
+		}
+		progressed = true
+	}
+	return progressed, stream.Err()
+}
+
+// toEvents makes the domain events of a change. A change can make none,
+// such as an update to an entity purged since, or several, such as an
+// invoice created already paid.
+func toEvents(c change) ([]Event, error) {
+	if c.FullDocument == nil {
+		return nil, nil
+	}
+
+	deletedAt, deletedChanged := c.UpdateDescription.UpdatedFields["deleted_at"]
+	created := c.OperationType == "insert" || (deletedChanged && deletedAt == nil)
+	deleted := deletedChanged && deletedAt != nil
+
+	id, _ := c.Id.Lookup("_data").StringValueOK()
+	base := Event{Id: id, Occurred_at: time.Unix(int64(c.ClusterTime.T), 0)}
+	event := func(eventType Type) Event {
+		e := base
+		e.Type = eventType
+		e.Id = base.Id + ":" + string(eventType)
+		return e
+	}
+
+	switch c.Ns.Coll {
+	case "order":
+		var order models.Order
+		if err := bson.Unmarshal(c.FullDocument, &order); err != nil {
+			return nil, err
+		}
+		base.Restaurant_id, base.Order_id, base.Order = order.Restaurant_id, order.Order_id, &order
+		switch {
+		case created:
+			return []Event{event(OrderCreated)}, nil
+		case deleted:
+			return []Event{event(OrderDeleted)}, nil
+		}
+		return []Event{event(OrderUpdated)}, nil
+
+	case "orderItem":
+		var orderItem models.OrderItem
+		if err := bson.Unmarshal(c.FullDocument, &orderItem); err != nil {
+			return nil, err
+		}
+		base.Restaurant_id, base.Order_id, base.Order_item = orderItem.Restaurant_id, orderItem.Order_id, &orderItem
+		switch {
+		case created:
+			return []Event{event(ItemAdded)}, nil
+		case deleted:
+			return []Event{event(ItemRemoved)}, nil
+		}
+		return []Event{event(ItemUpdated)}, nil
+
+	case "invoice":
+		var invoice models.Invoice
+		if err := bson.Unmarshal(c.FullDocument, &invoice); err != nil {
+			return nil, err
+		}
+		base.Restaurant_id, base.Order_id, base.Invoice = invoice.Restaurant_id, invoice.Order_id, &invoice
+
+		// Read from the change rather than the document, which may have
+		// been paid by a later change that makes its own event
+		paymentStatus, _ := c.UpdateDescription.UpdatedFields["payment_status"].(string)
+		if c.OperationType == "insert" && invoice.Payment_status != nil {
+			paymentStatus = *invoice.Payment_status
+		}
+		paid := paymentStatus == "PAID"
+
+		switch {
+		case created && paid:
+			return []Event{event(InvoiceCreated), event(InvoicePaid)}, nil
+		case created:
+			return []Event{event(InvoiceCreated)}, nil
+		case deleted:
+			return []Event{event(InvoiceDeleted)}, nil
+		case paid:
+			return []Event{event(InvoicePaid)}, nil
+		}
+		return []Event{event(InvoiceUpdated)}, nil
+	}
+	return nil, nil
+}
+
+// position returns the saved resume token, nil when there is none yet and
+// the stream starts from now.
+func (s *Stream) position(ctx context.Context) (bson.Raw, error) {
+	var saved struct {
+		Resume_token bson.Raw `bson:"resume_token"`
+	}
+	err := s.db.Collection(positionCollection).FindOne(ctx, bson.M{"_id": s.name}).Decode(&saved)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return saved.Resume_token, err
+}
+
+func (s *Stream) savePosition(ctx context.Context, token bson.Raw) error {
+	_, err := s.db.Collection(positionCollection).UpdateOne(
+		ctx,
+		bson.M{"_id": s.name},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "resume_token", Value: token},
+			{Key: "updated_at", Value: time.Now()},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *Stream) forgetPosition(ctx context.Context) error {
+	_, err := s.db.Collection(positionCollection).DeleteOne(ctx, bson.M{"_id": s.name})
+	return err
+}
+
+// isNotReplicaSet reports whether MongoDB refused a change stream for running
+// standalone.
+func isNotReplicaSet(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == 40573
+}
+
+// isHistoryLost reports whether the saved position is older than the oplog
+// MongoDB still has.
+func isHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(286)
+}
@@ -3,9 +3,18 @@ module restaurant_app
 go 1.20
 
 require (
+	github.com/coreos/go-oidc/v3 v3.9.0
 	github.com/gin-gonic/gin v1.10.0
 	github.com/go-playground/validator/v10 v10.22.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	go.mongodb.org/mongo-driver v1.16.1
+	golang.org/x/oauth2 v0.13.0
+)
+
+require (
+	github.com/go-jose/go-jose/v3 v3.0.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
 )
 
 require (
@@ -36,7 +45,7 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/arch v0.8.0 // indirect
-	golang.org/x/crypto v0.23.0 // indirect
+	golang.org/x/crypto v0.23.0
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
@@ -0,0 +1,163 @@
+package helpers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// API keys look like "rak_<api_key_id>_<secret>" so they can be told apart
+// from JWTs and looked up without scanning.
+const ApiKeyPrefix = "rak_"
+
+const (
+	apiKeyCacheTTL      = 30 * time.Second
+	apiKeyTouchInterval = time.Minute // how stale last_used_at may get
+)
+
+var scopePattern = regexp.MustCompile(`^(\*|[a-zA-Z]+:(read|write|\*))$`)
+
+var ErrInvalidApiKey = errors.New("invalid api key")
+
+type cachedApiKey struct {
+	apiKey    models.ApiKey
+	fetchedAt time.Time
+}
+
+var apiKeyCache = struct {
+	sync.Mutex
+	keys map[string]cachedApiKey
+}{keys: map[string]cachedApiKey{}}
+
+// GenerateApiKey returns the key to hand to the client once and the hash to
+// store for it.
+func GenerateApiKey(apiKeyId string) (key string, keyHash string, err error) {
+	return generateCredential(ApiKeyPrefix, apiKeyId)
+}
+
+// generateCredential builds a "<prefix><id>_<secret>" credential and the hash
+// of its secret.
+func generateCredential(prefix string, id string) (credential string, secretHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	return prefix + id + "_" + secret, hashApiKeySecret(secret), nil
+}
+
+func IsApiKey(credential string) bool {
+	return strings.HasPrefix(credential, ApiKeyPrefix)
+}
+
+func ValidScope(scope string) bool {
+	return scopePattern.MatchString(scope)
+}
+
+// ValidateApiKey checks the key against its stored hash and revocation, and
+// records when it was last used.
+func ValidateApiKey(key string) (*models.ApiKey, error) {
+	apiKeyId, secret, ok := strings.Cut(strings.TrimPrefix(key, ApiKeyPrefix), "_")
+	if !ok || !IsApiKey(key) {
+		return nil, ErrInvalidApiKey
+	}
+
+	apiKeyCache.Lock()
+	cached, found := apiKeyCache.keys[apiKeyId]
+	apiKeyCache.Unlock()
+
+	if !found || time.Since(cached.fetchedAt) > apiKeyCacheTTL {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var apiKey models.ApiKey
+		err := apiKeyCollection.FindOne(ctx, bson.M{"api_key_id": apiKeyId}, &apiKey)
+		if err == repository.ErrNotFound {
+			return nil, ErrInvalidApiKey
+		}
+		if err != nil {
+			log.Printf("Failed to look up api key: %v", err)
+			return nil, err
+		}
+		cached = cachedApiKey{apiKey: apiKey, fetchedAt: time.Now()}
+
+		apiKeyCache.Lock()
+		apiKeyCache.keys[apiKeyId] = cached
+		apiKeyCache.Unlock()
+	}
+
+	apiKey := cached.apiKey
+	if subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(apiKey.Key_hash)) != 1 {
+		return nil, ErrInvalidApiKey
+	}
+	if apiKey.Revoked_at != nil {
+		return nil, ErrInvalidApiKey
+	}
+
+	if apiKey.Last_used_at == nil || time.Since(*apiKey.Last_used_at) > apiKeyTouchInterval {
+		touchApiKey(apiKeyId)
+	}
+	return &apiKey, nil
+}
+
+// ForgetApiKey drops a key from this process' cache, e.g. after revoking it.
+func ForgetApiKey(apiKeyId string) {
+	apiKeyCache.Lock()
+	delete(apiKeyCache.keys, apiKeyId)
+	apiKeyCache.Unlock()
+}
+
+// ApiKeyHasScope reports whether the scopes grant access to the resource,
+// e.g. "invoice:read" for GET /invoices.
+func ApiKeyHasScope(scopes []string, resource string, access string) bool {
+	for _, scope := range scopes {
+		if scope == "*" || scope == resource+":"+access || scope == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+func touchApiKey(apiKeyId string) {
+	now := time.Now()
+
+	apiKeyCache.Lock()
+	if cached, found := apiKeyCache.keys[apiKeyId]; found {
+		cached.apiKey.Last_used_at = &now
+		apiKeyCache.keys[apiKeyId] = cached
+	}
+	apiKeyCache.Unlock()
+
+	go func() {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := apiKeyCollection.UpdateOne(
+			ctx,
+			bson.M{"api_key_id": apiKeyId},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "last_used_at", Value: now}}}},
+			false,
+		)
+		if err != nil {
+			log.Printf("Failed to record api key use: %v", err)
+		}
+	}()
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"restaurant_app/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApiKeyHasScope(t *testing.T) {
+	tests := []struct {
+		scopes   []string
+		resource string
+		access   string
+		want     bool
+	}{
+		{[]string{"invoice:read"}, "invoice", "read", true},
+		{[]string{"invoice:read"}, "invoice", "write", false},
+		{[]string{"invoice:read"}, "order", "read", false},
+		{[]string{"invoice:*"}, "invoice", "write", true},
+		{[]string{"order:read", "invoice:write"}, "invoice", "write", true},
+		{[]string{"*"}, "menu", "write", true},
+		{nil, "menu", "read", false},
+	}
+	for _, test := range tests {
+		if got := ApiKeyHasScope(test.scopes, test.resource, test.access); got != test.want {
+			t.Errorf("%v grants %s:%s %v, want %v", test.scopes, test.resource, test.access, got, test.want)
+		}
+	}
+
+	for scope, want := range map[string]bool{"invoice:read": true, "orderItem:write": true, "food:*": true, "*": true, "invoice": false, "invoice:delete": false, "invoice:read ": false} {
+		if got := ValidScope(scope); got != want {
+			t.Errorf("scope %q is valid %v, want %v", scope, got, want)
+		}
+	}
+}
+
+func TestValidateApiKey(t *testing.T) {
+	useMemoryStorage(t)
+	apiKeyId := primitive.NewObjectID().Hex()
+	key, keyHash, err := GenerateApiKey(apiKeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsApiKey(key) || !strings.HasPrefix(key, ApiKeyPrefix+apiKeyId+"_") {
+		t.Fatalf("generated key %q does not name its id", key)
+	}
+
+	name, role := "Accounting", models.RoleCashier
+	err = apiKeyCollection.Insert(context.Background(), models.ApiKey{
+		ID:         primitive.NewObjectID(),
+		Name:       &name,
+		Role:       &role,
+		Scopes:     []string{"invoice:read"},
+		Key_hash:   keyHash,
+		Created_at: time.Now(),
+		Updated_at: time.Now(),
+		Api_key_id: apiKeyId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKey, err := ValidateApiKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.Api_key_id != apiKeyId || *apiKey.Role != role {
+		t.Fatalf("validated key %s with role %s", apiKey.Api_key_id, *apiKey.Role)
+	}
+
+	for _, wrong := range []string{key + "x", ApiKeyPrefix + apiKeyId, ApiKeyPrefix + primitive.NewObjectID().Hex() + "_secret"} {
+		if _, err := ValidateApiKey(wrong); err != ErrInvalidApiKey {
+			t.Errorf("key %q gave %v, want ErrInvalidApiKey", wrong, err)
+		}
+	}
+
+	_, err = apiKeyCollection.UpdateOne(context.Background(), bson.M{"api_key_id": apiKeyId}, bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ForgetApiKey(apiKeyId)
+	if _, err := ValidateApiKey(key); err != ErrInvalidApiKey {
+		t.Fatalf("a revoked key gave %v, want ErrInvalidApiKey", err)
+	}
+}
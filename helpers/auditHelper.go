@@ -0,0 +1,102 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AuditRedacted replaces the values of secret fields in audit changes; that
+// they changed is still recorded.
+const AuditRedacted = "[redacted]"
+
+// Fields that never appear in the audit log, and fields not worth a change
+// entry of their own.
+var (
+	auditSecretFields = map[string]bool{
+		"password":         true,
+		"totp_secret":      true,
+		"totp_last_step":   true,
+		"recovery_codes":   true,
+		"pin_hash":         true,
+		"secret_hash":      true,
+		"key_hash":         true,
+		"refresh_token_id": true,
+		"active_token_id":  true,
+	}
+	auditIgnoredFields = map[string]bool{
+		"_id":        true,
+		"updated_at": true,
+	}
+)
+
+// AuditSnapshot loads the entity whose field equals id from the collection
+// of that name, or returns nil when there is none.
+func AuditSnapshot(collections repository.Collections, collection string, field string, id string) bson.M {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var snapshot bson.M
+	err := collections.Collection(collection).FindOne(ctx, bson.M{field: id}, &snapshot)
+	if err != nil {
+		if err != repository.ErrNotFound {
+			log.Printf("Failed to load %s %s for the audit log: %v", collection, id, err)
+		}
+		return nil
+	}
+	return snapshot
+}
+
+// AuditChanges lists the top-level fields that differ between two snapshots
+// of an entity, in field order.
+func AuditChanges(before bson.M, after bson.M) []models.AuditChange {
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+
+	changes := []models.AuditChange{}
+	for field := range fields {
+		if auditIgnoredFields[field] {
+			continue
+		}
+		beforeValue, afterValue := before[field], after[field]
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+		if auditSecretFields[field] {
+			beforeValue, afterValue = redactAuditValue(beforeValue), redactAuditValue(afterValue)
+		}
+		changes = append(changes, models.AuditChange{Field: field, Before: beforeValue, After: afterValue})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func RecordAudit(entry models.AuditEntry) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := auditCollection.Insert(ctx, entry)
+	if err != nil {
+		log.Printf("Failed to record audit entry for %s %s: %v", entry.Method, entry.Path, err)
+		return err
+	}
+	return nil
+}
+
+func redactAuditValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return AuditRedacted
+}
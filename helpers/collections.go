@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"restaurant_app/repository"
+)
+
+var (
+	apiKeyCollection       repository.Collection
+	auditCollection        repository.Collection
+	deviceCollection       repository.Collection
+	loginAttemptCollection repository.Collection
+	mfaChallengeCollection repository.Collection
+	oidcLoginCollection    repository.Collection
+	restaurantCollection   repository.Collection
+	revocationCollection   repository.Collection
+	sessionCollection      repository.Collection
+	signingKeyCollection   repository.Collection
+)
+
+// UseStorage points the helpers at the collections of the configured
+// storage. The app calls it once storage is open, before any route is served
+// or keys are rotated.
+func UseStorage(collections repository.Collections) {
+	apiKeyCollection = collections.Collection("apiKey")
+	auditCollection = collections.Collection("audit")
+	deviceCollection = collections.Collection("device")
+	loginAttemptCollection = collections.Collection("loginAttempt")
+	mfaChallengeCollection = collections.Collection("mfaChallenge")
+	oidcLoginCollection = collections.Collection("oidcLogin")
+	restaurantCollection = collections.Collection("restaurant")
+	revocationCollection = collections.Collection("revocation")
+	sessionCollection = collections.Collection("session")
+	signingKeyCollection = collections.Collection("signingKey")
+}
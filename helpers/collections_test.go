@@ -0,0 +1,22 @@
+package helpers
+
+import (
+	"encoding/base64"
+	"restaurant_app/repository"
+	"testing"
+	"time"
+)
+
+// useMemoryStorage points the helpers at empty in-memory collections and
+// sets a key-encryption key, so tokens can be signed without a database.
+func useMemoryStorage(t *testing.T) {
+	t.Helper()
+	t.Setenv(KeyEncryptionKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	UseStorage(repository.NewMemory().Collections)
+
+	// Keys signed by earlier storage are unknown to this one
+	keyRing.Lock()
+	keyRing.keys = nil
+	keyRing.loadedAt = time.Time{}
+	keyRing.Unlock()
+}
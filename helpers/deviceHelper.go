@@ -0,0 +1,188 @@
+package helpers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Device credentials look like "rdk_<device_id>_<secret>".
+const DeviceCredentialPrefix = "rdk_"
+
+// Longest a PIN login lasts, and how long a terminal may sit unused before
+// the next request is refused and staff must enter their PIN again.
+var TERMINAL_SESSION_TTL time.Duration = durationOrDefault("TERMINAL_SESSION_TTL", 15*time.Minute)
+var TERMINAL_IDLE_TIMEOUT time.Duration = durationOrDefault("TERMINAL_IDLE_TIMEOUT", 2*time.Minute)
+
+const (
+	deviceCacheTTL      = 5 * time.Second
+	deviceTouchInterval = 15 * time.Second
+)
+
+var (
+	ErrInvalidDevice  = errors.New("invalid device")
+	ErrTerminalLocked = errors.New("terminal is locked")
+)
+
+type cachedDevice struct {
+	device    models.Device
+	fetchedAt time.Time
+}
+
+var deviceCache = struct {
+	sync.Mutex
+	devices map[string]cachedDevice
+}{devices: map[string]cachedDevice{}}
+
+func GenerateDeviceCredential(deviceId string) (credential string, secretHash string, err error) {
+	return generateCredential(DeviceCredentialPrefix, deviceId)
+}
+
+// ValidateDeviceCredential returns the device a credential belongs to, unless
+// it is wrong or the device was revoked.
+func ValidateDeviceCredential(credential string) (*models.Device, error) {
+	deviceId, secret, ok := strings.Cut(strings.TrimPrefix(credential, DeviceCredentialPrefix), "_")
+	if !ok || !strings.HasPrefix(credential, DeviceCredentialPrefix) {
+		return nil, ErrInvalidDevice
+	}
+	device, err := GetDevice(deviceId, 0)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(device.Secret_hash)) != 1 {
+		return nil, ErrInvalidDevice
+	}
+	return device, nil
+}
+
+// GetDevice loads a device that has not been revoked, from the cache when the
+// entry is younger than maxAge.
+func GetDevice(deviceId string, maxAge time.Duration) (*models.Device, error) {
+	deviceCache.Lock()
+	cached, found := deviceCache.devices[deviceId]
+	deviceCache.Unlock()
+
+	if !found || time.Since(cached.fetchedAt) > maxAge {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var device models.Device
+		err := deviceCollection.FindOne(ctx, bson.M{"device_id": deviceId}, &device)
+		if err == repository.ErrNotFound {
+			return nil, ErrInvalidDevice
+		}
+		if err != nil {
+			log.Printf("Failed to look up device: %v", err)
+			return nil, err
+		}
+		cached = cachedDevice{device: device, fetchedAt: time.Now()}
+
+		deviceCache.Lock()
+		deviceCache.devices[deviceId] = cached
+		deviceCache.Unlock()
+	}
+
+	if cached.device.Revoked_at != nil {
+		return nil, ErrInvalidDevice
+	}
+	device := cached.device
+	return &device, nil
+}
+
+// StartTerminalSession makes the token the only one accepted on the device,
+// which locks out whoever was logged in there before.
+func StartTerminalSession(deviceId string, userId string, tokenId string) error {
+	return setTerminalSession(deviceId, &userId, &tokenId)
+}
+
+// LockDevice ends the active session on the device.
+func LockDevice(deviceId string) error {
+	return setTerminalSession(deviceId, nil, nil)
+}
+
+// TouchTerminalSession checks that a device-bound token is still the active
+// session on a usable device and has not sat idle, then records the activity.
+func TouchTerminalSession(claims *SignedDetails) error {
+	device, err := GetDevice(claims.DeviceId, deviceCacheTTL)
+	if err != nil {
+		return err
+	}
+	if device.Active_token_id == nil || *device.Active_token_id != claims.Id {
+		return ErrTerminalLocked
+	}
+
+	now := time.Now()
+	if device.Last_activity_at == nil || now.Sub(*device.Last_activity_at) > TERMINAL_IDLE_TIMEOUT {
+		LockDevice(claims.DeviceId)
+		return ErrTerminalLocked
+	}
+	if now.Sub(*device.Last_activity_at) < deviceTouchInterval {
+		return nil
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = deviceCollection.UpdateOne(
+		ctx,
+		bson.M{"device_id": claims.DeviceId, "active_token_id": claims.Id},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_activity_at", Value: now}}}},
+		false,
+	)
+	if err != nil {
+		log.Printf("Failed to record terminal activity: %v", err)
+		return err
+	}
+
+	deviceCache.Lock()
+	if cached, found := deviceCache.devices[claims.DeviceId]; found {
+		cached.device.Last_activity_at = &now
+		deviceCache.devices[claims.DeviceId] = cached
+	}
+	deviceCache.Unlock()
+	return nil
+}
+
+// ForgetDevice drops a device from this process' cache, e.g. after revoking it.
+func ForgetDevice(deviceId string) {
+	deviceCache.Lock()
+	delete(deviceCache.devices, deviceId)
+	deviceCache.Unlock()
+}
+
+func setTerminalSession(deviceId string, userId *string, tokenId *string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var lastActivity *time.Time
+	if tokenId != nil {
+		lastActivity = &now
+	}
+
+	_, err := deviceCollection.UpdateOne(
+		ctx,
+		bson.M{"device_id": deviceId},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "active_user_id", Value: userId},
+			{Key: "active_token_id", Value: tokenId},
+			{Key: "last_activity_at", Value: lastActivity},
+			{Key: "updated_at", Value: now},
+		}}},
+		false,
+	)
+	if err != nil {
+		log.Printf("Failed to update terminal session: %v", err)
+		return err
+	}
+	ForgetDevice(deviceId)
+	return nil
+}
@@ -0,0 +1,47 @@
+package helpers
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements Ed25519 signatures for jwt-go, which only
+// ships RSA, ECDSA and HMAC methods.
+type SigningMethodEdDSA struct{}
+
+var SigningMethodEd25519 = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEd25519
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("EdDSA signature is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidIfMatch = errors.New("If-Match must hold one entity tag, as sent in an ETag header, or *")
+
+// ErrWeakIfMatch is returned for a weak entity tag, which If-Match never
+// matches as it compares strongly.
+var ErrWeakIfMatch = errors.New("weak entity tags never match")
+
+// ETag formats an entity's version as a strong entity tag.
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ParseIfMatch reads the version an If-Match header asks for. anyVersion is
+// true for "*", which matches whatever version the entity is at.
+func ParseIfMatch(header string) (version int64, anyVersion bool, err error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return 0, true, nil
+	}
+	if strings.HasPrefix(header, "W/") {
+		return 0, false, ErrWeakIfMatch
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false, ErrInvalidIfMatch
+	}
+	version, err = strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 0 {
+		return 0, false, ErrInvalidIfMatch
+	}
+	return version, false, nil
+}
@@ -0,0 +1,222 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"math"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type throttlePolicy struct {
+	freeAttempts int           // failures allowed before any delay
+	baseDelay    time.Duration // delay after the first counted failure, doubled each time
+	maxDelay     time.Duration
+	lockAfter    int // failures that lock the key outright
+	lockFor      time.Duration
+}
+
+var (
+	accountThrottle = throttlePolicy{freeAttempts: 3, baseDelay: time.Second, maxDelay: 5 * time.Minute, lockAfter: 10, lockFor: 30 * time.Minute}
+	// Tablets in one restaurant share an address, so clients get more room
+	clientThrottle = throttlePolicy{freeAttempts: 20, baseDelay: time.Second, maxDelay: 5 * time.Minute, lockAfter: 100, lockFor: 30 * time.Minute}
+	// A four digit PIN is guessed quickly, so it locks early
+	pinThrottle = throttlePolicy{freeAttempts: 2, baseDelay: 2 * time.Second, maxDelay: time.Minute, lockAfter: 5, lockFor: 15 * time.Minute}
+	// One terminal trying the PINs of everyone in the restaurant
+	pinDeviceThrottle = throttlePolicy{freeAttempts: 5, baseDelay: 2 * time.Second, maxDelay: 5 * time.Minute, lockAfter: 20, lockFor: time.Hour}
+	// Every reset request sends an email, so they count whether or not they
+	// succeed, and a flood of them is slowed down by the minute
+	resetThrottle       = throttlePolicy{freeAttempts: 3, baseDelay: time.Minute, maxDelay: time.Hour, lockAfter: 10, lockFor: time.Hour}
+	resetClientThrottle = throttlePolicy{freeAttempts: 20, baseDelay: time.Minute, maxDelay: time.Hour, lockAfter: 100, lockFor: time.Hour}
+)
+
+// Failures older than this no longer count.
+const failureWindow = time.Hour
+
+func AccountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ClientThrottleKey(ip string) string {
+	return "client:" + ip
+}
+
+func PinThrottleKey(userId string) string {
+	return "pin:" + userId
+}
+
+func PinDeviceThrottleKey(deviceId string) string {
+	return "pin-device:" + deviceId
+}
+
+func ResetThrottleKey(email string) string {
+	return "reset:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ResetClientThrottleKey(ip string) string {
+	return "reset-client:" + ip
+}
+
+func policyFor(key string) throttlePolicy {
+	if strings.HasPrefix(key, "reset:") {
+		return resetThrottle
+	}
+	if strings.HasPrefix(key, "reset-client:") {
+		return resetClientThrottle
+	}
+	if strings.HasPrefix(key, "client:") {
+		return clientThrottle
+	}
+	if strings.HasPrefix(key, "pin:") {
+		return pinThrottle
+	}
+	if strings.HasPrefix(key, "pin-device:") {
+		return pinDeviceThrottle
+	}
+	return accountThrottle
+}
+
+// LoginRetryAfter returns how long the caller must wait before another login
+// attempt is accepted for any of the keys. Zero means go ahead.
+func LoginRetryAfter(keys ...string) (time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var wait time.Duration
+
+	for _, key := range keys {
+		var attempt models.LoginAttempt
+		err := loginAttemptCollection.FindOne(ctx, bson.M{"key": key}, &attempt)
+		if err == repository.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read login attempts: %v", err)
+			return 0, err
+		}
+
+		if attempt.Locked_until != nil && attempt.Locked_until.After(now) {
+			wait = maxDuration(wait, attempt.Locked_until.Sub(now))
+			continue
+		}
+		if now.Sub(attempt.Last_failure) > failureWindow {
+			continue
+		}
+
+		policy := policyFor(key)
+		if attempt.Failures <= policy.freeAttempts {
+			continue
+		}
+		exponent := float64(attempt.Failures - policy.freeAttempts - 1)
+		delay := time.Duration(float64(policy.baseDelay) * math.Pow(2, exponent))
+		if delay > policy.maxDelay || delay <= 0 {
+			delay = policy.maxDelay
+		}
+		if next := attempt.Last_failure.Add(delay); next.After(now) {
+			wait = maxDuration(wait, next.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed attempt against every key and locks the
+// ones that crossed their limit.
+func RecordLoginFailure(keys ...string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	for _, key := range keys {
+		// Start over when the previous failures are outside the window
+		_, err := loginAttemptCollection.UpdateOne(
+			ctx,
+			bson.M{"key": key, "last_failure": bson.M{"$lt": now.Add(-failureWindow)}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "failures", Value: 0}, {Key: "locked_until", Value: nil}}}},
+			false,
+		)
+		if err != nil {
+			log.Printf("Failed to reset login attempts: %v", err)
+			return err
+		}
+
+		var attempt models.LoginAttempt
+		err = loginAttemptCollection.FindOneAndUpdate(
+			ctx,
+			bson.M{"key": key},
+			bson.D{
+				{Key: "$inc", Value: bson.D{{Key: "failures", Value: 1}}},
+				{Key: "$set", Value: bson.D{{Key: "last_failure", Value: now}}},
+				{Key: "$setOnInsert", Value: bson.D{{Key: "_id", Value: primitive.NewObjectID()}}},
+			},
+			true,
+			&attempt,
+		)
+		if err != nil {
+			log.Printf("Failed to record login attempt: %v", err)
+			return err
+		}
+
+		policy := policyFor(key)
+		if attempt.Failures >= policy.lockAfter {
+			lockedUntil := now.Add(policy.lockFor)
+			_, err = loginAttemptCollection.UpdateOne(
+				ctx,
+				bson.M{"key": key},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "locked_until", Value: lockedUntil}}}},
+				false,
+			)
+			if err != nil {
+				log.Printf("Failed to lock login key: %v", err)
+				return err
+			}
+			log.Printf("Login locked for %s until %s after %d failures", key, lockedUntil.Format(time.RFC3339), attempt.Failures)
+		}
+	}
+	return nil
+}
+
+// LoginLocked reports whether key is locked outright, rather than only slowed
+// down.
+func LoginLocked(key string) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var attempt models.LoginAttempt
+	err := loginAttemptCollection.FindOne(ctx, bson.M{"key": key}, &attempt)
+	if err == repository.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read login attempts: %v", err)
+		return false, err
+	}
+	return attempt.Locked_until != nil && attempt.Locked_until.After(time.Now()), nil
+}
+
+// ResetLoginFailures clears the counter for a key, after a successful login
+// or when an admin unlocks an account.
+func ResetLoginFailures(key string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := loginAttemptCollection.DeleteOne(ctx, bson.M{"key": key})
+	if err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+		return err
+	}
+	return nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
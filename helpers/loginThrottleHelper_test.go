@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleLocksAndUnlocks(t *testing.T) {
+	useMemoryStorage(t)
+	key := AccountThrottleKey("Locked@Example.com ")
+
+	for i := 0; i < accountThrottle.freeAttempts; i++ {
+		if err := RecordLoginFailure(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, err := LoginRetryAfter(key); err != nil || wait != 0 {
+		t.Fatalf("after the free attempts the wait is %v (%v), want none", wait, err)
+	}
+
+	if err := RecordLoginFailure(key); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := LoginRetryAfter(key); err != nil || wait <= 0 || wait > accountThrottle.baseDelay {
+		t.Fatalf("after one more failure the wait is %v (%v), want up to %v", wait, err, accountThrottle.baseDelay)
+	}
+
+	for i := accountThrottle.freeAttempts + 1; i < accountThrottle.lockAfter; i++ {
+		if err := RecordLoginFailure(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if locked, err := LoginLocked(key); err != nil || !locked {
+		t.Fatalf("after %d failures the key is not locked (%v)", accountThrottle.lockAfter, err)
+	}
+	wait, err := LoginRetryAfter(key, ClientThrottleKey("192.0.2.1"))
+	if err != nil || wait < accountThrottle.lockFor-time.Minute {
+		t.Fatalf("while locked the wait is %v (%v), want about %v", wait, err, accountThrottle.lockFor)
+	}
+
+	// The same address is unaffected under another account
+	if wait, err := LoginRetryAfter(AccountThrottleKey("other@example.com")); err != nil || wait != 0 {
+		t.Fatalf("another account has to wait %v (%v)", wait, err)
+	}
+
+	if err := ResetLoginFailures(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := LoginLocked(key); err != nil || locked {
+		t.Fatalf("the key is still locked after a reset (%v)", err)
+	}
+	if wait, err := LoginRetryAfter(key); err != nil || wait != 0 {
+		t.Fatalf("after a reset the wait is %v (%v), want none", wait, err)
+	}
+}
+
+func TestPinThrottleLocksEarly(t *testing.T) {
+	useMemoryStorage(t)
+	key := PinThrottleKey("user-1")
+	deviceKey := PinDeviceThrottleKey("device-1")
+
+	for i := 0; i < pinThrottle.lockAfter; i++ {
+		if err := RecordLoginFailure(key, deviceKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if locked, err := LoginLocked(key); err != nil || !locked {
+		t.Fatalf("the PIN is not locked after %d failures (%v)", pinThrottle.lockAfter, err)
+	}
+	if locked, err := LoginLocked(deviceKey); err != nil || locked {
+		t.Fatalf("the device is locked after %d failures, want %d (%v)", pinThrottle.lockAfter, pinDeviceThrottle.lockAfter, err)
+	}
+}
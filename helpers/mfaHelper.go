@@ -0,0 +1,67 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidMfaToken = errors.New("mfa token is invalid or was used already")
+
+// recordMfaChallenge remembers an mfa token until it is used or expires.
+func recordMfaChallenge(claims *SignedDetails) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var challenge models.MfaChallenge
+	challenge.ID = primitive.NewObjectID()
+	challenge.Token_id = claims.Id
+	challenge.User_id = claims.Uid
+	challenge.Created_at = time.Now()
+	challenge.Expires_at = time.Unix(claims.ExpiresAt, 0)
+
+	if err := mfaChallengeCollection.Insert(ctx, challenge); err != nil {
+		log.Printf("Failed to record mfa challenge: %v", err)
+		return err
+	}
+	return nil
+}
+
+// CheckMfaToken returns the claims of an mfa token that has not been used
+// yet. The token stays usable until ConsumeMfaToken.
+func CheckMfaToken(ctx context.Context, mfaToken string) (*SignedDetails, error) {
+	claims, msg := ValidateToken(mfaToken)
+	if msg != "" || claims.TokenType != MfaTokenType {
+		return nil, ErrInvalidMfaToken
+	}
+	count, err := mfaChallengeCollection.Count(ctx, bson.M{"token_id": claims.Id, "user_id": claims.Uid})
+	if err != nil {
+		log.Printf("Failed to look up mfa challenge: %v", err)
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrInvalidMfaToken
+	}
+	return claims, nil
+}
+
+// ConsumeMfaToken uses up the mfa token once its second factor was valid.
+// Of two logins racing with the same token, only one gets a nil error.
+func ConsumeMfaToken(ctx context.Context, claims *SignedDetails) error {
+	var challenge models.MfaChallenge
+	err := mfaChallengeCollection.FindOneAndDelete(ctx, bson.M{"token_id": claims.Id, "user_id": claims.Uid}, &challenge)
+	if err == repository.ErrNotFound {
+		return ErrInvalidMfaToken
+	}
+	if err != nil {
+		log.Printf("Failed to consume mfa challenge: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users, e.g. password reset codes. Swap
+// UserNotifier for an email or SMS implementation in production.
+type Notifier interface {
+	Notify(to string, subject string, body string) error
+}
+
+// FileNotifier appends messages to a file, or prints them to stdout when
+// Path is empty. It is meant for local development.
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+var UserNotifier Notifier = &FileNotifier{Path: os.Getenv("NOTIFIER_FILE")}
+
+func (n *FileNotifier) Notify(to string, subject string, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	message := fmt.Sprintf("[%s] to=%s subject=%q\n%s\n\n", time.Now().Format(time.RFC3339), to, subject, body)
+
+	if n.Path == "" {
+		_, err := fmt.Print(message)
+		return err
+	}
+
+	file, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(message)
+	return err
+}
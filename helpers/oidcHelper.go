@@ -0,0 +1,268 @@
+package helpers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+// OIDC login is on when OIDC_ISSUER is set. To try it locally, run
+// "go run ./cmd/mockoidc" and point OIDC_ISSUER at it.
+var (
+	OIDC_ISSUER           = envOrDefault("OIDC_ISSUER", "")
+	OIDC_CLIENT_ID        = envOrDefault("OIDC_CLIENT_ID", "")
+	OIDC_CLIENT_SECRET    = envOrDefault("OIDC_CLIENT_SECRET", "")
+	OIDC_REDIRECT_URL     = envOrDefault("OIDC_REDIRECT_URL", "http://localhost:8000/users/oidc/callback")
+	OIDC_SCOPES           = envOrDefault("OIDC_SCOPES", "openid,email,profile,groups")
+	OIDC_GROUPS_CLAIM     = envOrDefault("OIDC_GROUPS_CLAIM", "groups")
+	OIDC_RESTAURANT_CLAIM = envOrDefault("OIDC_RESTAURANT_CLAIM", "restaurant_id")
+	// Comma separated "<group>=<role>" pairs, e.g. "pos-admins=ADMIN,pos-floor=WAITER"
+	OIDC_ROLE_MAPPING = envOrDefault("OIDC_ROLE_MAPPING", "")
+	// Role for users in none of the mapped groups; empty refuses them
+	OIDC_DEFAULT_ROLE = envOrDefault("OIDC_DEFAULT_ROLE", "")
+)
+
+// How long a login started with StartOidcLogin can be finished
+const OidcLoginTTL = 10 * time.Minute
+
+var (
+	ErrOidcDisabled     = errors.New("oidc login is not configured")
+	ErrInvalidOidcLogin = errors.New("invalid or expired oidc login")
+	ErrOidcNoRole       = errors.New("no role is mapped to the user's groups")
+)
+
+// Roles from most to least privileged, for users in several mapped groups.
+var rolePrecedence = []string{models.RoleAdmin, models.RoleManager, models.RoleCashier, models.RoleWaiter, models.RoleKitchen}
+
+// OidcIdentity is what the identity provider says about a user.
+type OidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	Role          string
+	RestaurantId  string
+	// Whether the provider says the user passed a second factor, with "mfa"
+	// in the ID token's amr claim (RFC 8176)
+	Mfa bool
+}
+
+var oidcClient = struct {
+	sync.Mutex
+	provider *oidc.Provider
+}{}
+
+func OidcEnabled() bool {
+	return OIDC_ISSUER != ""
+}
+
+// StartOidcLogin records a new login and returns the provider URL to send
+// the user to, and the login's state. State, nonce and PKCE verifier are
+// checked on the callback; the caller ties the state to the browser.
+func StartOidcLogin() (authorizationUrl string, state string, err error) {
+	config, _, err := oidcConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var login models.OidcLogin
+	login.ID = primitive.NewObjectID()
+	login.Oidc_login_id = login.ID.Hex()
+	login.State_hash = HashResetCode(state)
+	login.Nonce = nonce
+	login.Code_verifier = verifier
+	login.Created_at = time.Now()
+	login.Expires_at = login.Created_at.Add(OidcLoginTTL)
+
+	if err := oidcLoginCollection.Insert(ctx, login); err != nil {
+		log.Printf("Failed to record oidc login: %v", err)
+		return "", "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), state, nil
+}
+
+// FinishOidcLogin completes the login the state belongs to: it exchanges the
+// code, verifies the ID token and maps its claims to an identity.
+func FinishOidcLogin(ctx context.Context, state string, code string) (*OidcIdentity, error) {
+	config, verifier, err := oidcConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var login models.OidcLogin
+	err = oidcLoginCollection.FindOneAndDelete(ctx, bson.M{"state_hash": HashResetCode(state)}, &login)
+	if err == repository.ErrNotFound || (err == nil && time.Now().After(login.Expires_at)) {
+		return nil, ErrInvalidOidcLogin
+	}
+	if err != nil {
+		log.Printf("Failed to look up oidc login: %v", err)
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(login.Code_verifier))
+	if err != nil {
+		log.Printf("Failed to exchange the oidc code: %v", err)
+		return nil, ErrInvalidOidcLogin
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("Identity provider returned no id_token")
+		return nil, ErrInvalidOidcLogin
+	}
+	idToken, err := verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		log.Printf("Failed to verify the id token: %v", err)
+		return nil, ErrInvalidOidcLogin
+	}
+	if idToken.Nonce != login.Nonce {
+		return nil, ErrInvalidOidcLogin
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, ErrInvalidOidcLogin
+	}
+
+	identity := &OidcIdentity{
+		Subject:       idToken.Subject,
+		Email:         stringClaim(claims, "email"),
+		EmailVerified: claims["email_verified"] == true,
+		FirstName:     stringClaim(claims, "given_name"),
+		LastName:      stringClaim(claims, "family_name"),
+		RestaurantId:  stringClaim(claims, OIDC_RESTAURANT_CLAIM),
+		Mfa:           hasAmr(claims, "mfa"),
+	}
+	if identity.FirstName == "" && identity.LastName == "" {
+		identity.FirstName, identity.LastName, _ = strings.Cut(stringClaim(claims, "name"), " ")
+	}
+	identity.Role = OidcRole(groupsClaim(claims))
+	if identity.Role == "" {
+		return nil, ErrOidcNoRole
+	}
+	return identity, nil
+}
+
+// OidcRole maps identity provider groups to the most privileged role any of
+// them is mapped to, or OIDC_DEFAULT_ROLE.
+func OidcRole(groups []string) string {
+	mapped := map[string]bool{}
+	for _, pair := range strings.Split(OIDC_ROLE_MAPPING, ",") {
+		group, role, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		for _, member := range groups {
+			if member == group {
+				mapped[strings.ToUpper(role)] = true
+			}
+		}
+	}
+	for _, role := range rolePrecedence {
+		if mapped[role] {
+			return role
+		}
+	}
+	return OIDC_DEFAULT_ROLE
+}
+
+// oidcConfig discovers the provider on first use and builds the OAuth2
+// client and ID token verifier from it. Failed discovery is retried on the
+// next login.
+func oidcConfig() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	if !OidcEnabled() {
+		return nil, nil, ErrOidcDisabled
+	}
+
+	oidcClient.Lock()
+	defer oidcClient.Unlock()
+
+	if oidcClient.provider == nil {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		provider, err := oidc.NewProvider(ctx, OIDC_ISSUER)
+		if err != nil {
+			log.Printf("Failed to discover the oidc provider: %v", err)
+			return nil, nil, err
+		}
+		oidcClient.provider = provider
+	}
+
+	config := &oauth2.Config{
+		ClientID:     OIDC_CLIENT_ID,
+		ClientSecret: OIDC_CLIENT_SECRET,
+		RedirectURL:  OIDC_REDIRECT_URL,
+		Endpoint:     oidcClient.provider.Endpoint(),
+		Scopes:       strings.Split(OIDC_SCOPES, ","),
+	}
+	verifier := oidcClient.provider.Verifier(&oidc.Config{ClientID: OIDC_CLIENT_ID})
+	return config, verifier, nil
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// hasAmr reports whether the amr claim lists method.
+func hasAmr(claims map[string]interface{}, method string) bool {
+	methods, _ := claims["amr"].([]interface{})
+	for _, value := range methods {
+		if value == method {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsClaim accepts the groups as a list or as one comma separated string.
+func groupsClaim(claims map[string]interface{}) []string {
+	groups := []string{}
+	switch value := claims[OIDC_GROUPS_CLAIM].(type) {
+	case []interface{}:
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	case string:
+		for _, name := range strings.Split(value, ",") {
+			groups = append(groups, strings.TrimSpace(name))
+		}
+	}
+	return groups
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
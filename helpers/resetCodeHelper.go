@@ -0,0 +1,35 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+const resetCodeDigits = 8
+
+// GenerateResetCode returns a random numeric code and the hash to store for
+// it. Only the hash is ever persisted.
+func GenerateResetCode() (code string, codeHash string, err error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(resetCodeDigits), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", "", err
+	}
+	code = fmt.Sprintf("%0*d", resetCodeDigits, n)
+	return code, HashResetCode(code), nil
+}
+
+func HashResetCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ResetCodeMatches compares a submitted code against a stored hash in
+// constant time.
+func ResetCodeMatches(code string, codeHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashResetCode(code)), []byte(codeHash)) == 1
+}
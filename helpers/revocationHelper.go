@@ -0,0 +1,157 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long a lookup is trusted before storage is asked again. Revocations made
+// by this process are visible at once; ones made by other instances within
+// this window.
+const revocationCacheTTL = 30 * time.Second
+
+type revocationEntry struct {
+	revoked   bool
+	revokedAt time.Time
+	fetchedAt time.Time
+}
+
+var revocationCache = struct {
+	sync.Mutex
+	tokens map[string]revocationEntry
+	users  map[string]revocationEntry
+}{
+	tokens: map[string]revocationEntry{},
+	users:  map[string]revocationEntry{},
+}
+
+// RevokeToken blocks a single token until it expires, e.g. on logout.
+func RevokeToken(claims *SignedDetails) error{
+	if claims.Id == "" {
+		// Tokens issued before revocation existed carry no id and simply expire
+		return nil
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	var revocation models.Revocation
+
+	revocation.ID = primitive.NewObjectID()
+	revocation.Token_id = claims.Id
+	revocation.User_id = claims.Uid
+	revocation.Revoked_at = time.Now()
+	revocation.Expires_at = time.Unix(claims.ExpiresAt, 0)
+
+	err := revocationCollection.Insert(ctx, revocation)
+	if err != nil {
+		log.Printf("Failed to revoke token: %v", err)
+		return err
+	}
+
+	revocationCache.Lock()
+	revocationCache.tokens[claims.Id] = revocationEntry{revoked: true, fetchedAt: time.Now()}
+	revocationCache.Unlock()
+	return nil
+}
+
+// RevokeUserTokens blocks every token issued to the user up to now and ends
+// all of the user's sessions.
+func RevokeUserTokens(userId string) error{
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	// Tokens carry their issue time in whole seconds, so the revocation
+	// covers everything issued up to the end of this second, including
+	// tokens issued later within it
+	revokedAt := time.Now().Truncate(time.Second)
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "revoked_at", Value: revokedAt})
+	// The entry is deleted at expires_at, once every access token it
+	// covers has expired: 15 minutes, or longer on terminals
+	updateObj = append(updateObj, bson.E{Key: "expires_at", Value: revokedAt.Add(maxDuration(15*time.Minute, TERMINAL_SESSION_TTL))})
+
+	filter := bson.M{"user_id": userId, "token_id": ""}
+
+	_, err := revocationCollection.UpdateOne(
+		ctx,
+		filter,
+		bson.D{
+			{Key: "$set", Value: updateObj},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "_id", Value: primitive.NewObjectID()}}},
+		},
+		true,
+	)
+	if err != nil {
+		log.Printf("Failed to revoke user tokens: %v", err)
+		return err
+	}
+
+	revocationCache.Lock()
+	revocationCache.users[userId] = revocationEntry{revoked: true, revokedAt: revokedAt, fetchedAt: time.Now()}
+	revocationCache.Unlock()
+
+	return RevokeAllSessions(userId)
+}
+
+// IsRevoked reports whether the token was revoked on its own or by a
+// revoke-all for its user.
+func IsRevoked(claims *SignedDetails) (bool, error){
+	now := time.Now()
+
+	revocationCache.Lock()
+	tokenEntry, tokenCached := revocationCache.tokens[claims.Id]
+	userEntry, userCached := revocationCache.users[claims.Uid]
+	revocationCache.Unlock()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if claims.Id != "" && (!tokenCached || (!tokenEntry.revoked && now.Sub(tokenEntry.fetchedAt) > revocationCacheTTL)) {
+		count, err := revocationCollection.Count(ctx, bson.M{"token_id": claims.Id})
+		if err != nil {
+			log.Printf("Failed to check token revocation: %v", err)
+			return false, err
+		}
+		tokenEntry = revocationEntry{revoked: count > 0, fetchedAt: now}
+		cacheRevocation(revocationCache.tokens, claims.Id, tokenEntry)
+	}
+	if tokenEntry.revoked {
+		return true, nil
+	}
+
+	if !userCached || now.Sub(userEntry.fetchedAt) > revocationCacheTTL {
+		var revocation models.Revocation
+		err := revocationCollection.FindOne(ctx, bson.M{"user_id": claims.Uid, "token_id": ""}, &revocation)
+		if err != nil && err != repository.ErrNotFound {
+			log.Printf("Failed to check user revocation: %v", err)
+			return false, err
+		}
+		userEntry = revocationEntry{revoked: err == nil, revokedAt: revocation.Revoked_at, fetchedAt: now}
+		cacheRevocation(revocationCache.users, claims.Uid, userEntry)
+	}
+	return userEntry.revoked && claims.IssuedAt <= userEntry.revokedAt.Unix(), nil
+}
+
+func cacheRevocation(entries map[string]revocationEntry, key string, entry revocationEntry){
+	revocationCache.Lock()
+	defer revocationCache.Unlock()
+
+	// Keep the cache bounded; stale entries would be refetched anyway
+	if len(entries) > 10000 {
+		for k, e := range entries {
+			if time.Since(e.fetchedAt) > revocationCacheTTL {
+				delete(entries, k)
+			}
+		}
+	}
+	entries[key] = entry
+}
@@ -0,0 +1,77 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRevokeUserTokens(t *testing.T) {
+	useMemoryStorage(t)
+	userId := primitive.NewObjectID().Hex()
+
+	issued := func(at time.Time) *SignedDetails {
+		claims := &SignedDetails{Uid: userId}
+		claims.Id = primitive.NewObjectID().Hex()
+		claims.IssuedAt = at.Unix()
+		return claims
+	}
+	before := issued(time.Now().Add(-time.Minute))
+	sameSecond := issued(time.Now())
+
+	if err := RevokeUserTokens(userId); err != nil {
+		t.Fatal(err)
+	}
+	after := issued(time.Now().Truncate(time.Second).Add(time.Second))
+
+	check := func() {
+		t.Helper()
+		for name, want := range map[*SignedDetails]bool{before: true, sameSecond: true, after: false} {
+			revoked, err := IsRevoked(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != want {
+				t.Errorf("token issued at %d revoked %v, want %v", name.IssuedAt, revoked, want)
+			}
+		}
+	}
+	check()
+
+	// Other instances only see what is stored
+	revocationCache.Lock()
+	delete(revocationCache.users, userId)
+	revocationCache.Unlock()
+	check()
+
+	other := issued(time.Now().Add(-time.Minute))
+	other.Uid = primitive.NewObjectID().Hex()
+	if revoked, err := IsRevoked(other); err != nil || revoked {
+		t.Fatalf("another user's token is revoked %v (%v)", revoked, err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	useMemoryStorage(t)
+	claims := &SignedDetails{Uid: primitive.NewObjectID().Hex()}
+	claims.Id = primitive.NewObjectID().Hex()
+	claims.IssuedAt = time.Now().Unix()
+	claims.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	if err := RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	revocationCache.Lock()
+	delete(revocationCache.tokens, claims.Id)
+	revocationCache.Unlock()
+
+	if revoked, err := IsRevoked(claims); err != nil || !revoked {
+		t.Fatalf("the token is revoked %v (%v), want true", revoked, err)
+	}
+	sibling := *claims
+	sibling.Id = primitive.NewObjectID().Hex()
+	if revoked, err := IsRevoked(&sibling); err != nil || revoked {
+		t.Fatalf("another token of the user is revoked %v (%v)", revoked, err)
+	}
+}
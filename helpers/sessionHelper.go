@@ -0,0 +1,227 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	sessionCacheTTL      = 30 * time.Second
+	sessionTouchInterval = time.Minute // how stale last_seen_at may get
+)
+
+var ErrSessionRevoked = errors.New("session revoked")
+
+type cachedSession struct {
+	session   models.Session
+	fetchedAt time.Time
+}
+
+var sessionCache = struct {
+	sync.Mutex
+	sessions map[string]cachedSession
+}{sessions: map[string]cachedSession{}}
+
+// CreateSession records the login a new token pair was issued for. The
+// session id is the pair's token family.
+func CreateSession(user models.User, signedRefreshToken string, deviceName string, ipAddress string, userAgent string) (*models.Session, error) {
+	claims, msg := ValidateToken(signedRefreshToken)
+	if msg != "" {
+		return nil, errors.New(msg)
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	session := models.Session{
+		ID:               primitive.NewObjectID(),
+		User_id:          user.User_id,
+		Restaurant_id:    user.Restaurant_id,
+		Device_name:      deviceName,
+		Ip_address:       ipAddress,
+		User_agent:       userAgent,
+		Refresh_token_id: claims.Id,
+		Created_at:       now,
+		Last_seen_at:     now,
+		Expires_at:       time.Unix(claims.ExpiresAt, 0),
+		Session_id:       claims.Family,
+	}
+
+	err := sessionCollection.Insert(ctx, session)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetSession loads a session that has not been revoked.
+func GetSession(sessionId string) (*models.Session, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var session models.Session
+	err := sessionCollection.FindOne(ctx, bson.M{"session_id": sessionId}, &session)
+	if err == repository.ErrNotFound {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		log.Printf("Failed to look up session: %v", err)
+		return nil, err
+	}
+	if session.Revoked_at != nil {
+		return nil, ErrSessionRevoked
+	}
+	return &session, nil
+}
+
+// RotateSession moves the session on to a new refresh token, but only if the
+// one being exchanged is still its current token. It returns false when
+// another request got there first, which callers must treat as reuse.
+func RotateSession(previous *SignedDetails, signedRefreshToken string, ipAddress string) (bool, error) {
+	claims, msg := ValidateToken(signedRefreshToken)
+	if msg != "" {
+		return false, errors.New(msg)
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var updateObj primitive.D
+
+	updateObj = append(updateObj, bson.E{Key: "refresh_token_id", Value: claims.Id})
+	updateObj = append(updateObj, bson.E{Key: "ip_address", Value: ipAddress})
+	updateObj = append(updateObj, bson.E{Key: "last_seen_at", Value: time.Now()})
+	updateObj = append(updateObj, bson.E{Key: "expires_at", Value: time.Unix(claims.ExpiresAt, 0)})
+
+	filter := bson.M{"session_id": previous.Family, "refresh_token_id": previous.Id, "revoked_at": nil}
+
+	result, err := sessionCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: updateObj}}, false)
+	if err != nil {
+		log.Printf("Failed to rotate session: %v", err)
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// CheckSession returns ErrSessionRevoked once the session an access token
+// belongs to has been revoked, and keeps its last_seen_at current.
+func CheckSession(sessionId string, ipAddress string) error {
+	sessionCache.Lock()
+	cached, found := sessionCache.sessions[sessionId]
+	sessionCache.Unlock()
+
+	if !found || time.Since(cached.fetchedAt) > sessionCacheTTL {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var session models.Session
+		err := sessionCollection.FindOne(ctx, bson.M{"session_id": sessionId}, &session)
+		if err == repository.ErrNotFound {
+			return ErrSessionRevoked
+		}
+		if err != nil {
+			log.Printf("Failed to look up session: %v", err)
+			return err
+		}
+		cached = cachedSession{session: session, fetchedAt: time.Now()}
+
+		sessionCache.Lock()
+		sessionCache.sessions[sessionId] = cached
+		sessionCache.Unlock()
+	}
+
+	if cached.session.Revoked_at != nil {
+		return ErrSessionRevoked
+	}
+	if time.Since(cached.session.Last_seen_at) > sessionTouchInterval {
+		touchSession(sessionId, ipAddress)
+	}
+	return nil
+}
+
+// ListSessions returns the user's sessions that can still be used, most
+// recently seen first.
+func ListSessions(userId string) ([]models.Session, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userId, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := repository.FindOptions{Sort: bson.D{{Key: "last_seen_at", Value: -1}}}
+
+	sessions := []models.Session{}
+	if err := sessionCollection.Find(ctx, filter, opts, &sessions); err != nil {
+		log.Printf("Failed to list sessions: %v", err)
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions. Its refresh token can no
+// longer be exchanged and its access tokens stop working. It returns false
+// when the user has no such active session.
+func RevokeSession(userId string, sessionId string) (bool, error) {
+	return revokeSessions(userId, bson.M{"user_id": userId, "session_id": sessionId, "revoked_at": nil})
+}
+
+// RevokeAllSessions ends every session of the user.
+func RevokeAllSessions(userId string) error {
+	_, err := revokeSessions(userId, bson.M{"user_id": userId, "revoked_at": nil})
+	return err
+}
+
+func revokeSessions(userId string, filter bson.M) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	revokedAt := time.Now()
+	result, err := sessionCollection.UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: revokedAt}}}})
+	if err != nil {
+		log.Printf("Failed to revoke sessions: %v", err)
+		return false, err
+	}
+
+	sessionCache.Lock()
+	for sessionId, cached := range sessionCache.sessions {
+		if cached.session.User_id == userId {
+			delete(sessionCache.sessions, sessionId)
+		}
+	}
+	sessionCache.Unlock()
+	return result.MatchedCount > 0, nil
+}
+
+func touchSession(sessionId string, ipAddress string) {
+	now := time.Now()
+
+	sessionCache.Lock()
+	if cached, found := sessionCache.sessions[sessionId]; found {
+		cached.session.Last_seen_at = now
+		sessionCache.sessions[sessionId] = cached
+	}
+	sessionCache.Unlock()
+
+	go func() {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := sessionCollection.UpdateOne(
+			ctx,
+			bson.M{"session_id": sessionId},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "last_seen_at", Value: now}, {Key: "ip_address", Value: ipAddress}}}},
+			false,
+		)
+		if err != nil {
+			log.Printf("Failed to record session activity: %v", err)
+		}
+	}()
+}
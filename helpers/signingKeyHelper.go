@@ -0,0 +1,445 @@
+package helpers
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Algorithm for new keys, RS256 or EdDSA. Existing keys keep theirs.
+var JWT_ALGORITHM string = envOrDefault("JWT_ALGORITHM", "RS256")
+
+// KeyEncryptionKeyEnv names the variable holding the key the signing keys
+// are stored encrypted with: 32 random bytes in base64, e.g. from
+// "openssl rand -base64 32". Anyone who can read the stored keys without it
+// learns nothing; anyone with both can sign tokens as any user.
+const KeyEncryptionKeyEnv = "JWT_KEY_ENCRYPTION_KEY"
+
+// How long a key is used for signing before a new one takes over.
+var JWT_KEY_ROTATION time.Duration = durationOrDefault("JWT_KEY_ROTATION", 30*24*time.Hour)
+
+const (
+	// New keys are published this long before they sign anything, so
+	// verifiers caching the JWKS pick them up first
+	keyActivationDelay = time.Hour
+	// Retired keys stay published until every token they signed has expired
+	keyRetirementDelay = 7*24*time.Hour + time.Hour
+	keyRefreshInterval = 10 * time.Minute
+)
+
+type loadedKey struct {
+	kid         string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	public      crypto.PublicKey
+	activatesAt time.Time
+	retiresAt   time.Time
+}
+
+var keyRing = struct {
+	sync.RWMutex
+	keys     []loadedKey // newest first
+	loadedAt time.Time
+}{}
+
+func durationOrDefault(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(envOrDefault(key, fallback.String()))
+	if err != nil || value <= 0 {
+		log.Printf("Invalid %s, using %s", key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// StartKeyRotation keeps the key ring in sync with the database and adds a
+// new key whenever the active one is due for rotation. Every instance runs
+// it; they all converge on the newest stored key. Rotation stops when ctx is
+// done.
+func StartKeyRotation(ctx context.Context) {
+	if err := RotateSigningKeys(); err != nil {
+		log.Printf("Failed to load signing keys: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(keyRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := RotateSigningKeys(); err != nil {
+					log.Printf("Failed to rotate signing keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// RotateSigningKeys reloads the stored keys, creates a successor when the
+// newest key is older than JWT_KEY_ROTATION and drops retired keys.
+func RotateSigningKeys() error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	_, err := signingKeyCollection.DeleteMany(ctx, bson.M{"retires_at": bson.M{"$lte": now}})
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if err := encryptStoredKeys(ctx, keys); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || now.Sub(keys[0].Created_at) >= JWT_KEY_ROTATION {
+		activatesAt := now.Add(keyActivationDelay)
+		if len(keys) == 0 {
+			// Nothing can sign yet, so there is no one to wait for
+			activatesAt = now
+		}
+		key, err := newSigningKey(JWT_ALGORITHM, now, activatesAt)
+		if err != nil {
+			return err
+		}
+		if err := signingKeyCollection.Insert(ctx, key); err != nil {
+			return err
+		}
+		log.Printf("Created signing key %s (%s)", key.Kid, key.Algorithm)
+
+		// The previous keys sign until the new one activates, then retire.
+		// Keys created after this one, by another instance, are left alone.
+		retiresAt := activatesAt.Add(keyRetirementDelay)
+		_, err = signingKeyCollection.UpdateMany(
+			ctx,
+			bson.M{"created_at": bson.M{"$lt": key.Created_at}, "retires_at": bson.M{"$gt": retiresAt}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "retires_at", Value: retiresAt}}}},
+		)
+		if err != nil {
+			return err
+		}
+		if keys, err = loadSigningKeys(ctx); err != nil {
+			return err
+		}
+	}
+
+	var ring []loadedKey
+	for _, key := range keys {
+		loaded, err := parseSigningKey(key)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", key.Kid, err)
+			continue
+		}
+		ring = append(ring, loaded)
+	}
+
+	keyRing.Lock()
+	keyRing.keys = ring
+	keyRing.loadedAt = now
+	keyRing.Unlock()
+	return nil
+}
+
+func loadSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	err := signingKeyCollection.Find(ctx, bson.M{"retires_at": bson.M{"$gt": time.Now()}}, repository.FindOptions{}, &keys)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created_at.After(keys[j].Created_at) })
+	return keys, nil
+}
+
+func newSigningKey(algorithm string, createdAt time.Time, activatesAt time.Time) (models.SigningKey, error) {
+	var key models.SigningKey
+	var private interface{}
+	var err error
+
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case SigningMethodEd25519.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return key, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return key, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return key, err
+	}
+
+	key.ID = primitive.NewObjectID()
+	key.Kid = key.ID.Hex()
+	key.Algorithm = algorithm
+	if key.Encrypted_private_key, err = sealPrivateKey(key.Kid, der); err != nil {
+		return key, err
+	}
+	key.Created_at = createdAt
+	key.Activates_at = activatesAt
+	key.Retires_at = createdAt.Add(100 * 365 * 24 * time.Hour) // until a successor exists
+	return key, nil
+}
+
+// encryptStoredKeys encrypts the keys stored before keys were encrypted, in
+// storage and in keys.
+func encryptStoredKeys(ctx context.Context, keys []models.SigningKey) error {
+	for i, key := range keys {
+		if key.Private_key == "" {
+			continue
+		}
+		block, _ := pem.Decode([]byte(key.Private_key))
+		if block == nil {
+			return fmt.Errorf("signing key %s: no PEM block", key.Kid)
+		}
+		sealed, err := sealPrivateKey(key.Kid, block.Bytes)
+		if err != nil {
+			return err
+		}
+		_, err = signingKeyCollection.UpdateOne(
+			ctx,
+			bson.M{"kid": key.Kid},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "encrypted_private_key", Value: sealed},
+				{Key: "private_key", Value: ""},
+			}}},
+			false,
+		)
+		if err != nil {
+			return err
+		}
+		keys[i].Encrypted_private_key = sealed
+		keys[i].Private_key = ""
+		log.Printf("Encrypted signing key %s", key.Kid)
+	}
+	return nil
+}
+
+// keyEncryption is the AEAD the signing keys are stored encrypted with, from
+// the key in KeyEncryptionKeyEnv.
+func keyEncryption() (cipher.AEAD, error) {
+	encoded := os.Getenv(KeyEncryptionKeyEnv)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is not set", KeyEncryptionKeyEnv)
+	}
+	kek, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(kek) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes in base64", KeyEncryptionKeyEnv)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// CheckKeyEncryptionKey reports whether signing keys can be stored and loaded.
+func CheckKeyEncryptionKey() error {
+	_, err := keyEncryption()
+	return err
+}
+
+// sealPrivateKey encrypts a key's DER, bound to its kid so that sealed keys
+// can't be swapped between records.
+func sealPrivateKey(kid string, der []byte) (string, error) {
+	aead, err := keyEncryption()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, der, []byte(kid))), nil
+}
+
+func openPrivateKey(kid string, sealed string) ([]byte, error) {
+	aead, err := keyEncryption()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted key")
+	}
+	der, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt with %s: %w", KeyEncryptionKeyEnv, err)
+	}
+	return der, nil
+}
+
+func parseSigningKey(key models.SigningKey) (loadedKey, error) {
+	der, err := openPrivateKey(key.Kid, key.Encrypted_private_key)
+	if err != nil {
+		return loadedKey{}, err
+	}
+	private, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return loadedKey{}, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return loadedKey{}, errors.New("key cannot sign")
+	}
+	method := jwt.GetSigningMethod(key.Algorithm)
+	if method == nil {
+		return loadedKey{}, fmt.Errorf("unsupported signing algorithm %q", key.Algorithm)
+	}
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		if method != jwt.SigningMethodRS256 {
+			return loadedKey{}, errors.New("RSA key with a non-RSA algorithm")
+		}
+	case ed25519.PrivateKey:
+		if method != SigningMethodEd25519 {
+			return loadedKey{}, errors.New("Ed25519 key with a non-EdDSA algorithm")
+		}
+	default:
+		return loadedKey{}, errors.New("unsupported key type")
+	}
+	return loadedKey{
+		kid:         key.Kid,
+		method:      method,
+		private:     signer,
+		public:      signer.Public(),
+		activatesAt: key.Activates_at,
+		retiresAt:   key.Retires_at,
+	}, nil
+}
+
+// ensureKeyRing loads the keys on first use, or again when they are stale,
+// e.g. when a token carries a kid another instance just created.
+func ensureKeyRing(maxAge time.Duration) error {
+	keyRing.RLock()
+	fresh := !keyRing.loadedAt.IsZero() && time.Since(keyRing.loadedAt) < maxAge
+	keyRing.RUnlock()
+	if fresh {
+		return nil
+	}
+	return RotateSigningKeys()
+}
+
+// signToken signs claims with the newest active key and names it in the
+// "kid" header.
+func signToken(claims jwt.Claims) (string, error) {
+	if err := ensureKeyRing(keyRefreshInterval * 2); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	keyRing.RLock()
+	var active *loadedKey
+	for i := range keyRing.keys {
+		if !keyRing.keys[i].activatesAt.After(now) && keyRing.keys[i].retiresAt.After(now) {
+			active = &keyRing.keys[i]
+			break
+		}
+	}
+	keyRing.RUnlock()
+	if active == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(active.method, claims)
+	token.Header["kid"] = active.kid
+	return token.SignedString(active.private)
+}
+
+// verificationKey is the jwt.Keyfunc for ValidateToken. The token must name a
+// published key and use exactly that key's algorithm.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no key id")
+	}
+
+	key, found := findKey(kid)
+	if !found {
+		// Another instance may have rotated since our last load
+		if err := ensureKeyRing(time.Minute); err != nil {
+			return nil, err
+		}
+		key, found = findKey(kid)
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing algorithm %q", token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+func findKey(kid string) (loadedKey, bool) {
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+
+	now := time.Now()
+	for _, key := range keyRing.keys {
+		if key.kid == kid && key.retiresAt.After(now) {
+			return key, true
+		}
+	}
+	return loadedKey{}, false
+}
+
+// JWKS returns the published public keys as a JSON Web Key Set.
+func JWKS() (map[string]interface{}, error) {
+	if err := ensureKeyRing(keyRefreshInterval * 2); err != nil {
+		return nil, err
+	}
+
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+
+	keys := []map[string]interface{}{}
+	for _, key := range keyRing.keys {
+		jwk := map[string]interface{}{
+			"kid": key.kid,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}, nil
+}
@@ -0,0 +1,52 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RestaurantHeader lets a cross-site user act on one restaurant. Users tied
+// to a restaurant cannot use it to reach another one.
+const RestaurantHeader = "X-Restaurant-Id"
+
+const restaurantCacheTTL = 5 * time.Minute
+
+var ErrUnknownRestaurant = errors.New("unknown restaurant")
+
+var restaurantCache = struct {
+	sync.Mutex
+	checkedAt map[string]time.Time
+}{checkedAt: map[string]time.Time{}}
+
+// CheckRestaurant returns ErrUnknownRestaurant unless a restaurant with the
+// id exists. Known ids are cached; restaurants are never deleted.
+func CheckRestaurant(restaurantId string) error {
+	restaurantCache.Lock()
+	checkedAt, found := restaurantCache.checkedAt[restaurantId]
+	restaurantCache.Unlock()
+	if found && time.Since(checkedAt) < restaurantCacheTTL {
+		return nil
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := restaurantCollection.Count(ctx, bson.M{"restaurant_id": restaurantId})
+	if err != nil {
+		log.Printf("Failed to look up restaurant: %v", err)
+		return err
+	}
+	if count == 0 {
+		return ErrUnknownRestaurant
+	}
+
+	restaurantCache.Lock()
+	restaurantCache.checkedAt[restaurantId] = time.Now()
+	restaurantCache.Unlock()
+	return nil
+}
@@ -1,63 +1,84 @@
 package helpers
 
 import (
-	"context"
 	"log"
-	"os"
-	"restaurant_app/database"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SignedDetails struct {
-	Email      string
-	FirstName  string
-	LastName   string
-	Uid        string
+	Email        string
+	FirstName    string
+	LastName     string
+	Uid          string
+	Role         string
+	RestaurantId string // empty for cross-site users
+	TokenType    string
+	Family       string
+	DeviceId     string
 	jwt.StandardClaims
 }
 
-var userCollection *mongo.Collection = database.OpenCollection(database.Client, "user")
+const (
+	AccessTokenType  = "access"
+	RefreshTokenType = "refresh"
+	MfaTokenType     = "mfa"
+	DeviceTokenType  = "device"
+)
 
-var SECRET_KEY string = os.Getenv("SECRET_KEY")
+// Only asymmetric algorithms are accepted; anything else, HS256 and "none"
+// included, is rejected before the signature is looked at.
+var tokenParser = &jwt.Parser{ValidMethods: []string{jwt.SigningMethodRS256.Alg(), SigningMethodEd25519.Alg()}}
 
+// GenerateAllTokens starts a new token family, i.e. a new session, on login.
+func GenerateAllTokens(email, firstName, lastName, uid, role, restaurantId string) (signedToken string, signedRefreshToken string, err error) {
+	return GenerateFamilyTokens(email, firstName, lastName, uid, role, restaurantId, primitive.NewObjectID().Hex())
+}
 
-func GenerateAllTokens(email, firstName, lastName, uid string) (signedToken string, signedRefreshToken string, err error) {
+// GenerateFamilyTokens issues a new pair whose refresh token belongs to an
+// existing family, so a rotated token can be traced back to its login.
+func GenerateFamilyTokens(email, firstName, lastName, uid, role, restaurantId, family string) (signedToken string, signedRefreshToken string, err error) {
     // Setup claims for the access token
     claims := &SignedDetails{
         Email:      email,
         FirstName:  firstName,
         LastName:   lastName,
         Uid:        uid,
+        Role:       role,
+        RestaurantId: restaurantId,
+        TokenType:  AccessTokenType,
+        Family:     family, // the session, see CheckSession
         StandardClaims: jwt.StandardClaims{
+            Id:        primitive.NewObjectID().Hex(), // lets a single token be revoked
+            IssuedAt:  time.Now().Unix(),
             ExpiresAt: time.Now().Add(15 * time.Minute).Unix(), // 15 minutes for access token
         },
     }
 
     // Setup claims for the refresh token
     refreshClaims := &SignedDetails{
+        Uid:        uid,
+        TokenType:  RefreshTokenType,
+        Family:     family,
         StandardClaims: jwt.StandardClaims{
+            Id:        primitive.NewObjectID().Hex(), // unique per rotation
+            IssuedAt:  time.Now().Unix(),
             ExpiresAt: time.Now().Add(7 * 24 * time.Hour).Unix(), // 7 days for refresh token
         },
     }
 
     // Generate the access token
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    signedToken, err = token.SignedString([]byte(SECRET_KEY))
+    signedToken, err = signToken(claims)
     if err != nil {
         log.Printf("Failed to sign the access token: %v", err)
         return
     }
 
     // Generate the refresh token
-    refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-    signedRefreshToken, err = refreshToken.SignedString([]byte(SECRET_KEY))
+    signedRefreshToken, err = signToken(refreshClaims)
     if err != nil {
         log.Printf("Failed to sign the refresh token: %v", err)
         return
@@ -65,48 +86,89 @@ func GenerateAllTokens(email, firstName, lastName, uid string) (signedToken stri
     return signedToken, signedRefreshToken, nil
 }
 
+// GenerateMfaToken issues a short-lived token proving the password step of a
+// login passed. It can only be exchanged at the second factor step, once.
+func GenerateMfaToken(uid string) (signedToken string, err error) {
+	claims := &SignedDetails{
+		Uid:       uid,
+		TokenType: MfaTokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+		},
+	}
 
-func UpdateAllToken(signedToken string, signedRefreshToken string, userId string){
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
-	var updateObj primitive.D
-
-	updateObj = append(updateObj, bson.E{Key: "token", Value: signedToken})
-	updateObj = append(updateObj, bson.E{Key: "refresh_token", Value: signedRefreshToken})
+	signedToken, err = signToken(claims)
+	if err != nil {
+		log.Printf("Failed to sign the mfa token: %v", err)
+		return
+	}
+	if err = recordMfaChallenge(claims); err != nil {
+		return "", err
+	}
+	return signedToken, nil
+}
 
-	Updated_at, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: Updated_at})
-	
+// GenerateDeviceToken identifies a registered terminal. It lets the terminal
+// call the PIN login endpoints but nothing else.
+func GenerateDeviceToken(deviceId string) (signedToken string, err error) {
+	claims := &SignedDetails{
+		DeviceId:  deviceId,
+		TokenType: DeviceTokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+		},
+	}
 
-	filter := bson.M{"user_id": userId}
-	upsert := true
-    opts := options.UpdateOptions{Upsert: &upsert}
+	signedToken, err = signToken(claims)
+	if err != nil {
+		log.Printf("Failed to sign the device token: %v", err)
+		return
+	}
+	return signedToken, nil
+}
 
+// GenerateTerminalToken issues an access token for a PIN login. It is bound
+// to the device, has no refresh token and is checked for inactivity on every
+// request.
+func GenerateTerminalToken(email, firstName, lastName, uid, role, restaurantId, deviceId string) (signedToken string, tokenId string, err error) {
+	claims := &SignedDetails{
+		Email:        email,
+		FirstName:    firstName,
+		LastName:     lastName,
+		Uid:          uid,
+		Role:         role,
+		RestaurantId: restaurantId,
+		TokenType:    AccessTokenType,
+		DeviceId:     deviceId,
+		StandardClaims: jwt.StandardClaims{
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(TERMINAL_SESSION_TTL).Unix(),
+		},
+	}
 
-	_, err := userCollection.UpdateOne(
-		ctx,
-		filter,
-		bson.D{{Key: "$set", Value: updateObj}},
-		&opts,
-	)
+	signedToken, err = signToken(claims)
 	if err != nil {
-		log.Printf("Failed to update tokens: %v", err)
-        return
+		log.Printf("Failed to sign the terminal token: %v", err)
+		return
 	}
+	return signedToken, claims.Id, nil
 }
 
 
 func ValidateToken(signedToken string) (claims *SignedDetails, msg string){
 	
-	token, err := jwt.ParseWithClaims(
+	token, err := tokenParser.ParseWithClaims(
 		signedToken,
 		&SignedDetails{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(SECRET_KEY), nil
-		})
+		verificationKey)
 	if err != nil{
-		log.Printf("Failed to sign the refresh token: %v", err)
+		msg = err.Error()
+		log.Printf("Failed to parse the token: %v", err)
         return
 
 	}
@@ -116,14 +178,14 @@ func ValidateToken(signedToken string) (claims *SignedDetails, msg string){
 	claims, ok := token.Claims.(*SignedDetails)
 	if !ok {
 		msg = "the token is inValid"
-		log.Printf("Failed to sign the refresh token: %v", msg)
+		log.Printf("Rejected a token: %v", msg)
         return
 	}
 	
 	// Check if the token is expired
 	if claims.ExpiresAt < time.Now().Local().Unix(){
 		msg = "Token is expired"
-		log.Printf("Failed to sign the refresh token: %v", msg)
+		log.Printf("Rejected a token: %v", msg)
 		return
 	}
 	return claims, msg
@@ -0,0 +1,122 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod        = 30 // seconds per code
+	totpDigits        = 6
+	totpSkew          = 1 // accepted steps either side of now, for clock drift
+	recoveryCodeCount = 10
+)
+
+var TOTP_ISSUER string = envOrDefault("TOTP_ISSUER", "Restaurant App")
+
+// Roles that must pass a second factor at login, e.g. "ADMIN,MANAGER".
+var TOTP_REQUIRED_ROLES []string = strings.Split(envOrDefault("TOTP_REQUIRED_ROLES", "ADMIN,MANAGER"), ",")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// TotpRequired reports whether users with the role must use a second factor.
+func TotpRequired(role string) bool {
+	for _, required := range TOTP_REQUIRED_ROLES {
+		if strings.TrimSpace(required) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateTotpSecret returns a new base32 secret and the otpauth URI that
+// authenticator apps read from a QR code.
+func GenerateTotpSecret(accountName string) (secret string, uri string, err error) {
+	raw := make([]byte, 20)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret = totpEncoding.EncodeToString(raw)
+
+	label := url.PathEscape(TOTP_ISSUER + ":" + accountName)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TOTP_ISSUER)
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri = "otpauth://totp/" + label + "?" + query.Encode()
+	return secret, uri, nil
+}
+
+// ValidateTotp checks a code against the secret and returns the time step it
+// matched. Steps at or before lastStep are refused so a code can't be replayed.
+func ValidateTotp(secret string, code string, lastStep int64) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := time.Now().Unix() / totpPeriod
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		candidate := current + offset
+		if candidate <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, candidate)), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// GenerateRecoveryCodes returns single-use codes for a lost authenticator
+// along with the hashes to store.
+func GenerateRecoveryCodes() (codes []string, codeHashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err = rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes = append(codes, code)
+		codeHashes = append(codeHashes, HashRecoveryCode(code))
+	}
+	return codes, codeHashes, nil
+}
+
+func HashRecoveryCode(code string) string {
+	return HashResetCode(strings.ToLower(strings.TrimSpace(code)))
+}
@@ -0,0 +1,52 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, appendix B. The RFC's codes have eight
+// digits; ours are their last six.
+func TestTotpCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, vector := range vectors {
+		want := vector.code[len(vector.code)-totpDigits:]
+		if got := totpCode(key, vector.unix/totpPeriod); got != want {
+			t.Errorf("code at %d is %s, want %s", vector.unix, got, want)
+		}
+	}
+}
+
+func TestValidateTotpRefusesReplay(t *testing.T) {
+	secret, _, err := GenerateTotpSecret("test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	step, ok := ValidateTotp(secret, code, 0)
+	if !ok {
+		t.Fatal("the current code was refused")
+	}
+	if _, ok := ValidateTotp(secret, code, step); ok {
+		t.Fatal("the code was accepted again for the step it was used in")
+	}
+	if _, ok := ValidateTotp(secret, "000000", 0); ok && code != "000000" {
+		t.Fatal("a wrong code was accepted")
+	}
+}
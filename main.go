@@ -1,39 +1,24 @@
 package main
 
 import (
-	"os"
-	"restaurant_app/database"
-	"restaurant_app/middlewares"
-	"restaurant_app/routes"
-
-	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/mongo"
+	"context"
+	"log"
+	"restaurant_app/app"
 )
 
-var foodCollection *mongo.Collection = database.OpenCollection(database.Client, "food")
-
 
 func main(){
-	port := os.Getenv("PORT")
-
-	if port == ""{
-		port = "8000"
+	config, err := app.LoadConfig()
+	if err != nil{
+		log.Fatal(err)
 	}
 
-	router := gin.New()
-	router.Use(gin.Logger())
-	routes.UserRoutes(router)
-	router.Use(middleware.Authentication())
-
-	routes.FoodRoutes(router)
-	routes.MenuRoutes(router)
-	routes.TableRoutes(router)
-	routes.OrderRoutes(router)
-	routes.OrderItemRoutes(router)
-	routes.InvoiceRoutes(router)
-
-
-
-	router.Run(":" + port)
+	server, err := app.New(context.Background(), config)
+	if err != nil{
+		log.Fatal(err)
+	}
 
-}
\ No newline at end of file
+	if err := server.Run(); err != nil{
+		log.Fatal(err)
+	}
+}
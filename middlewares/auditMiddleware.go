@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// auditedEntity says where the entity behind a route lives: its collection
+// and the field its id is stored in.
+type auditedEntity struct{
+	collection string
+	field string
+}
+
+// Entities by the route parameter that carries their id.
+var auditedParams = map[string]auditedEntity{
+	"food_id": {"food", "food_id"},
+	"menu_id": {"menu", "menu_id"},
+	"table_id": {"table", "table_id"},
+	"order_id": {"order", "order_id"},
+	"orderItem_id": {"orderItem", "order_item_id"},
+	"order_item_id": {"orderItem", "order_item_id"},
+	"invoice_id": {"invoice", "invoice_id"},
+	"user_id": {"user", "user_id"},
+	"api_key_id": {"apiKey", "api_key_id"},
+	"device_id": {"device", "device_id"},
+	"restaurant_id": {"restaurant", "restaurant_id"},
+	"session_id": {"session", "session_id"},
+}
+
+// Entities created by a POST to the collection route, by its first segment.
+var auditedCollections = map[string]auditedEntity{
+	"foods": {"food", "food_id"},
+	"menus": {"menu", "menu_id"},
+	"tables": {"table", "table_id"},
+	"orders": {"order", "order_id"},
+	"orderItems": {"orderItem", "order_item_id"},
+	"invoices": {"invoice", "invoice_id"},
+	"apiKeys": {"apiKey", "api_key_id"},
+	"devices": {"device", "device_id"},
+	"restaurants": {"restaurant", "restaurant_id"},
+}
+
+// Responses are only read to find the id of a created entity.
+const auditMaxResponseSize = 64 * 1024
+
+type auditResponseWriter struct{
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error){
+	if w.body.Len() < auditMaxResponseSize{
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Audit records every POST, PATCH and DELETE in the audit log, with the uid
+// that Authentication set and a before/after diff of the entity the route
+// acts on. It runs around the whole chain, so it must be registered before
+// any other middleware that can abort. Entities are read from collections,
+// so deleted ones are still found.
+func Audit(collections repository.Collections) gin.HandlerFunc{
+	return func(c *gin.Context){
+		method := c.Request.Method
+		if method != http.MethodPost && method != http.MethodPatch && method != http.MethodDelete{
+			c.Next()
+			return
+		}
+
+		entity, entityId, found := auditedParam(c)
+		var before bson.M
+		if found{
+			before = helpers.AuditSnapshot(collections, entity.collection, entity.field, entityId)
+		} else if method == http.MethodPost{
+			entity, found = auditedCollections[strings.Split(strings.TrimPrefix(c.FullPath(), "/"), "/")[0]]
+		}
+
+		writer := &auditResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		entry := models.AuditEntry{
+			User_id: c.GetString("uid"),
+			Role: c.GetString("role"),
+			Restaurant_id: c.GetString("restaurantId"),
+			Method: method,
+			Route: c.FullPath(),
+			Path: c.Request.URL.Path,
+			Entity: entity.collection,
+			Status: writer.Status(),
+			Changes: []models.AuditChange{},
+			Ip_address: c.ClientIP(),
+		}
+		entry.Created_at, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+
+		entityIds := []string{entityId}
+		if found && entityId == ""{
+			entityIds = createdIds(writer.body.Bytes(), entity.field)
+		}
+
+		for _, id := range entityIds{
+			record := entry
+			record.ID = primitive.NewObjectID()
+			record.Audit_id = record.ID.Hex()
+			record.Entity_id = id
+			if found && id != "" && writer.Status() < http.StatusBadRequest{
+				after := helpers.AuditSnapshot(collections, entity.collection, entity.field, id)
+				record.Changes = helpers.AuditChanges(before, after)
+				if restaurantId, ok := after["restaurant_id"].(string); ok && restaurantId != ""{
+					record.Restaurant_id = restaurantId
+				}
+			}
+			helpers.RecordAudit(record)
+		}
+	}
+}
+
+// auditedParam finds the entity a route acts on from its path parameters.
+func auditedParam(c *gin.Context) (auditedEntity, string, bool){
+	for _, param := range c.Params{
+		if entity, found := auditedParams[param.Key]; found{
+			return entity, param.Value, true
+		}
+	}
+	return auditedEntity{}, "", false
+}
+
+// createdIds reads the ids of created entities from a response: the result
+// of InsertOne or InsertMany, or the entity itself, possibly as "details".
+func createdIds(body []byte, field string) []string{
+	var response map[string]interface{}
+	if json.Unmarshal(body, &response) != nil{
+		return []string{""}
+	}
+	if id, ok := response["InsertedID"].(string); ok{
+		return []string{id}
+	}
+	if insertedIds, ok := response["InsertedIDs"].([]interface{}); ok && len(insertedIds) > 0{
+		ids := []string{}
+		for _, insertedId := range insertedIds{
+			if id, ok := insertedId.(string); ok{
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if id, ok := response[field].(string); ok{
+		return []string{id}
+	}
+	if details, ok := response["details"].(map[string]interface{}); ok{
+		if id, ok := details[field].(string); ok{
+			return []string{id}
+		}
+	}
+	return []string{""}
+}
@@ -3,30 +3,115 @@ package middleware
 import (
 	"net/http"
 	"restaurant_app/helpers"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 func Authentication() gin.HandlerFunc{
 	return func(c *gin.Context){
-		clientToken := c.Request.Header.Get("token")
+		clientToken := credentialFromRequest(c)
 
 		if clientToken == ""{
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "No Authourization header provided"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "No Authourization header provided"})
 			c.Abort()
 			return
 		}
+
+		if helpers.IsApiKey(clientToken){
+			apiKey, err := helpers.ValidateApiKey(clientToken)
+			if err == helpers.ErrInvalidApiKey{
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid api key"})
+				c.Abort()
+				return
+			}
+			if err != nil{
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the api key"})
+				c.Abort()
+				return
+			}
+			c.Set("uid", "api-key:" + apiKey.Api_key_id)
+			c.Set("role", *apiKey.Role)
+			c.Set("apiKeyId", apiKey.Api_key_id)
+			c.Set("scopes", apiKey.Scopes)
+			if !setRestaurant(c, apiKey.Restaurant_id, *apiKey.Role){
+				return
+			}
+
+			c.Next()
+			return
+		}
+
 		claims, err := helpers.ValidateToken(clientToken)
 		if err != ""{
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err})
+			c.Abort()
+			return
+		}
+		if claims.TokenType != helpers.AccessTokenType{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "only access tokens can be used for authorization"})
+			c.Abort()
+			return
+		}
+		revoked, revokedErr := helpers.IsRevoked(claims)
+		if revokedErr != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the token"})
 			c.Abort()
 			return
 		}
+		if revoked{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
+		if claims.Family != ""{
+			if err := helpers.CheckSession(claims.Family, c.ClientIP()); err != nil{
+				if err == helpers.ErrSessionRevoked{
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the session"})
+				}
+				c.Abort()
+				return
+			}
+		}
+		if claims.DeviceId != ""{
+			if err := helpers.TouchTerminalSession(claims); err != nil{
+				if err == helpers.ErrTerminalLocked || err == helpers.ErrInvalidDevice{
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Terminal is locked, enter your PIN again"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the terminal session"})
+				}
+				c.Abort()
+				return
+			}
+		}
 		c.Set("email", claims.Email)
 		c.Set("firstName", claims.FirstName)
 		c.Set("lastName", claims.LastName)
 		c.Set("uid", claims.Uid)
+		c.Set("role", claims.Role)
+		c.Set("tokenId", claims.Id)
+		c.Set("tokenExpiresAt", claims.ExpiresAt)
+		c.Set("deviceId", claims.DeviceId)
+		c.Set("sessionId", claims.Family)
+		if !setRestaurant(c, claims.RestaurantId, claims.Role){
+			return
+		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// credentialFromRequest reads "Authorization: Bearer <token or api key>",
+// falling back to the legacy "token" header.
+func credentialFromRequest(c *gin.Context) string{
+	if authorization := c.Request.Header.Get("Authorization"); authorization != ""{
+		scheme, credential, found := strings.Cut(authorization, " ")
+		if found && strings.EqualFold(scheme, "Bearer"){
+			return strings.TrimSpace(credential)
+		}
+		return ""
+	}
+	return c.Request.Header.Get("token")
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// useMemoryStorage points the helpers at empty in-memory collections and
+// returns them, with a key-encryption key set so tokens can be signed.
+func useMemoryStorage(t *testing.T) repository.Collections {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv(helpers.KeyEncryptionKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	collections := repository.NewMemory().Collections
+	helpers.UseStorage(collections)
+	return collections
+}
+
+// echoRouter answers every route with the restaurant the request acts on.
+func echoRouter(roles ...string) *gin.Engine {
+	router := gin.New()
+	router.Use(Authentication())
+	echo := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"restaurant_id": c.GetString("restaurantId"), "cross_site": c.GetBool("crossSite")})
+	}
+	router.GET("/invoices", Authorize(roles...), echo)
+	router.PATCH("/invoices/:invoice_id", Authorize(roles...), echo)
+	router.GET("/orderItems-order/:order_id", Authorize(roles...), echo)
+	router.GET("/foods", Authorize(roles...), echo)
+	router.GET("/restaurants", Authorize(roles...), CrossSite(), echo)
+	return router
+}
+
+func send(router *gin.Engine, method string, path string, credential string, restaurantId string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer "+credential)
+	if restaurantId != "" {
+		request.Header.Set(helpers.RestaurantHeader, restaurantId)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	collections := useMemoryStorage(t)
+	apiKeyId := primitive.NewObjectID().Hex()
+	key, keyHash, err := helpers.GenerateApiKey(apiKeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, role := "Accounting", models.RoleCashier
+	err = collections.Collection("apiKey").Insert(context.Background(), models.ApiKey{
+		ID:            primitive.NewObjectID(),
+		Name:          &name,
+		Role:          &role,
+		Scopes:        []string{"invoice:read", "orderItem:read"},
+		Restaurant_id: "restaurant-1",
+		Key_hash:      keyHash,
+		Created_at:    time.Now(),
+		Updated_at:    time.Now(),
+		Api_key_id:    apiKeyId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := echoRouter(models.RoleAdmin, models.RoleCashier)
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/invoices", http.StatusOK},
+		{http.MethodGet, "/orderItems-order/1", http.StatusOK},
+		{http.MethodPatch, "/invoices/1", http.StatusForbidden},
+		{http.MethodGet, "/foods", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if response := send(router, test.method, test.path, key, ""); response.Code != test.want {
+			t.Errorf("%s %s answered %d, want %d: %s", test.method, test.path, response.Code, test.want, response.Body)
+		}
+	}
+
+	// The scopes narrow the key's role, they do not widen it
+	if response := send(echoRouter(models.RoleAdmin), http.MethodGet, "/invoices", key, ""); response.Code != http.StatusForbidden {
+		t.Errorf("a cashier key reached an admin route: %d", response.Code)
+	}
+	// The key is tied to its restaurant
+	if response := send(router, http.MethodGet, "/invoices", key, "restaurant-2"); response.Code != http.StatusForbidden {
+		t.Errorf("the key acted on another restaurant: %d", response.Code)
+	}
+	if response := send(router, http.MethodGet, "/invoices", key+"x", ""); response.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong secret answered %d, want 401", response.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"restaurant_app/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceAuthentication admits registered terminals presenting the device
+// token from the authenticate endpoint. It sets "deviceId" and the device's
+// "restaurantId".
+func DeviceAuthentication() gin.HandlerFunc{
+	return func(c *gin.Context){
+		deviceToken := credentialFromRequest(c)
+
+		if deviceToken == ""{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "No Authourization header provided"})
+			c.Abort()
+			return
+		}
+		claims, msg := helpers.ValidateToken(deviceToken)
+		if msg != "" || claims.TokenType != helpers.DeviceTokenType{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid device token"})
+			c.Abort()
+			return
+		}
+		device, err := helpers.GetDevice(claims.DeviceId, 0)
+		if err == helpers.ErrInvalidDevice{
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Device has been revoked"})
+			c.Abort()
+			return
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the device"})
+			c.Abort()
+			return
+		}
+		c.Set("deviceId", claims.DeviceId)
+		c.Set("restaurantId", device.Restaurant_id)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"restaurant_app/helpers"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Authorize only lets the request through when the role set by Authentication
+// is one of the given roles. It must be chained after Authentication.
+//
+// API keys must also hold a scope for the route's resource: the first path
+// segment, singular, e.g. "invoice:read" for GET /invoices or "orderItem:write"
+// for PATCH /orderItems/:orderItem_id.
+func Authorize(roles ...string) gin.HandlerFunc{
+	return func(c *gin.Context){
+		role := c.GetString("role")
+
+		if scopes, isApiKey := c.Get("scopes"); isApiKey{
+			resource, access := requiredScope(c)
+			if !helpers.ApiKeyHasScope(scopes.([]string), resource, access){
+				c.JSON(http.StatusForbidden, gin.H{"error": "api key is missing scope " + resource + ":" + access})
+				c.Abort()
+				return
+			}
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to perform this action"})
+		c.Abort()
+	}
+}
+
+func requiredScope(c *gin.Context) (resource string, access string){
+	segment := strings.Split(strings.TrimPrefix(c.FullPath(), "/"), "/")[0]
+	resource, _, _ = strings.Cut(segment, "-")
+	resource = strings.TrimSuffix(resource, "s")
+
+	access = "write"
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead{
+		access = "read"
+	}
+	return resource, access
+}
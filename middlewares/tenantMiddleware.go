@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setRestaurant records which restaurant the request acts on in
+// "restaurantId". Users tied to a restaurant always act on theirs; cross-site
+// users pick one with the X-Restaurant-Id header, or act on every site when
+// they send none. Only admins can be cross-site. It responds and returns false
+// when the request is refused.
+func setRestaurant(c *gin.Context, homeRestaurantId string, role string) bool{
+	requested := c.Request.Header.Get(helpers.RestaurantHeader)
+
+	if homeRestaurantId != ""{
+		if requested != "" && requested != homeRestaurantId{
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only act on your own restaurant"})
+			c.Abort()
+			return false
+		}
+		c.Set("restaurantId", homeRestaurantId)
+		c.Set("crossSite", false)
+		return true
+	}
+
+	if role != models.RoleAdmin{
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your account is not assigned to a restaurant"})
+		c.Abort()
+		return false
+	}
+	if requested != ""{
+		err := helpers.CheckRestaurant(requested)
+		if err == helpers.ErrUnknownRestaurant{
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown restaurant"})
+			c.Abort()
+			return false
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the restaurant"})
+			c.Abort()
+			return false
+		}
+	}
+	c.Set("restaurantId", requested)
+	c.Set("crossSite", true)
+	return true
+}
+
+// CrossSite admits only users who are not tied to a restaurant. Use it after
+// Authentication.
+func CrossSite() gin.HandlerFunc{
+	return func(c *gin.Context){
+		if !c.GetBool("crossSite"){
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only cross-site users can do this"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
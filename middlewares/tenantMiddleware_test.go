@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"restaurant_app/helpers"
+	"restaurant_app/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// loginToken signs an access token for a user of the role at restaurantId,
+// empty for a cross-site user, with the session a login creates.
+func loginToken(t *testing.T, role string, restaurantId string) string {
+	t.Helper()
+	user := models.User{User_id: primitive.NewObjectID().Hex(), Restaurant_id: restaurantId}
+	token, refreshToken, err := helpers.GenerateAllTokens("user@example.com", "Test", "User", user.User_id, role, restaurantId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := helpers.CreateSession(user, refreshToken, "test", "192.0.2.1", "go test"); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRestaurantScope(t *testing.T) {
+	collections := useMemoryStorage(t)
+	err := collections.Collection("restaurant").Insert(context.Background(), models.Restaurant{ID: primitive.NewObjectID(), Restaurant_id: "restaurant-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := echoRouter(models.RoleAdmin, models.RoleManager)
+	manager := loginToken(t, models.RoleManager, "restaurant-1")
+	admin := loginToken(t, models.RoleAdmin, "")
+
+	tests := []struct {
+		name         string
+		token        string
+		path         string
+		header       string
+		status       int
+		restaurantId string
+	}{
+		{"manager at home", manager, "/foods", "", http.StatusOK, "restaurant-1"},
+		{"manager naming home", manager, "/foods", "restaurant-1", http.StatusOK, "restaurant-1"},
+		{"manager naming another", manager, "/foods", "restaurant-2", http.StatusForbidden, ""},
+		{"manager on a cross-site route", manager, "/restaurants", "", http.StatusForbidden, ""},
+		{"admin on every site", admin, "/foods", "", http.StatusOK, ""},
+		{"admin on one site", admin, "/foods", "restaurant-2", http.StatusOK, "restaurant-2"},
+		{"admin on an unknown site", admin, "/foods", "restaurant-3", http.StatusBadRequest, ""},
+		{"admin on a cross-site route", admin, "/restaurants", "", http.StatusOK, ""},
+		{"cross-site manager", loginToken(t, models.RoleManager, ""), "/foods", "", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		response := send(router, http.MethodGet, test.path, test.token, test.header)
+		if response.Code != test.status {
+			t.Errorf("%s: answered %d, want %d: %s", test.name, response.Code, test.status, response.Body)
+			continue
+		}
+		if response.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Restaurant_id string
+		}
+		json.Unmarshal(response.Body.Bytes(), &body)
+		if body.Restaurant_id != test.restaurantId {
+			t.Errorf("%s: acted on %q, want %q", test.name, body.Restaurant_id, test.restaurantId)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package migrations brings a database up to date with what the code
+// expects: the indexes its queries and uniqueness checks rely on, and fields
+// older documents lack. Every migration has a version, and the applied ones
+// are recorded in the schemaMigrations collection.
+//
+// Migrations are applied in order by Up and undone newest first by Down.
+// Applying one is safe to repeat, so a run that fails halfway can simply be
+// run again.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const collectionName = "schemaMigrations"
+
+// Migration is one versioned change to the database.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	// Down undoes Up. It is nil when Up cannot be undone, such as a backfill
+	// that overwrites what was there.
+	Down func(ctx context.Context, db *mongo.Database) error
+}
+
+// record is what schemaMigrations keeps about an applied migration.
+type record struct {
+	Version     int       `bson:"version"`
+	Description string    `bson:"description"`
+	Applied_at  time.Time `bson:"applied_at"`
+}
+
+// State is a migration and when it was applied, nil when it is pending.
+type State struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	Applied_at  *time.Time `json:"applied_at"`
+}
+
+// ErrIrreversible is returned by Down for a migration without a Down.
+var ErrIrreversible = errors.New("migration cannot be undone")
+
+// Latest is the version the code expects the database to be at.
+func Latest() int {
+	return all[len(all)-1].Version
+}
+
+func applied(ctx context.Context, db *mongo.Database) (map[int]record, error) {
+	cursor, err := db.Collection(collectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	byVersion := map[int]record{}
+	for _, r := range records {
+		byVersion[r.Version] = r
+	}
+	return byVersion, nil
+}
+
+// Status lists every migration, oldest first, with when it was applied.
+func Status(ctx context.Context, db *mongo.Database) ([]State, error) {
+	done, err := applied(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]State, len(all))
+	for i, migration := range all {
+		states[i] = State{Version: migration.Version, Description: migration.Description}
+		if r, found := done[migration.Version]; found {
+			appliedAt := r.Applied_at
+			states[i].Applied_at = &appliedAt
+		}
+	}
+	return states, nil
+}
+
+// Pending returns how many migrations have not been applied.
+func Pending(ctx context.Context, db *mongo.Database) (int, error) {
+	done, err := applied(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, migration := range all {
+		if _, found := done[migration.Version]; !found {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration up to and including version target,
+// or all of them when target is 0. It returns the versions it applied.
+func Up(ctx context.Context, db *mongo.Database, target int) ([]int, error) {
+	if err := ensureIndex(ctx, db); err != nil {
+		return nil, err
+	}
+	done, err := applied(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for _, migration := range all {
+		if target != 0 && migration.Version > target {
+			break
+		}
+		if _, found := done[migration.Version]; found {
+			continue
+		}
+		log.Printf("Applying migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Up(ctx, db); err != nil {
+			return versions, fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+		r := record{Version: migration.Version, Description: migration.Description, Applied_at: time.Now()}
+		if _, err := db.Collection(collectionName).InsertOne(ctx, r); err != nil {
+			// Another run applied it at the same time
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return versions, fmt.Errorf("migration %d was applied but not recorded: %w", migration.Version, err)
+		}
+		versions = append(versions, migration.Version)
+	}
+	return versions, nil
+}
+
+// Down undoes the applied migrations above version target, newest first. It
+// stops at the first one that cannot be undone. It returns the versions it
+// undid.
+func Down(ctx context.Context, db *mongo.Database, target int) ([]int, error) {
+	done, err := applied(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for i := len(all) - 1; i >= 0; i-- {
+		migration := all[i]
+		if migration.Version <= target {
+			break
+		}
+		if _, found := done[migration.Version]; !found {
+			continue
+		}
+		if migration.Down == nil {
+			return versions, fmt.Errorf("migration %d: %w", migration.Version, ErrIrreversible)
+		}
+		log.Printf("Undoing migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Down(ctx, db); err != nil {
+			return versions, fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+		if _, err := db.Collection(collectionName).DeleteOne(ctx, bson.M{"version": migration.Version}); err != nil {
+			return versions, fmt.Errorf("migration %d was undone but is still recorded: %w", migration.Version, err)
+		}
+		versions = append(versions, migration.Version)
+	}
+	return versions, nil
+}
+
+// Previous returns the version before the newest applied one, which is where
+// a single step down goes. It is 0 when at most one migration is applied.
+func Previous(ctx context.Context, db *mongo.Database) (int, error) {
+	done, err := applied(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	newest := -1
+	for i := len(all) - 1; i >= 0; i-- {
+		if _, found := done[all[i].Version]; found {
+			newest = i
+			break
+		}
+	}
+	if newest <= 0 {
+		return 0, nil
+	}
+	return all[newest-1].Version, nil
+}
+
+// ensureIndex keeps two concurrent runs from both recording a version.
+func ensureIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "version", Value: 1}},
+		Options: options.Index().SetName("version_unique").SetUnique(true),
+	})
+	return err
+}
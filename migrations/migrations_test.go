@@ -0,0 +1,145 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"restaurant_app/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestVersions(t *testing.T) {
+	for i, migration := range all {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d has version %d", i+1, migration.Version)
+		}
+		if migration.Description == "" || migration.Up == nil {
+			t.Errorf("migration %d has no description or no Up", migration.Version)
+		}
+	}
+	if Latest() != len(all) {
+		t.Errorf("Latest is %d with %d migrations", Latest(), len(all))
+	}
+}
+
+// testDatabase returns a database of its own on the server at MONGODB_URI,
+// dropped after the test, and skips the test when there is no server.
+func testDatabase(t *testing.T) *mongo.Database {
+	config, err := database.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DatabaseName = "restaurant_app_test_" + primitive.NewObjectID().Hex()
+	config.ServerSelectionTimeout = 2 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := database.Connect(ctx, config)
+	if err != nil {
+		t.Skipf("MongoDB is not available at %s: %v", config.URI, err)
+	}
+	db := client.Database(config.DatabaseName)
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestUpAndDown(t *testing.T) {
+	db := testDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	versions, err := Up(ctx, db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 5 {
+		t.Fatalf("Up to 5 applied %v", versions)
+	}
+	checkIndexes(t, db, authIndexes, true)
+	checkIndexes(t, db, liveInvoiceIndexes, false)
+	if pending, err := Pending(ctx, db); err != nil || pending != Latest()-5 {
+		t.Fatalf("%d migrations are pending (%v), want %d", pending, err, Latest()-5)
+	}
+	if versions, err := Up(ctx, db, 0); err != nil || len(versions) != Latest()-5 {
+		t.Fatalf("Up applied %v (%v), want the rest", versions, err)
+	}
+	if versions, err := Up(ctx, db, 0); err != nil || len(versions) != 0 {
+		t.Fatalf("a second Up applied %v (%v)", versions, err)
+	}
+	checkIndexes(t, db, liveInvoiceIndexes, true)
+
+	users := db.Collection("user")
+	if _, err := users.InsertOne(ctx, bson.M{"user_id": "1", "email": "wendy@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.InsertOne(ctx, bson.M{"user_id": "2", "email": "wendy@example.com"}); !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("a second user with the email gave %v, want a duplicate key error", err)
+	}
+	if _, err := users.InsertOne(ctx, bson.M{"user_id": "3"}); err != nil {
+		t.Fatalf("a second user without an email gave %v", err)
+	}
+
+	if previous, err := Previous(ctx, db); err != nil || previous != Latest()-1 {
+		t.Fatalf("Previous is %d (%v), want %d", previous, err, Latest()-1)
+	}
+	if versions, err := Down(ctx, db, 8); err != nil || len(versions) != Latest()-8 {
+		t.Fatalf("Down to 8 undid %v (%v)", versions, err)
+	}
+	checkIndexes(t, db, liveInvoiceIndexes, false)
+
+	// The backfills can't be undone
+	if versions, err := Down(ctx, db, 0); !errors.Is(err, ErrIrreversible) || len(versions) != 0 {
+		t.Fatalf("Down to 0 undid %v (%v), want ErrIrreversible", versions, err)
+	}
+	checkIndexes(t, db, authIndexes, true)
+	if versions, err := Up(ctx, db, 0); err != nil || len(versions) != Latest()-8 {
+		t.Fatalf("Up after Down applied %v (%v)", versions, err)
+	}
+	checkIndexes(t, db, liveInvoiceIndexes, true)
+}
+
+// indexInfo is what listIndexes reports about an index.
+type indexInfo struct {
+	Name               string `bson:"name"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+}
+
+// checkIndexes fails the test unless every index exists, or none does.
+func checkIndexes(t *testing.T, db *mongo.Database, indexes []collectionIndexes, exist bool) {
+	t.Helper()
+	ctx := context.Background()
+	for _, c := range indexes {
+		var found []indexInfo
+		cursor, err := db.Collection(c.collection).Indexes().List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cursor.All(ctx, &found); err != nil {
+			t.Fatal(err)
+		}
+		for _, model := range c.indexes {
+			var index *indexInfo
+			for i := range found {
+				if found[i].Name == *model.Options.Name {
+					index = &found[i]
+				}
+			}
+			if (index != nil) != exist {
+				t.Errorf("index %s of %s exists %v, want %v", *model.Options.Name, c.collection, index != nil, exist)
+				continue
+			}
+			if index != nil && (index.ExpireAfterSeconds != nil) != (model.Options.ExpireAfterSeconds != nil) {
+				t.Errorf("index %s of %s expires documents %v", index.Name, c.collection, index.ExpireAfterSeconds != nil)
+			}
+		}
+	}
+}
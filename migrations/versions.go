@@ -0,0 +1,442 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// all is every migration, oldest first. Append new ones with the next
+// version; never change or reorder one that has shipped.
+var all = []Migration{
+	{
+		Version:     1,
+		Description: "Unique indexes on user email, phone, user_id and oidc_subject",
+		Up:          createIndexes(userIndexes),
+		Down:        dropIndexes(userIndexes),
+	},
+	{
+		Version:     2,
+		Description: "Unique indexes on entity ids, and indexes for order and restaurant lookups",
+		Up:          createIndexes(entityIndexes),
+		Down:        dropIndexes(entityIndexes),
+	},
+	{
+		Version:     3,
+		Description: "Assign documents from before restaurants to a restaurant",
+		Up:          backfillRestaurantId,
+	},
+	{
+		Version:     4,
+		Description: "Remove the token fields users kept before sessions",
+		Up:          removeUserTokens,
+	},
+	{
+		Version:     5,
+		Description: "Indexes for the lookups of sessions, revocations, throttling and the other auth collections, and expiry of their short-lived documents",
+		Up:          createIndexes(authIndexes),
+		Down:        dropIndexes(authIndexes),
+	},
+	{
+		Version:     6,
+		Description: "Backfill order status from invoices, and table status",
+		Up:          backfillStatuses,
+	},
+	{
+		Version:     7,
+		Description: "Backfill version on documents from before it",
+		Up:          backfillVersions,
+	},
+	{
+		Version:     8,
+		Description: "Backfill deleted_at on documents from before soft deletion",
+		Up:          backfillDeletedAt,
+	},
+	{
+		Version:     9,
+		Description: "Unique order_id among live invoices",
+		Up:          createIndexes(liveInvoiceIndexes),
+		Down:        dropIndexes(liveInvoiceIndexes),
+	},
+}
+
+// collectionIndexes are indexes of one collection. Every index is named so
+// Down can drop it.
+type collectionIndexes struct {
+	collection string
+	indexes    []mongo.IndexModel
+}
+
+func unique(name string, field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetUnique(true),
+	}
+}
+
+// uniqueString is unique among the documents where field is set, so users
+// without a phone or an OIDC subject don't collide.
+func uniqueString(name string, field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetUnique(true).
+			SetPartialFilterExpression(bson.M{field: bson.M{"$type": "string"}}),
+	}
+}
+
+// uniqueLive is unique among the documents that are not deleted. It needs
+// deleted_at to be set, if only to null, on every live document; a missing
+// field is not of type null.
+func uniqueLive(name string, field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetUnique(true).
+			SetPartialFilterExpression(bson.M{"deleted_at": bson.M{"$type": "null"}}),
+	}
+}
+
+// expiring has MongoDB delete documents once after has passed since the time
+// in field.
+func expiring(name string, field string, after time.Duration) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(after.Seconds())),
+	}
+}
+
+func index(name string, keys ...string) mongo.IndexModel {
+	var fields bson.D
+	for _, key := range keys {
+		fields = append(fields, bson.E{Key: key, Value: 1})
+	}
+	return mongo.IndexModel{Keys: fields, Options: options.Index().SetName(name)}
+}
+
+var userIndexes = []collectionIndexes{
+	{"user", []mongo.IndexModel{
+		uniqueString("email_unique", "email"),
+		uniqueString("phone_unique", "phone"),
+		unique("user_id_unique", "user_id"),
+		uniqueString("oidc_subject_unique", "oidc_subject"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+}
+
+var entityIndexes = []collectionIndexes{
+	{"food", []mongo.IndexModel{
+		unique("food_id_unique", "food_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+	{"menu", []mongo.IndexModel{
+		unique("menu_id_unique", "menu_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+	{"table", []mongo.IndexModel{
+		unique("table_id_unique", "table_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+	{"order", []mongo.IndexModel{
+		unique("order_id_unique", "order_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+	{"orderItem", []mongo.IndexModel{
+		unique("order_item_id_unique", "order_item_id"),
+		index("order_id", "order_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+	{"invoice", []mongo.IndexModel{
+		unique("invoice_id_unique", "invoice_id"),
+		index("order_id", "order_id"),
+		index("restaurant_id", "restaurant_id"),
+	}},
+}
+
+// One invoice per order, so two concurrent CreateInvoice calls can't both
+// bill it. Deleted invoices are left out, since an order can be billed again
+// once its invoice is deleted.
+var liveInvoiceIndexes = []collectionIndexes{
+	{"invoice", []mongo.IndexModel{
+		uniqueLive("order_id_live_unique", "order_id"),
+	}},
+}
+
+// The lookups made on every request, login or token check, as the SQLite
+// backend indexes them. What only matters until it expires is deleted then,
+// so that nobody can grow the collections without bound, e.g. with failed
+// logins for made up emails.
+var authIndexes = []collectionIndexes{
+	{"revocation", []mongo.IndexModel{
+		index("token_id", "token_id"),
+		index("user_id_token_id", "user_id", "token_id"),
+		expiring("expires_at_ttl", "expires_at", 0),
+	}},
+	{"session", []mongo.IndexModel{
+		index("session_id", "session_id"),
+		index("user_id", "user_id"),
+		expiring("expires_at_ttl", "expires_at", 0),
+	}},
+	// Attempts count for an hour and locks last at most an hour after the
+	// last failure, so two hours on there is nothing left to remember
+	{"loginAttempt", []mongo.IndexModel{
+		index("key", "key"),
+		expiring("last_failure_ttl", "last_failure", 2*time.Hour),
+	}},
+	{"mfaChallenge", []mongo.IndexModel{
+		index("token_id", "token_id"),
+		expiring("expires_at_ttl", "expires_at", 0),
+	}},
+	{"oidcLogin", []mongo.IndexModel{
+		index("state_hash", "state_hash"),
+		expiring("expires_at_ttl", "expires_at", 0),
+	}},
+	{"passwordReset", []mongo.IndexModel{
+		index("user_id", "user_id"),
+		expiring("expires_at_ttl", "expires_at", 0),
+	}},
+	{"apiKey", []mongo.IndexModel{
+		index("api_key_id", "api_key_id"),
+	}},
+	{"device", []mongo.IndexModel{
+		index("device_id", "device_id"),
+	}},
+}
+
+func createIndexes(indexes []collectionIndexes) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, c := range indexes {
+			if _, err := db.Collection(c.collection).Indexes().CreateMany(ctx, c.indexes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func dropIndexes(indexes []collectionIndexes) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, c := range indexes {
+			for _, model := range c.indexes {
+				_, err := db.Collection(c.collection).Indexes().DropOne(ctx, *model.Options.Name)
+				if err != nil && !isIndexNotFound(err) {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && (commandErr.Code == 27 || commandErr.Name == "IndexNotFound")
+}
+
+// restaurantCollections are the collections whose documents belong to one
+// restaurant. Users are handled apart since admins may belong to none.
+var restaurantCollections = []string{"food", "menu", "table", "order", "orderItem", "invoice", "device", "apiKey"}
+
+var noRestaurant = bson.M{"$or": bson.A{
+	bson.M{"restaurant_id": bson.M{"$exists": false}},
+	bson.M{"restaurant_id": ""},
+	bson.M{"restaurant_id": nil},
+}}
+
+// backfillRestaurantId gives documents written before there were restaurants
+// to the only restaurant, creating one when there is none. Admins without a
+// restaurant stay cross-site. With several restaurants there is no telling
+// where the documents belong, so they have to be assigned by hand.
+func backfillRestaurantId(ctx context.Context, db *mongo.Database) error {
+	legacyUsers := bson.M{"$and": bson.A{noRestaurant, bson.M{"role": bson.M{"$ne": "ADMIN"}}}}
+
+	legacy, err := countLegacy(ctx, db, legacyUsers)
+	if err != nil || legacy == 0 {
+		return err
+	}
+
+	restaurantId, err := legacyRestaurant(ctx, db)
+	if err != nil {
+		return err
+	}
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "restaurant_id", Value: restaurantId}}}}
+
+	for _, name := range restaurantCollections {
+		result, err := db.Collection(name).UpdateMany(ctx, noRestaurant, set)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Assigned %d %s documents to restaurant %s", result.ModifiedCount, name, restaurantId)
+		}
+	}
+	result, err := db.Collection("user").UpdateMany(ctx, legacyUsers, set)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Assigned %d users to restaurant %s", result.ModifiedCount, restaurantId)
+	}
+	return nil
+}
+
+func countLegacy(ctx context.Context, db *mongo.Database, legacyUsers bson.M) (int64, error) {
+	total, err := db.Collection("user").CountDocuments(ctx, legacyUsers)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range restaurantCollections {
+		count, err := db.Collection(name).CountDocuments(ctx, noRestaurant)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+func legacyRestaurant(ctx context.Context, db *mongo.Database) (string, error) {
+	restaurants := db.Collection("restaurant")
+
+	count, err := restaurants.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return "", err
+	}
+	if count > 1 {
+		return "", errors.New("there are documents without a restaurant and several restaurants to choose from; set their restaurant_id by hand, then run the migration again")
+	}
+
+	if count == 1 {
+		var restaurant struct {
+			Restaurant_id string `bson:"restaurant_id"`
+		}
+		err := restaurants.FindOne(ctx, bson.M{}).Decode(&restaurant)
+		return restaurant.Restaurant_id, err
+	}
+
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	id := primitive.NewObjectID()
+	_, err = restaurants.InsertOne(ctx, bson.M{
+		"_id":           id,
+		"name":          "Main restaurant",
+		"address":       nil,
+		"created_at":    now,
+		"updated_at":    now,
+		"restaurant_id": id.Hex(),
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created restaurant %s for documents without one", id.Hex())
+	return id.Hex(), nil
+}
+
+// removeUserTokens drops the tokens users carried before logins became
+// sessions. Nothing reads them, but they were still valid credentials at rest.
+func removeUserTokens(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("user").UpdateMany(
+		ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"token": bson.M{"$exists": true}},
+			bson.M{"refresh_token": bson.M{"$exists": true}},
+			bson.M{"token_family": bson.M{"$exists": true}},
+		}},
+		bson.D{{Key: "$unset", Value: bson.D{
+			{Key: "token", Value: ""},
+			{Key: "refresh_token", Value: ""},
+			{Key: "token_family", Value: ""},
+		}}},
+	)
+	return err
+}
+
+// backfillStatuses gives orders the status their invoice implies and marks
+// tables without a status free, since nothing tracked occupancy before.
+func backfillStatuses(ctx context.Context, db *mongo.Database) error {
+	noStatus := func(field string) bson.M {
+		return bson.M{"$or": bson.A{bson.M{field: bson.M{"$exists": false}}, bson.M{field: ""}}}
+	}
+
+	cursor, err := db.Collection("invoice").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var invoice struct {
+			Order_id       string  `bson:"order_id"`
+			Payment_status *string `bson:"payment_status"`
+		}
+		if err := cursor.Decode(&invoice); err != nil {
+			return err
+		}
+		status := "BILLED"
+		if invoice.Payment_status != nil && *invoice.Payment_status == "PAID" {
+			status = "PAID"
+		}
+		filter := noStatus("order_status")
+		filter["order_id"] = invoice.Order_id
+		_, err := db.Collection("order").UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "order_status", Value: status}}}})
+		if err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Collection("order").UpdateMany(ctx, noStatus("order_status"), bson.D{{Key: "$set", Value: bson.D{{Key: "order_status", Value: "OPEN"}}}})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("table").UpdateMany(ctx, noStatus("table_status"), bson.D{{Key: "$set", Value: bson.D{{Key: "table_status", Value: "FREE"}}}})
+	return err
+}
+
+// versionedCollections are the collections whose documents carry a version.
+var versionedCollections = []string{"food", "menu", "table", "order", "orderItem", "invoice", "user", "restaurant"}
+
+// backfillVersions starts documents written before versions at version 1.
+func backfillVersions(ctx context.Context, db *mongo.Database) error {
+	for _, name := range versionedCollections {
+		result, err := db.Collection(name).UpdateMany(
+			ctx,
+			bson.M{"version": bson.M{"$exists": false}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "version", Value: 1}}}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Set the version of %d %s documents", result.ModifiedCount, name)
+		}
+	}
+	return nil
+}
+
+// softDeletedCollections are the collections whose documents can be soft
+// deleted.
+var softDeletedCollections = []string{"food", "menu", "table", "order", "orderItem", "invoice", "user"}
+
+// backfillDeletedAt marks documents written before soft deletion as live,
+// which the partial indexes of later migrations rely on.
+func backfillDeletedAt(ctx context.Context, db *mongo.Database) error {
+	for _, name := range softDeletedCollections {
+		result, err := db.Collection(name).UpdateMany(
+			ctx,
+			bson.M{"deleted_at": bson.M{"$exists": false}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "deleted_at", Value: nil}, {Key: "deleted_by", Value: nil}}}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Marked %d %s documents as not deleted", result.ModifiedCount, name)
+		}
+	}
+	return nil
+}
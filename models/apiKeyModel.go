@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ApiKey authenticates a machine client. Only a hash of the secret is stored;
+// Scopes narrow what the key's role may do, e.g. "invoice:read".
+type ApiKey struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Name				*string					`json:"name" validate:"required,min=2,max=100"`
+	Role				*string					`json:"role" validate:"required,eq=ADMIN|eq=MANAGER|eq=WAITER|eq=KITCHEN|eq=CASHIER"`
+	Scopes				[]string				`json:"scopes" validate:"required,min=1"`
+	Restaurant_id		string					`json:"restaurant_id"`
+	Key_hash			string					`json:"-"`
+	Created_by			string					`json:"created_by"`
+	Last_used_at		*time.Time				`json:"last_used_at"`
+	Revoked_at			*time.Time				`json:"revoked_at"`
+	Created_at			time.Time				`json:"created_at"`
+	Updated_at			time.Time				`json:"updated_at"`
+	Api_key_id			string					`json:"api_key_id"`
+}
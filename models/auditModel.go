@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records one POST, PATCH or DELETE call: who made it, on which
+// route and entity, and what it changed.
+type AuditEntry struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	User_id				string					`json:"user_id"`
+	Role				string					`json:"role"`
+	Restaurant_id		string					`json:"restaurant_id"`
+	Method				string					`json:"method"`
+	Route				string					`json:"route"`
+	Path				string					`json:"path"`
+	Entity				string					`json:"entity"`
+	Entity_id			string					`json:"entity_id"`
+	Status				int						`json:"status"`
+	Changes				[]AuditChange			`json:"changes"`
+	Ip_address			string					`json:"ip_address"`
+	Created_at			time.Time				`json:"created_at"`
+	Audit_id			string					`json:"audit_id"`
+}
+
+// AuditChange is one top-level field that differs between the entity before
+// and after the call. Before is nil for created entities.
+type AuditChange struct{
+	Field				string					`json:"field"`
+	Before				interface{}				`json:"before"`
+	After				interface{}				`json:"after"`
+}
\ No newline at end of file
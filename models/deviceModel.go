@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Device is a shared POS terminal. Staff log in on it with their PIN; only
+// one of them is active at a time and the session locks when left idle.
+type Device struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Name				*string					`json:"name" validate:"required,min=2,max=100"`
+	Restaurant_id		string					`json:"restaurant_id"`
+	Secret_hash			string					`json:"-"`
+	Registered_by		string					`json:"registered_by"`
+	Active_user_id		*string					`json:"active_user_id"`
+	Active_token_id		*string					`json:"-"`
+	Last_activity_at	*time.Time				`json:"last_activity_at"`
+	Revoked_at			*time.Time				`json:"revoked_at"`
+	Created_at			time.Time				`json:"created_at"`
+	Updated_at			time.Time				`json:"updated_at"`
+	Device_id			string					`json:"device_id"`
+}
@@ -13,6 +13,10 @@ type Food struct{
 	Food_image    	*string           		`json:"food_image" validate:"required"`
 	Created_at    	time.Time         		`json:"created_at"`
 	Updated_at    	time.Time         		`json:"updated_at"`
+	Version    	int64	         		`json:"version"`
+	Deleted_at    	*time.Time	         		`json:"deleted_at"`
+	Deleted_by    	*string	         		`json:"deleted_by"`
 	Food_id       	string           		`json:"food_id"`
 	Menu_id       	*string           		`json:"menu_id" validate:"required"`
+	Restaurant_id		string					`json:"restaurant_id"`
 }
\ No newline at end of file
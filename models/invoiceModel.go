@@ -15,4 +15,8 @@ type Invoice struct{
 	Payment_due_date   	time.Time  				`json:"payment_due_date"`
 	Created_at         	time.Time   			`json:"created_at"`
 	Updated_at         	time.Time    			`json:"updated_at"`
+	Version         	int64	    			`json:"version"`
+	Deleted_at         	*time.Time	    			`json:"deleted_at"`
+	Deleted_by         	*string	    			`json:"deleted_by"`
+	Restaurant_id		string					`json:"restaurant_id"`
 }
\ No newline at end of file
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LoginAttempt counts recent failed logins for one account or one client.
+type LoginAttempt struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Key					string					`json:"key"`
+	Failures			int						`json:"failures"`
+	Last_failure		time.Time				`json:"last_failure"`
+	Locked_until		*time.Time				`json:"locked_until"`
+}
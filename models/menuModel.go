@@ -14,5 +14,9 @@ type Menu struct{
 	End_Date		*time.Time 				`json:"end_date"`
 	Created_at		time.Time 				`json:"created_at"`
 	Updated_at		time.Time 				`json:"updated_at"`
+	Version		int64	 				`json:"version"`
+	Deleted_at		*time.Time	 				`json:"deleted_at"`
+	Deleted_by		*string	 				`json:"deleted_by"`
 	Menu_id			string  				`json:"food_id"`
+	Restaurant_id	string					`json:"restaurant_id"`
 }
\ No newline at end of file
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MfaChallenge is the second factor step of a login, from the password step
+// until a valid code. The mfa token it belongs to can be used once.
+type MfaChallenge struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Token_id			string					`json:"token_id"`
+	User_id				string					`json:"user_id"`
+	Expires_at			time.Time				`json:"expires_at"`
+	Created_at			time.Time				`json:"created_at"`
+}
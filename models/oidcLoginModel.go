@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OidcLogin is an identity provider login in progress, from the redirect to
+// the provider until its callback. It can be completed once.
+type OidcLogin struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	State_hash			string					`json:"-"`
+	Nonce				string					`json:"-"`
+	Code_verifier		string					`json:"-"`
+	Expires_at			time.Time				`json:"expires_at"`
+	Created_at			time.Time				`json:"created_at"`
+	Oidc_login_id		string					`json:"oidc_login_id"`
+}
\ No newline at end of file
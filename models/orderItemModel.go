@@ -13,8 +13,12 @@ type OrderItem struct{
 	Unit_price			*float64				`json:"unit_price" validate:"required"`
 	Created_at			time.Time  				`json:"created_at"`
 	Updated_at			time.Time				`json:"updated_at"`
-	Food_id				*string					`json:"food_id" validate:"requried"`
+	Version			int64					`json:"version"`
+	Deleted_at			*time.Time					`json:"deleted_at"`
+	Deleted_by			*string					`json:"deleted_by"`
+	Food_id				*string					`json:"food_id" validate:"required"`
 	Order_item_id		string					`json:"order_item_id"`
 	Order_id			string					`json:"order_id" validate:"required"`
+	Restaurant_id		string					`json:"restaurant_id"`
 
 }
\ No newline at end of file
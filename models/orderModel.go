@@ -6,12 +6,24 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// An order is open while guests are served, billed once it has an invoice and
+// paid when the invoice is.
+const (
+	OrderOpen   = "OPEN"
+	OrderBilled = "BILLED"
+	OrderPaid   = "PAID"
+)
 
 type Order struct{
 	ID					primitive.ObjectID 	`bson:"_id"`
 	Order_Date			time.Time			`json:"order_date" validate:"required"`
 	Created_at			time.Time			`json:"created_at"`
 	Updated_at			time.Time			`json:"updated_at"`
+	Version			int64				`json:"version"`
+	Deleted_at			*time.Time				`json:"deleted_at"`
+	Deleted_by			*string				`json:"deleted_by"`
 	Order_id			string				`json:"order_id"`
-	Table_id			*string				`json:"table_id" validate:"requred"`
+	Table_id			*string				`json:"table_id" validate:"required"`
+	Order_status		string				`json:"order_status"`
+	Restaurant_id		string				`json:"restaurant_id"`
 }
\ No newline at end of file
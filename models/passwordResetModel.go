@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PasswordReset struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	User_id				string					`json:"user_id"`
+	Code_hash			string					`json:"-"`
+	Attempts			int						`json:"attempts"`
+	Expires_at			time.Time				`json:"expires_at"`
+	Used_at				*time.Time				`json:"used_at"`
+	Created_at			time.Time				`json:"created_at"`
+	Password_reset_id	string					`json:"password_reset_id"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Restaurant is one site. Every other document carries the Restaurant_id of
+// the site it belongs to.
+type Restaurant struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Name				*string					`json:"name" validate:"required,min=2,max=100"`
+	Address				*string					`json:"address"`
+	Created_at			time.Time				`json:"created_at"`
+	Updated_at			time.Time				`json:"updated_at"`
+	Version			int64					`json:"version"`
+	Restaurant_id		string					`json:"restaurant_id"`
+}
\ No newline at end of file
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Revocation either blocks one token (Token_id set) or every token issued to
+// a user before Revoked_at (Token_id empty).
+type Revocation struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Token_id			string					`json:"token_id"`
+	User_id				string					`json:"user_id"`
+	Revoked_at			time.Time				`json:"revoked_at"`
+	Expires_at			time.Time				`json:"expires_at"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is one login on one device. Its Session_id is the family of every
+// token issued for it; only the refresh token with Refresh_token_id can be
+// exchanged next.
+type Session struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	User_id				string					`json:"user_id"`
+	Restaurant_id		string					`json:"restaurant_id"`
+	Device_name			string					`json:"device_name"`
+	Ip_address			string					`json:"ip_address"`
+	User_agent			string					`json:"user_agent"`
+	Refresh_token_id	string					`json:"-"`
+	Created_at			time.Time				`json:"created_at"`
+	Last_seen_at		time.Time				`json:"last_seen_at"`
+	Expires_at			time.Time				`json:"expires_at"`
+	Revoked_at			*time.Time				`json:"revoked_at"`
+	Session_id			string					`json:"session_id"`
+}
\ No newline at end of file
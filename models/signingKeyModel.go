@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SigningKey is a private key used to sign tokens. Keys are published from
+// creation until Retires_at and used for signing once Activates_at has passed.
+type SigningKey struct{
+	ID					primitive.ObjectID		`bson:"_id"`
+	Kid					string					`json:"kid"`
+	Algorithm			string					`json:"algorithm"`
+	// The PKCS #8 PEM of keys stored before they were encrypted; it is
+	// encrypted the next time the keys are loaded
+	Private_key			string					`json:"-"`
+	// The PKCS #8 DER, sealed with the key encryption key
+	Encrypted_private_key	string				`json:"-"`
+	Created_at			time.Time				`json:"created_at"`
+	Activates_at		time.Time				`json:"activates_at"`
+	Retires_at			time.Time				`json:"retires_at"`
+}
@@ -6,11 +6,22 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// A table is occupied from its first order until every order on it is paid.
+const (
+	TableFree     = "FREE"
+	TableOccupied = "OCCUPIED"
+)
+
 type Table struct{
 	ID						primitive.ObjectID  	`bson:"_id"`
-	Number_of_guest			*int					`json:"number_of_guests" validate:"requred"`
+	Number_of_guest			*int					`json:"number_of_guests" validate:"required"`
 	Table_number			*int					`json:"table_number" validate:"required"`
 	Created_at				time.Time				`json:"created_at"`
 	Updated_at				time.Time				`json:"updated_at"`
+	Version				int64					`json:"version"`
+	Deleted_at				*time.Time					`json:"deleted_at"`
+	Deleted_by				*string					`json:"deleted_by"`
+	Table_status			string					`json:"table_status" validate:"omitempty,eq=FREE|eq=OCCUPIED"`
 	Table_id				string					`json:"table_id"`
+	Restaurant_id			string					`json:"restaurant_id"`
 }
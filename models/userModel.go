@@ -6,6 +6,14 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	RoleAdmin   = "ADMIN"
+	RoleManager = "MANAGER"
+	RoleWaiter  = "WAITER"
+	RoleKitchen = "KITCHEN"
+	RoleCashier = "CASHIER"
+)
+
 type User struct{
 	ID						primitive.ObjectID			`bson:"_id"`
 	First_name					*string					`json:"first_name" validate:"required,min=2,max=100"`
@@ -14,9 +22,22 @@ type User struct{
 	Email						*string					`json:"email" validate:"email,required"`
 	Avatar						*string					`json:"avatar"`
 	Phone						*string					`json:"phone" validate:"required"`
-	Token						*string					`json:"token"`
-	Refresh_Token				*string					`json:"refresh_token"`
+	Role						*string					`json:"role" validate:"omitempty,eq=ADMIN|eq=MANAGER|eq=WAITER|eq=KITCHEN|eq=CASHIER"`
+	Totp_secret					*string					`json:"-"`
+	Totp_enabled				bool					`json:"totp_enabled"`
+	Totp_last_step				int64					`json:"-"`
+	Recovery_codes				[]string				`json:"-"`
+	Deactivated_at				*time.Time				`json:"deactivated_at"`
+	Pin_hash					*string					`json:"-"`
+	// Set once too many wrong PINs were entered; cleared by logging in with
+	// the password
+	Pin_locked_at				*time.Time				`json:"pin_locked_at"`
+	Restaurant_id				string					`json:"restaurant_id"`
+	Oidc_subject				*string					`json:"-"`
 	Created_at					time.Time				`json:"created_at"`
 	Updated_at					time.Time				`json:"updated_at"`
+	Version					int64					`json:"version"`
+	Deleted_at					*time.Time					`json:"deleted_at"`
+	Deleted_by					*string					`json:"deleted_by"`
 	User_id						string					`json:"user_id"`
 }		
\ No newline at end of file
@@ -0,0 +1,335 @@
+package repository
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The in-memory and SQLite collections hold documents as Mongo would and
+// query them in Go, with what follows. Filters, updates and documents are
+// normalised with toDocument first, so values compare as the same types.
+
+// matches reports whether doc satisfies filter. Fields holding arrays or
+// documents are compared whole, not searched into.
+func matches(doc bson.M, filter bson.M) bool {
+	for field, condition := range filter {
+		value := doc[field]
+		operators, isOperators := condition.(bson.M)
+		if !isOperators || !hasOperators(operators) {
+			if !valuesEqual(value, condition) {
+				return false
+			}
+			continue
+		}
+		for operator, operand := range operators {
+			if !matchesOperator(value, operator, operand) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasOperators(condition bson.M) bool {
+	for key := range condition {
+		if len(key) > 0 && key[0] == '$' {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesOperator(value interface{}, operator string, operand interface{}) bool {
+	switch operator {
+	case "$ne":
+		return !valuesEqual(value, operand)
+	case "$in":
+		candidates, _ := operand.(primitive.A)
+		for _, candidate := range candidates {
+			if valuesEqual(value, candidate) {
+				return true
+			}
+		}
+		return false
+	case "$gt", "$gte", "$lt", "$lte":
+		order, comparable := compareValues(value, operand)
+		if !comparable {
+			return false
+		}
+		switch operator {
+		case "$gt":
+			return order > 0
+		case "$gte":
+			return order >= 0
+		case "$lt":
+			return order < 0
+		}
+		return order <= 0
+	}
+	// An operator the collections don't know matches nothing, rather than
+	// everything
+	return false
+}
+
+// valuesEqual compares like Mongo's equality: nil equals a missing field,
+// and numbers are equal whatever their type.
+func valuesEqual(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two values of the same kind, reporting false for
+// values of different kinds, which Mongo's range operators never match.
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(x, y), true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(x, y), true
+	case primitive.DateTime:
+		y, ok := b.(primitive.DateTime)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(float64(x), float64(y)), true
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(x.Hex(), y.Hex()), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(fmt.Sprint(x), fmt.Sprint(y)), true
+	}
+	return 0, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortRank puts values of different kinds in Mongo's order, missing and nil
+// first.
+func sortRank(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+	if _, ok := toFloat(value); ok {
+		return 1
+	}
+	switch value.(type) {
+	case string:
+		return 2
+	case primitive.ObjectID:
+		return 3
+	case bool:
+		return 4
+	case primitive.DateTime:
+		return 5
+	}
+	return 6
+}
+
+// sortDocuments orders docs by the fields of order, keeping the order they
+// came in for ties.
+func sortDocuments(docs []bson.M, order bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range order {
+			a, b := docs[i][field.Key], docs[j][field.Key]
+			result := compareFloats(float64(sortRank(a)), float64(sortRank(b)))
+			if result == 0 {
+				result, _ = compareValues(a, b)
+			}
+			if direction, _ := toFloat(field.Value); direction < 0 {
+				result = -result
+			}
+			if result != 0 {
+				return result < 0
+			}
+		}
+		return false
+	})
+}
+
+// page applies the skip and limit of opts to docs.
+func (opts FindOptions) page(docs []bson.M) []bson.M {
+	if opts.Skip > 0 {
+		if opts.Skip >= int64(len(docs)) {
+			return nil
+		}
+		docs = docs[opts.Skip:]
+	}
+	if opts.Limit > 0 && opts.Limit < int64(len(docs)) {
+		docs = docs[:opts.Limit]
+	}
+	return docs
+}
+
+// applyUpdate changes doc in place by the operators of update. $setOnInsert
+// only applies when inserting.
+func applyUpdate(doc bson.M, update bson.D, inserting bool) error {
+	for _, operation := range update {
+		fields, err := toDocument(operation.Value)
+		if err != nil {
+			return err
+		}
+		switch operation.Key {
+		case "$set":
+			for field, value := range fields {
+				doc[field] = value
+			}
+		case "$setOnInsert":
+			if inserting {
+				for field, value := range fields {
+					doc[field] = value
+				}
+			}
+		case "$inc":
+			for field, value := range fields {
+				sum, err := addNumbers(doc[field], value)
+				if err != nil {
+					return fmt.Errorf("cannot $inc %s: %w", field, err)
+				}
+				doc[field] = sum
+			}
+		default:
+			return fmt.Errorf("unsupported update operator %s", operation.Key)
+		}
+	}
+	return nil
+}
+
+// addNumbers adds to a field, which counts as 0 when missing. Integers stay
+// integers.
+func addNumbers(current interface{}, increment interface{}) (interface{}, error) {
+	if current == nil {
+		current = int32(0)
+	}
+	a, aIsNumber := toFloat(current)
+	b, bIsNumber := toFloat(increment)
+	if !aIsNumber || !bIsNumber {
+		return nil, fmt.Errorf("%v is not a number", current)
+	}
+	_, aIsFloat := current.(float64)
+	_, bIsFloat := increment.(float64)
+	if aIsFloat || bIsFloat {
+		return a + b, nil
+	}
+	return int64(a) + int64(b), nil
+}
+
+// upsertDocument is the document an upsert inserts: the filter's plain
+// values and the update.
+func upsertDocument(filter bson.M, update bson.D) (bson.M, error) {
+	doc := bson.M{}
+	for field, condition := range filter {
+		if operators, isOperators := condition.(bson.M); isOperators && hasOperators(operators) {
+			continue
+		}
+		doc[field] = condition
+	}
+	if err := applyUpdate(doc, update, true); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// documentKey is what a collection keys doc by: its idField, with an _id
+// generated as Mongo would when it has none.
+func documentKey(doc bson.M, idField string) (string, error) {
+	switch id := doc[idField].(type) {
+	case string:
+		if id != "" {
+			return id, nil
+		}
+	case primitive.ObjectID:
+		return id.Hex(), nil
+	case nil:
+		if idField == "_id" {
+			generated := primitive.NewObjectID()
+			doc["_id"] = generated
+			return generated.Hex(), nil
+		}
+	}
+	return "", fmt.Errorf("cannot store a document without a %s", idField)
+}
+
+// decodeDocument decodes doc into result, a pointer.
+func decodeDocument(doc bson.M, result interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+// decodeDocuments decodes docs into results, a pointer to a slice.
+func decodeDocuments(docs []bson.M, results interface{}) error {
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("results must be a pointer to a slice, not %T", results)
+	}
+	decoded := reflect.MakeSlice(slice.Elem().Type(), 0, len(docs))
+	for _, doc := range docs {
+		element := reflect.New(slice.Elem().Type().Elem())
+		if err := decodeDocument(doc, element.Interface()); err != nil {
+			return err
+		}
+		decoded = reflect.Append(decoded, element.Elem())
+	}
+	slice.Elem().Set(decoded)
+	return nil
+}
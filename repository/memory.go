@@ -0,0 +1,964 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"restaurant_app/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// NewMemory keeps everything in process, for running without a database.
+// Nothing survives a restart.
+func NewMemory() *Repositories {
+	foods := newMemoryStore[models.Food]("food_id")
+	menus := newMemoryStore[models.Menu]("menu_id")
+	tables := newMemoryStore[models.Table]("table_id")
+	orders := newMemoryStore[models.Order]("order_id")
+	orderItems := newMemoryStore[models.OrderItem]("order_item_id")
+	invoices := newMemoryStore[models.Invoice]("invoice_id", memoryUnique{field: "order_id", live: true})
+	users := newMemoryStore[models.User]("user_id", memoryUnique{field: "email"}, memoryUnique{field: "phone"}, memoryUnique{field: "oidc_subject"})
+
+	return &Repositories{
+		Transactions: memoryTransactions{},
+		Foods:        memoryFoods{foods},
+		Menus:        menus,
+		Tables:       tables,
+		Orders:       memoryOrders{orders},
+		OrderItems: memoryOrderItems{
+			memoryStore: orderItems,
+			foods:       foods,
+			orders:      orders,
+			tables:      tables,
+		},
+		Invoices: invoices,
+		Users:    memoryUsers{users},
+		Collections: &memoryCollections{collections: map[string]*memoryCollection{
+			"food":      foods.memoryCollection,
+			"menu":      menus.memoryCollection,
+			"table":     tables.memoryCollection,
+			"order":     orders.memoryCollection,
+			"orderItem": orderItems.memoryCollection,
+			"invoice":   invoices.memoryCollection,
+			"user":      users.memoryCollection,
+		}},
+	}
+}
+
+// memoryTransaction remembers how to undo what was written in it. It rolls
+// back only its own writes, but gives no isolation: other requests see them
+// before the commit.
+type memoryTransaction struct {
+	mu   sync.Mutex
+	undo []func()
+}
+
+type memoryTransactionKey struct{}
+
+type memoryTransactions struct{}
+
+func (memoryTransactions) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(memoryTransactionKey{}) != nil {
+		return fn(ctx)
+	}
+
+	transaction := &memoryTransaction{}
+	err := fn(context.WithValue(ctx, memoryTransactionKey{}, transaction))
+	if err != nil {
+		transaction.mu.Lock()
+		defer transaction.mu.Unlock()
+		for i := len(transaction.undo) - 1; i >= 0; i-- {
+			transaction.undo[i]()
+		}
+	}
+	return err
+}
+
+// memoryCollection keeps documents as Mongo would hold them, by their
+// idField.
+type memoryCollection struct {
+	idField string
+
+	mu   sync.RWMutex
+	ids  []string // in insertion order
+	docs map[string]bson.M
+}
+
+func newMemoryCollection(idField string) *memoryCollection {
+	return &memoryCollection{idField: idField, docs: map[string]bson.M{}}
+}
+
+// memoryStore keeps entities as the documents Mongo would hold, so fields
+// are set by their bson names exactly as in the Mongo implementation.
+type memoryStore[T any] struct {
+	*memoryCollection
+	unique []memoryUnique
+}
+
+// memoryUnique is a field that no two entities can share a string value of,
+// as the unique indexes of the migrations keep it in Mongo. With live, only
+// entities that are not deleted count.
+type memoryUnique struct {
+	field string
+	live  bool
+}
+
+func newMemoryStore[T any](idField string, unique ...memoryUnique) *memoryStore[T] {
+	return &memoryStore[T]{newMemoryCollection(idField), unique}
+}
+
+// toDocument turns a value into a document that shares no memory with it.
+func toDocument(value interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+func fromDocument[T any](doc bson.M) (T, error) {
+	var entity T
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return entity, err
+	}
+	err = bson.Unmarshal(raw, &entity)
+	return entity, err
+}
+
+func inRestaurant(doc bson.M, restaurantId string) bool {
+	return restaurantId == "" || doc["restaurant_id"] == restaurantId
+}
+
+func isDeleted(doc bson.M) bool {
+	return doc["deleted_at"] != nil
+}
+
+// find returns the entities of the restaurant that match and are not
+// deleted, in insertion order.
+func (s *memoryStore[T]) find(restaurantId string, match func(T) bool) ([]T, error) {
+	return s.scan(restaurantId, false, match)
+}
+
+func (s *memoryStore[T]) scan(restaurantId string, withDeleted bool, match func(T) bool) ([]T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entities := []T{}
+	for _, id := range s.ids {
+		doc := s.docs[id]
+		if !inRestaurant(doc, restaurantId) || (isDeleted(doc) && !withDeleted) {
+			continue
+		}
+		entity, err := fromDocument[T](doc)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match(entity) {
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+func (s *memoryStore[T]) findOne(match func(T) bool) (T, error) {
+	entities, err := s.find("", match)
+	return first(entities, err)
+}
+
+func first[T any](entities []T, err error) (T, error) {
+	if err != nil || len(entities) == 0 {
+		var entity T
+		if err == nil {
+			err = ErrNotFound
+		}
+		return entity, err
+	}
+	return entities[0], nil
+}
+
+// modify lets change edit the stored document of id in place, reporting
+// whether it did. Edits bump the version like any other update.
+func (s *memoryStore[T]) modify(ctx context.Context, id string, change func(doc bson.M) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, found := s.docs[id]
+	if !found {
+		return false, nil
+	}
+	updated, err := toDocument(doc)
+	if err != nil {
+		return false, err
+	}
+	if !change(updated) {
+		return false, nil
+	}
+	updated["version"] = versionOf(doc) + 1
+	return true, s.store(ctx, id, updated)
+}
+
+// store normalises doc, checks it still decodes into T and saves it. Within
+// a transaction it records how to put back what was there. The caller holds
+// s.mu.
+func (s *memoryStore[T]) store(ctx context.Context, id string, doc bson.M) error {
+	normalised, err := toDocument(doc)
+	if err != nil {
+		return err
+	}
+	if _, err := fromDocument[T](normalised); err != nil {
+		return err
+	}
+	if s.repeatsUnique(id, normalised) {
+		return ErrDuplicate
+	}
+	s.put(ctx, id, normalised)
+	return nil
+}
+
+// repeatsUnique reports whether doc, to be saved as the document of id,
+// has the value of a unique field that another entity has. The caller holds
+// s.mu.
+func (s *memoryStore[T]) repeatsUnique(id string, doc bson.M) bool {
+	for _, unique := range s.unique {
+		value, isString := doc[unique.field].(string)
+		if !isString || (unique.live && isDeleted(doc)) {
+			continue
+		}
+		for otherId, other := range s.docs {
+			if otherId != id && other[unique.field] == value && !(unique.live && isDeleted(other)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// put saves doc, already normalised, as the document of id. The caller holds
+// s.mu.
+func (s *memoryCollection) put(ctx context.Context, id string, doc bson.M) {
+	_, found := s.docs[id]
+	s.journal(ctx, id)
+
+	if !found {
+		s.ids = append(s.ids, id)
+	}
+	s.docs[id] = doc
+}
+
+// remove deletes the document of id. The caller holds s.mu.
+func (s *memoryCollection) remove(ctx context.Context, id string) {
+	s.journal(ctx, id)
+	delete(s.docs, id)
+	s.dropId(id)
+}
+
+// journal records, within a transaction, how to put back the document of id
+// before it is written. The caller holds s.mu.
+func (s *memoryCollection) journal(ctx context.Context, id string) {
+	transaction, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction)
+	if !ok {
+		return
+	}
+	previous, found := s.docs[id]
+	transaction.mu.Lock()
+	transaction.undo = append(transaction.undo, func() { s.restore(id, previous, found) })
+	transaction.mu.Unlock()
+}
+
+// restore puts back a document as it was before a transaction wrote it.
+// Stored documents are never changed in place, so previous is intact.
+func (s *memoryCollection) restore(id string, previous bson.M, existed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existed {
+		if _, found := s.docs[id]; !found {
+			s.ids = append(s.ids, id)
+		}
+		s.docs[id] = previous
+		return
+	}
+	delete(s.docs, id)
+	s.dropId(id)
+}
+
+func (s *memoryCollection) dropId(id string) {
+	for i, storedId := range s.ids {
+		if storedId == id {
+			s.ids = append(s.ids[:i:i], s.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+// memoryCollections opens a collection the first time it is asked for.
+type memoryCollections struct {
+	mu          sync.Mutex
+	collections map[string]*memoryCollection
+}
+
+func (c *memoryCollections) Collection(name string) Collection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collection, found := c.collections[name]
+	if !found {
+		collection = newMemoryCollection("_id")
+		c.collections[name] = collection
+	}
+	return collection
+}
+
+func (s *memoryCollection) Insert(ctx context.Context, document interface{}) error {
+	doc, err := toDocument(document)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := documentKey(doc, s.idField)
+	if err != nil {
+		return err
+	}
+	if _, found := s.docs[id]; found {
+		return ErrDuplicate
+	}
+	s.put(ctx, id, doc)
+	return nil
+}
+
+// matching returns the ids of the documents matching filter, in insertion
+// order. The caller holds s.mu.
+func (s *memoryCollection) matching(filter bson.M) ([]string, error) {
+	normalised, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, id := range s.ids {
+		if matches(s.docs[id], normalised) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryCollection) FindOne(ctx context.Context, filter bson.M, result interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.matching(filter)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrNotFound
+	}
+	return decodeDocument(s.docs[ids[0]], result)
+}
+
+func (s *memoryCollection) Find(ctx context.Context, filter bson.M, opts FindOptions, results interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.matching(filter)
+	if err != nil {
+		return err
+	}
+	docs := make([]bson.M, 0, len(ids))
+	for _, id := range ids {
+		docs = append(docs, s.docs[id])
+	}
+	sortDocuments(docs, opts.Sort)
+	return decodeDocuments(opts.page(docs), results)
+}
+
+func (s *memoryCollection) Count(ctx context.Context, filter bson.M) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.matching(filter)
+	return int64(len(ids)), err
+}
+
+func (s *memoryCollection) UpdateOne(ctx context.Context, filter bson.M, update bson.D, upsert bool) (UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, _, err := s.update(ctx, filter, update, upsert, false)
+	return result, err
+}
+
+func (s *memoryCollection) UpdateMany(ctx context.Context, filter bson.M, update bson.D) (UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, _, err := s.update(ctx, filter, update, false, true)
+	return result, err
+}
+
+func (s *memoryCollection) FindOneAndUpdate(ctx context.Context, filter bson.M, update bson.D, upsert bool, result interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, updated, err := s.update(ctx, filter, update, upsert, false)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		return ErrNotFound
+	}
+	return decodeDocument(updated, result)
+}
+
+// update applies update to the first document matching filter, or to all of
+// them, returning the last one it wrote. The caller holds s.mu.
+func (s *memoryCollection) update(ctx context.Context, filter bson.M, update bson.D, upsert bool, many bool) (UpdateResult, bson.M, error) {
+	ids, err := s.matching(filter)
+	if err != nil {
+		return UpdateResult{}, nil, err
+	}
+
+	if len(ids) == 0 {
+		if !upsert {
+			return UpdateResult{}, nil, nil
+		}
+		normalised, err := toDocument(filter)
+		if err != nil {
+			return UpdateResult{}, nil, err
+		}
+		doc, err := upsertDocument(normalised, update)
+		if err != nil {
+			return UpdateResult{}, nil, err
+		}
+		id, err := documentKey(doc, s.idField)
+		if err != nil {
+			return UpdateResult{}, nil, err
+		}
+		if doc, err = toDocument(doc); err != nil {
+			return UpdateResult{}, nil, err
+		}
+		s.put(ctx, id, doc)
+		return UpdateResult{UpsertedCount: 1, UpsertedID: doc[s.idField]}, doc, nil
+	}
+
+	if !many {
+		ids = ids[:1]
+	}
+	var result UpdateResult
+	var updated bson.M
+	for _, id := range ids {
+		doc, err := toDocument(s.docs[id])
+		if err != nil {
+			return UpdateResult{}, nil, err
+		}
+		if err := applyUpdate(doc, update, false); err != nil {
+			return UpdateResult{}, nil, err
+		}
+		if updated, err = toDocument(doc); err != nil {
+			return UpdateResult{}, nil, err
+		}
+		result.MatchedCount++
+		if !reflect.DeepEqual(updated, s.docs[id]) {
+			result.ModifiedCount++
+			s.put(ctx, id, updated)
+		}
+	}
+	return result, updated, nil
+}
+
+func (s *memoryCollection) FindOneAndDelete(ctx context.Context, filter bson.M, result interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.matching(filter)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrNotFound
+	}
+	if err := decodeDocument(s.docs[ids[0]], result); err != nil {
+		return err
+	}
+	s.remove(ctx, ids[0])
+	return nil
+}
+
+func (s *memoryCollection) DeleteOne(ctx context.Context, filter bson.M) (int64, error) {
+	return s.delete(ctx, filter, false)
+}
+
+func (s *memoryCollection) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+	return s.delete(ctx, filter, true)
+}
+
+func (s *memoryCollection) delete(ctx context.Context, filter bson.M, many bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.matching(filter)
+	if err != nil {
+		return 0, err
+	}
+	if !many && len(ids) > 1 {
+		ids = ids[:1]
+	}
+	for _, id := range ids {
+		s.remove(ctx, id)
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *memoryStore[T]) List(ctx context.Context, restaurantId string) ([]T, error) {
+	return s.find(restaurantId, nil)
+}
+
+func (s *memoryStore[T]) Get(ctx context.Context, restaurantId string, id string) (T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, found := s.docs[id]
+	if !found || !inRestaurant(doc, restaurantId) || isDeleted(doc) {
+		var entity T
+		return entity, ErrNotFound
+	}
+	return fromDocument[T](doc)
+}
+
+func (s *memoryStore[T]) Create(ctx context.Context, entity T) error {
+	doc, err := toDocument(entity)
+	if err != nil {
+		return err
+	}
+	id, _ := doc[s.idField].(string)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == "" {
+		return fmt.Errorf("cannot create without a %s", s.idField)
+	}
+	if _, found := s.docs[id]; found {
+		return ErrDuplicate
+	}
+	return s.store(ctx, id, doc)
+}
+
+func (s *memoryStore[T]) Update(ctx context.Context, restaurantId string, id string, set bson.D) (UpdateResult, error) {
+	result, err := s.update(ctx, restaurantId, id, nil, set)
+	if err == ErrNotFound {
+		return result, nil
+	}
+	return result, err
+}
+
+func (s *memoryStore[T]) UpdateVersion(ctx context.Context, restaurantId string, id string, version int64, set bson.D) (UpdateResult, error) {
+	return s.update(ctx, restaurantId, id, &version, set)
+}
+
+// update applies set to the entity, if it is at version when one is given.
+func (s *memoryStore[T]) update(ctx context.Context, restaurantId string, id string, version *int64, set bson.D) (UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, found := s.docs[id]
+	if !found || !inRestaurant(doc, restaurantId) || isDeleted(doc) {
+		return UpdateResult{}, ErrNotFound
+	}
+	if version != nil && versionOf(doc) != *version {
+		return UpdateResult{}, ErrVersionConflict
+	}
+
+	updated := bson.M{}
+	for field, value := range doc {
+		updated[field] = value
+	}
+	for _, field := range set {
+		updated[field.Key] = field.Value
+	}
+	updated["version"] = versionOf(doc) + 1
+
+	if err := s.store(ctx, id, updated); err != nil {
+		return UpdateResult{}, err
+	}
+	return UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (s *memoryStore[T]) Delete(ctx context.Context, restaurantId string, id string, deletedBy string) error {
+	_, err := s.update(ctx, restaurantId, id, nil, bson.D{
+		{Key: "deleted_at", Value: time.Now().Truncate(time.Second)},
+		{Key: "deleted_by", Value: deletedBy},
+	})
+	return err
+}
+
+func (s *memoryStore[T]) Restore(ctx context.Context, restaurantId string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, found := s.docs[id]
+	if !found || !inRestaurant(doc, restaurantId) || !isDeleted(doc) {
+		return ErrNotFound
+	}
+	restored := bson.M{}
+	for field, value := range doc {
+		restored[field] = value
+	}
+	restored["deleted_at"] = nil
+	restored["deleted_by"] = nil
+	restored["version"] = versionOf(doc) + 1
+	return s.store(ctx, id, restored)
+}
+
+func (s *memoryStore[T]) Purge(ctx context.Context, restaurantId string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, found := s.docs[id]
+	if !found || !inRestaurant(doc, restaurantId) || !isDeleted(doc) {
+		return ErrNotFound
+	}
+	s.remove(ctx, id)
+	return nil
+}
+
+func (s *memoryStore[T]) AnyWith(ctx context.Context, restaurantId string, field string, value string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, doc := range s.docs {
+		if inRestaurant(doc, restaurantId) && !isDeleted(doc) && doc[field] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// versionOf reads a document's version, which may have been stored as any
+// integer type or, before versions, not at all.
+func versionOf(doc bson.M) int64 {
+	switch version := doc["version"].(type) {
+	case int64:
+		return version
+	case int32:
+		return int64(version)
+	case int:
+		return int64(version)
+	}
+	return 0
+}
+
+type memoryFoods struct {
+	*memoryStore[models.Food]
+}
+
+func (s memoryFoods) Page(ctx context.Context, restaurantId string, startIndex int, limit int) ([]models.Food, int64, error) {
+	foods, err := s.find(restaurantId, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	totalCount := int64(len(foods))
+	if startIndex > len(foods) {
+		startIndex = len(foods)
+	}
+	foods = foods[startIndex:]
+	if limit < len(foods) {
+		foods = foods[:limit]
+	}
+	return foods, totalCount, nil
+}
+
+type memoryOrders struct {
+	*memoryStore[models.Order]
+}
+
+func (s memoryOrders) ByTable(ctx context.Context, restaurantId string, tableId string) ([]models.Order, error) {
+	return s.find(restaurantId, func(order models.Order) bool {
+		return order.Table_id != nil && *order.Table_id == tableId
+	})
+}
+
+type memoryOrderItems struct {
+	*memoryStore[models.OrderItem]
+	foods  *memoryStore[models.Food]
+	orders *memoryStore[models.Order]
+	tables *memoryStore[models.Table]
+}
+
+func (s memoryOrderItems) CreateMany(ctx context.Context, orderItems []models.OrderItem) error {
+	for _, orderItem := range orderItems {
+		if err := s.Create(ctx, orderItem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s memoryOrderItems) ByOrder(ctx context.Context, restaurantId string, orderId string) ([]OrderSummary, error) {
+	orderItems, err := s.find(restaurantId, func(orderItem models.OrderItem) bool {
+		return orderItem.Order_id == orderId
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []summaryRow
+	for _, orderItem := range orderItems {
+		row := summaryRow{item: OrderSummaryItem{Quantity: orderItem.Quantity}}
+
+		if orderItem.Food_id != nil {
+			if food, err := s.foods.Get(ctx, "", *orderItem.Food_id); err == nil {
+				row.item.Amount = food.Price
+				row.item.Food_name = food.Name
+				row.item.Food_image = food.Food_image
+			}
+		}
+		// Items of a deleted order are left out with it
+		order, err := s.orders.Get(ctx, "", orderItem.Order_id)
+		if err != nil {
+			continue
+		}
+		row.item.Order_id = &order.Order_id
+		row.key.orderId = order.Order_id
+		if order.Table_id != nil {
+			if table, err := s.tables.Get(ctx, "", *order.Table_id); err == nil {
+				row.item.Table_id = &table.Table_id
+				row.item.Table_number = table.Table_number
+				row.key.tableId = table.Table_id
+				if table.Table_number != nil {
+					row.key.tableNumber, row.key.hasTable = *table.Table_number, true
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	return groupSummaries(rows), nil
+}
+
+// summaryRow is an order item joined with its food, order and table.
+type summaryRow struct {
+	key  summaryKey
+	item OrderSummaryItem
+}
+
+// summaryKey groups rows like the Mongo aggregation, by order, table id and
+// table number.
+type summaryKey struct {
+	orderId, tableId string
+	tableNumber      int
+	hasTable         bool
+}
+
+// groupSummaries groups rows into summaries, in the order each group first
+// appears.
+func groupSummaries(rows []summaryRow) []OrderSummary {
+	var keys []summaryKey
+	groups := map[summaryKey]*OrderSummary{}
+
+	for _, row := range rows {
+		group, found := groups[row.key]
+		if !found {
+			group = &OrderSummary{Table_number: row.item.Table_number, Order_items: []OrderSummaryItem{}}
+			groups[row.key] = group
+			keys = append(keys, row.key)
+		}
+		if row.item.Amount != nil {
+			group.Payment_due += *row.item.Amount
+		}
+		group.Total_count++
+		group.Order_items = append(group.Order_items, row.item)
+	}
+
+	summaries := []OrderSummary{}
+	for _, key := range keys {
+		summaries = append(summaries, *groups[key])
+	}
+	return summaries
+}
+
+type memoryUsers struct {
+	*memoryStore[models.User]
+}
+
+func (s memoryUsers) Search(ctx context.Context, query UserQuery) ([]models.User, int64, error) {
+	users, err := s.find(query.RestaurantId, query.matches)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, totalCount := query.page(users)
+	return users, totalCount, nil
+}
+
+// matches reports whether user is one the query selects, for backends that
+// filter in Go.
+func (query UserQuery) matches(user models.User) bool {
+	for _, term := range query.Search {
+		term = strings.ToLower(term)
+		found := false
+		for _, field := range []*string{user.First_name, user.Last_name, user.Email, user.Phone} {
+			if field != nil && strings.Contains(strings.ToLower(*field), term) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if query.Role != "" && (user.Role == nil || *user.Role != query.Role) {
+		return false
+	}
+	if query.Active != nil && *query.Active != (user.Deactivated_at == nil) {
+		return false
+	}
+	return true
+}
+
+// page sorts the users the query matched and returns its page of them,
+// without their secrets, and how many there are in all.
+func (query UserQuery) page(users []models.User) ([]models.User, int64) {
+	sort.SliceStable(users, func(i, j int) bool {
+		order := compareUsers(users[i], users[j], query.SortField)
+		if order == 0 {
+			return users[i].User_id < users[j].User_id
+		}
+		return (order < 0) != query.SortDescending
+	})
+
+	totalCount := int64(len(users))
+	if query.StartIndex > len(users) {
+		query.StartIndex = len(users)
+	}
+	users = users[query.StartIndex:]
+	if query.Limit < len(users) {
+		users = users[:query.Limit]
+	}
+	for i := range users {
+		users[i].Password = nil
+		users[i].Totp_secret = nil
+		users[i].Totp_last_step = 0
+		users[i].Recovery_codes = nil
+		users[i].Pin_hash = nil
+	}
+	return users, totalCount
+}
+
+// compareUsers orders two users by one of UserSortFields, missing values first.
+func compareUsers(a, b models.User, field string) int {
+	switch field {
+	case "created_at":
+		return compareTimes(a.Created_at.UnixNano(), b.Created_at.UnixNano())
+	case "updated_at":
+		return compareTimes(a.Updated_at.UnixNano(), b.Updated_at.UnixNano())
+	}
+	values := map[string][2]*string{
+		"first_name": {a.First_name, b.First_name},
+		"last_name":  {a.Last_name, b.Last_name},
+		"email":      {a.Email, b.Email},
+		"role":       {a.Role, b.Role},
+	}[field]
+	switch {
+	case values[0] == nil && values[1] == nil:
+		return 0
+	case values[0] == nil:
+		return -1
+	case values[1] == nil:
+		return 1
+	}
+	return strings.Compare(*values[0], *values[1])
+}
+
+func compareTimes(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (s memoryUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.findOne(func(user models.User) bool {
+		return user.Email != nil && *user.Email == email
+	})
+}
+
+func (s memoryUsers) GetByOidcSubject(ctx context.Context, subject string) (models.User, error) {
+	return s.findOne(func(user models.User) bool {
+		return user.Oidc_subject != nil && *user.Oidc_subject == subject
+	})
+}
+
+// Deleted users keep their email and phone, and still count as admins, as
+// in the Mongo implementation.
+
+func (s memoryUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	_, err := first(s.scan("", true, func(user models.User) bool {
+		return user.Email != nil && *user.Email == email
+	}))
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s memoryUsers) PhoneTaken(ctx context.Context, phone string, exceptUserId string) (bool, error) {
+	_, err := first(s.scan("", true, func(user models.User) bool {
+		return user.Phone != nil && *user.Phone == phone && user.User_id != exceptUserId
+	}))
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s memoryUsers) HasAdmin(ctx context.Context) (bool, error) {
+	_, err := first(s.scan("", true, func(user models.User) bool {
+		return user.Role != nil && *user.Role == models.RoleAdmin
+	}))
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s memoryUsers) PinStaff(ctx context.Context, restaurantId string) ([]models.User, error) {
+	return s.find("", func(user models.User) bool {
+		return user.Restaurant_id == restaurantId && user.Pin_hash != nil && user.Deactivated_at == nil
+	})
+}
+
+func (s memoryUsers) AdvanceTotpStep(ctx context.Context, userId string, step int64) (bool, error) {
+	return s.modify(ctx, userId, func(doc bson.M) bool {
+		if lastStep, _ := doc["totp_last_step"].(int64); lastStep >= step {
+			return false
+		}
+		doc["totp_last_step"] = step
+		doc["totp_enabled"] = true
+		return true
+	})
+}
+
+func (s memoryUsers) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	return s.modify(ctx, userId, func(doc bson.M) bool {
+		codes, _ := doc["recovery_codes"].(bson.A)
+		for i, code := range codes {
+			if code == codeHash {
+				doc["recovery_codes"] = append(codes[:i:i], codes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,581 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"restaurant_app/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo keeps every entity in its own collection of db.
+func NewMongo(db *mongo.Database) *Repositories {
+	return &Repositories{
+		Transactions: mongoTransactions{db.Client()},
+		Foods:        mongoFoods{mongoStore[models.Food]{db.Collection("food"), "food_id"}},
+		Menus:        mongoStore[models.Menu]{db.Collection("menu"), "menu_id"},
+		Tables:       mongoStore[models.Table]{db.Collection("table"), "table_id"},
+		Orders:       mongoOrders{mongoStore[models.Order]{db.Collection("order"), "order_id"}},
+		OrderItems:   mongoOrderItems{mongoStore[models.OrderItem]{db.Collection("orderItem"), "order_item_id"}},
+		Invoices:     mongoStore[models.Invoice]{db.Collection("invoice"), "invoice_id"},
+		Users:        mongoUsers{mongoStore[models.User]{db.Collection("user"), "user_id"}},
+		Collections:  mongoCollections{db},
+	}
+}
+
+type mongoTransactions struct {
+	client *mongo.Client
+}
+
+func (t mongoTransactions) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	session, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	if isNotReplicaSet(err) {
+		return ErrTransactionsUnsupported
+	}
+	return err
+}
+
+// isNotReplicaSet reports whether a standalone server refused the first
+// command of a transaction.
+func isNotReplicaSet(err error) bool {
+	var commandErr mongo.CommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+	return commandErr.Code == 20 && strings.Contains(commandErr.Message, "replica set")
+}
+
+type mongoStore[T any] struct {
+	collection *mongo.Collection
+	idField    string
+}
+
+func scoped(restaurantId string, filter bson.M) bson.M {
+	if restaurantId != "" {
+		filter["restaurant_id"] = restaurantId
+	}
+	return filter
+}
+
+// live is scoped, leaving out deleted entities.
+func live(restaurantId string, filter bson.M) bson.M {
+	filter["deleted_at"] = nil
+	return scoped(restaurantId, filter)
+}
+
+// deleted is scoped, matching only deleted entities.
+func deleted(restaurantId string, filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$ne": nil}
+	return scoped(restaurantId, filter)
+}
+
+func (s mongoStore[T]) find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := s.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	entities := []T{}
+	if err := cursor.All(ctx, &entities); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+func (s mongoStore[T]) findOne(ctx context.Context, filter interface{}) (T, error) {
+	var entity T
+	err := s.collection.FindOne(ctx, filter).Decode(&entity)
+	if err == mongo.ErrNoDocuments {
+		return entity, ErrNotFound
+	}
+	return entity, err
+}
+
+func (s mongoStore[T]) exists(ctx context.Context, filter interface{}) (bool, error) {
+	count, err := s.collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+func (s mongoStore[T]) List(ctx context.Context, restaurantId string) ([]T, error) {
+	return s.find(ctx, live(restaurantId, bson.M{}))
+}
+
+func (s mongoStore[T]) Get(ctx context.Context, restaurantId string, id string) (T, error) {
+	return s.findOne(ctx, live(restaurantId, bson.M{s.idField: id}))
+}
+
+func (s mongoStore[T]) Create(ctx context.Context, entity T) error {
+	_, err := s.collection.InsertOne(ctx, entity)
+	return duplicateOr(err)
+}
+
+func duplicateOr(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s mongoStore[T]) Update(ctx context.Context, restaurantId string, id string, set bson.D) (UpdateResult, error) {
+	return s.update(ctx, live(restaurantId, bson.M{s.idField: id}), set)
+}
+
+func (s mongoStore[T]) UpdateVersion(ctx context.Context, restaurantId string, id string, version int64, set bson.D) (UpdateResult, error) {
+	// Documents from before versions have none, which is version 0
+	var versionFilter interface{} = version
+	if version == 0 {
+		versionFilter = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	result, err := s.update(ctx, live(restaurantId, bson.M{s.idField: id, "version": versionFilter}), set)
+	if err != nil || result.MatchedCount > 0 {
+		return result, err
+	}
+	found, err := s.exists(ctx, live(restaurantId, bson.M{s.idField: id}))
+	if err != nil {
+		return result, err
+	}
+	if found {
+		return result, ErrVersionConflict
+	}
+	return result, ErrNotFound
+}
+
+func (s mongoStore[T]) update(ctx context.Context, filter bson.M, set bson.D) (UpdateResult, error) {
+	result, err := s.collection.UpdateOne(
+		ctx,
+		filter,
+		bson.D{
+			{Key: "$set", Value: set},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return UpdateResult{}, duplicateOr(err)
+	}
+	return UpdateResult{
+		MatchedCount:  result.MatchedCount,
+		ModifiedCount: result.ModifiedCount,
+		UpsertedCount: result.UpsertedCount,
+		UpsertedID:    result.UpsertedID,
+	}, nil
+}
+
+func (s mongoStore[T]) Delete(ctx context.Context, restaurantId string, id string, deletedBy string) error {
+	result, err := s.update(ctx, live(restaurantId, bson.M{s.idField: id}), bson.D{
+		{Key: "deleted_at", Value: time.Now().Truncate(time.Second)},
+		{Key: "deleted_by", Value: deletedBy},
+	})
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s mongoStore[T]) Restore(ctx context.Context, restaurantId string, id string) error {
+	result, err := s.update(ctx, deleted(restaurantId, bson.M{s.idField: id}), bson.D{
+		{Key: "deleted_at", Value: nil},
+		{Key: "deleted_by", Value: nil},
+	})
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s mongoStore[T]) Purge(ctx context.Context, restaurantId string, id string) error {
+	result, err := s.collection.DeleteOne(ctx, deleted(restaurantId, bson.M{s.idField: id}))
+	if err == nil && result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s mongoStore[T]) AnyWith(ctx context.Context, restaurantId string, field string, value string) (bool, error) {
+	return s.exists(ctx, live(restaurantId, bson.M{field: value}))
+}
+
+type mongoFoods struct {
+	mongoStore[models.Food]
+}
+
+func (s mongoFoods) Page(ctx context.Context, restaurantId string, startIndex int, limit int) ([]models.Food, int64, error) {
+	filter := live(restaurantId, bson.M{})
+
+	totalCount, err := s.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	foods, err := s.find(ctx, filter, options.Find().SetSkip(int64(startIndex)).SetLimit(int64(limit)))
+	return foods, totalCount, err
+}
+
+type mongoOrders struct {
+	mongoStore[models.Order]
+}
+
+func (s mongoOrders) ByTable(ctx context.Context, restaurantId string, tableId string) ([]models.Order, error) {
+	return s.find(ctx, live(restaurantId, bson.M{"table_id": tableId}))
+}
+
+type mongoOrderItems struct {
+	mongoStore[models.OrderItem]
+}
+
+func (s mongoOrderItems) CreateMany(ctx context.Context, orderItems []models.OrderItem) error {
+	documents := make([]interface{}, len(orderItems))
+	for i, orderItem := range orderItems {
+		documents[i] = orderItem
+	}
+	_, err := s.collection.InsertMany(ctx, documents)
+	return duplicateOr(err)
+}
+
+func (s mongoOrderItems) ByOrder(ctx context.Context, restaurantId string, orderId string) ([]OrderSummary, error) {
+	matchStage := bson.D{{Key: "$match", Value: live(restaurantId, bson.M{"order_id": orderId})}}
+	lookupFoodStage := bson.D{{Key: "$lookup", Value: lookupLive("food", "food_id", "food_id", "food")}}
+	unwindFoodStage := bson.D{{Key: "$unwind", Value: bson.D{
+		{Key: "path", Value: "$food"},
+		{Key: "preserveNullAndEmptyArrays", Value: true},
+	}}}
+
+	// Items of a deleted order are left out with it
+	lookupOrderStage := bson.D{{Key: "$lookup", Value: lookupLive("order", "order_id", "order_id", "order")}}
+	unwindOrderStage := bson.D{{Key: "$unwind", Value: "$order"}}
+
+	lookupTableStage := bson.D{{Key: "$lookup", Value: lookupLive("table", "order.table_id", "table_id", "table")}}
+	unwindTableStage := bson.D{{Key: "$unwind", Value: bson.D{
+		{Key: "path", Value: "$table"},
+		{Key: "preserveNullAndEmptyArrays", Value: true},
+	}}}
+
+	projectStage := bson.D{{Key: "$project", Value: bson.M{
+		"amount":       "$food.price",
+		"food_name":    "$food.name",
+		"food_image":   "$food.food_image",
+		"table_number": "$table.table_number",
+		"table_id":     "$table.table_id",
+		"order_id":     "$order.order_id",
+		"quantity":     1,
+	}}}
+
+	groupStage := bson.D{{Key: "$group", Value: bson.M{
+		"_id": bson.M{
+			"order_id":     "$order_id",
+			"table_id":     "$table_id",
+			"table_number": "$table_number",
+		},
+		"payment_due": bson.M{"$sum": "$amount"},
+		"total_count": bson.M{"$sum": 1},
+		"order_items": bson.M{"$push": "$$ROOT"},
+	}}}
+
+	projectStage2 := bson.D{{Key: "$project", Value: bson.M{
+		"_id":          0,
+		"payment_due":  1,
+		"total_count":  1,
+		"table_number": "$_id.table_number",
+		"order_items":  1,
+	}}}
+
+	pipeline := mongo.Pipeline{
+		matchStage,
+		lookupFoodStage,
+		unwindFoodStage,
+		lookupOrderStage,
+		unwindOrderStage,
+		lookupTableStage,
+		unwindTableStage,
+		projectStage,
+		groupStage,
+		projectStage2,
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	summaries := []OrderSummary{}
+	if err := cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// lookupLive joins the entities of collection whose foreignField equals
+// localField, like a plain $lookup, but leaves out deleted ones.
+func lookupLive(collection string, localField string, foreignField string, as string) bson.D {
+	return bson.D{
+		{Key: "from", Value: collection},
+		{Key: "let", Value: bson.D{{Key: "key", Value: "$" + localField}}},
+		{Key: "pipeline", Value: bson.A{
+			bson.D{{Key: "$match", Value: bson.D{
+				{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{"$" + foreignField, "$$key"}}}},
+				{Key: "deleted_at", Value: nil},
+			}}},
+		}},
+		{Key: "as", Value: as},
+	}
+}
+
+type mongoUsers struct {
+	mongoStore[models.User]
+}
+
+// Removes the fields that must never be sent back from user query results.
+var hideUserSecrets = bson.D{
+	{Key: "password", Value: 0},
+	{Key: "totp_secret", Value: 0},
+	{Key: "totp_last_step", Value: 0},
+	{Key: "recovery_codes", Value: 0},
+	{Key: "pin_hash", Value: 0},
+}
+
+func (s mongoUsers) Search(ctx context.Context, query UserQuery) ([]models.User, int64, error) {
+	filter := bson.D{{Key: "deleted_at", Value: nil}}
+
+	if query.RestaurantId != "" {
+		filter = append(filter, bson.E{Key: "restaurant_id", Value: query.RestaurantId})
+	}
+
+	var searchTerms bson.A
+	for _, term := range query.Search {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(term), Options: "i"}
+		searchTerms = append(searchTerms, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "first_name", Value: pattern}},
+			bson.D{{Key: "last_name", Value: pattern}},
+			bson.D{{Key: "email", Value: pattern}},
+			bson.D{{Key: "phone", Value: pattern}},
+		}}})
+	}
+	if len(searchTerms) > 0 {
+		filter = append(filter, bson.E{Key: "$and", Value: searchTerms})
+	}
+
+	if query.Role != "" {
+		filter = append(filter, bson.E{Key: "role", Value: query.Role})
+	}
+
+	if query.Active != nil {
+		if *query.Active {
+			filter = append(filter, bson.E{Key: "deactivated_at", Value: nil})
+		} else {
+			filter = append(filter, bson.E{Key: "deactivated_at", Value: bson.M{"$ne": nil}})
+		}
+	}
+
+	sortOrder := 1
+	if query.SortDescending {
+		sortOrder = -1
+	}
+
+	// Count every match and cut one page out of them in a single query
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$project", Value: hideUserSecrets}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "total_count", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+			{Key: "users", Value: bson.A{
+				bson.D{{Key: "$sort", Value: bson.D{{Key: query.SortField, Value: sortOrder}, {Key: "user_id", Value: 1}}}},
+				bson.D{{Key: "$skip", Value: query.StartIndex}},
+				bson.D{{Key: "$limit", Value: query.Limit}},
+			}},
+		}}},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var pages []struct {
+		Total_count []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total_count"`
+		Users []models.User `bson:"users"`
+	}
+	if err = cursor.All(ctx, &pages); err != nil {
+		return nil, 0, err
+	}
+
+	var totalCount int64
+	users := []models.User{}
+	if len(pages) > 0 {
+		if len(pages[0].Total_count) > 0 {
+			totalCount = pages[0].Total_count[0].Count
+		}
+		users = append(users, pages[0].Users...)
+	}
+	return users, totalCount, nil
+}
+
+func (s mongoUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.findOne(ctx, live("", bson.M{"email": email}))
+}
+
+func (s mongoUsers) GetByOidcSubject(ctx context.Context, subject string) (models.User, error) {
+	return s.findOne(ctx, live("", bson.M{"oidc_subject": subject}))
+}
+
+// Deleted users keep their email and phone, which the unique indexes hold on
+// to, and still count as admins so deleting one can't hand the first sign up
+// admin rights.
+
+func (s mongoUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	return s.exists(ctx, bson.M{"email": email})
+}
+
+func (s mongoUsers) PhoneTaken(ctx context.Context, phone string, exceptUserId string) (bool, error) {
+	return s.exists(ctx, bson.M{"phone": phone, "user_id": bson.M{"$ne": exceptUserId}})
+}
+
+func (s mongoUsers) HasAdmin(ctx context.Context) (bool, error) {
+	return s.exists(ctx, bson.M{"role": models.RoleAdmin})
+}
+
+func (s mongoUsers) PinStaff(ctx context.Context, restaurantId string) ([]models.User, error) {
+	return s.find(ctx, live("", bson.M{"pin_hash": bson.M{"$ne": nil}, "deactivated_at": nil, "restaurant_id": restaurantId}))
+}
+
+func (s mongoUsers) AdvanceTotpStep(ctx context.Context, userId string, step int64) (bool, error) {
+	// Guard on the stored step so the same code can't be used twice concurrently
+	result, err := s.collection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "totp_last_step": bson.M{"$lt": step}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "totp_last_step", Value: step},
+				{Key: "totp_enabled", Value: true},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (s mongoUsers) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	result, err := s.collection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "recovery_codes": codeHash},
+		bson.D{
+			{Key: "$pull", Value: bson.D{{Key: "recovery_codes", Value: codeHash}}},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+type mongoCollections struct {
+	db *mongo.Database
+}
+
+func (c mongoCollections) Collection(name string) Collection {
+	return mongoCollection{c.db.Collection(name)}
+}
+
+type mongoCollection struct {
+	collection *mongo.Collection
+}
+
+func (c mongoCollection) Insert(ctx context.Context, document interface{}) error {
+	_, err := c.collection.InsertOne(ctx, document)
+	return duplicateOr(err)
+}
+
+func (c mongoCollection) FindOne(ctx context.Context, filter bson.M, result interface{}) error {
+	return notFoundOr(c.collection.FindOne(ctx, filter).Decode(result))
+}
+
+func (c mongoCollection) Find(ctx context.Context, filter bson.M, opts FindOptions, results interface{}) error {
+	findOptions := options.Find()
+	if opts.Sort != nil {
+		findOptions.SetSort(opts.Sort)
+	}
+	if opts.Skip > 0 {
+		findOptions.SetSkip(opts.Skip)
+	}
+	if opts.Limit > 0 {
+		findOptions.SetLimit(opts.Limit)
+	}
+	cursor, err := c.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+func (c mongoCollection) Count(ctx context.Context, filter bson.M) (int64, error) {
+	return c.collection.CountDocuments(ctx, filter)
+}
+
+func (c mongoCollection) UpdateOne(ctx context.Context, filter bson.M, update bson.D, upsert bool) (UpdateResult, error) {
+	result, err := c.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(upsert))
+	if err != nil {
+		return UpdateResult{}, duplicateOr(err)
+	}
+	return UpdateResult(*result), nil
+}
+
+func (c mongoCollection) UpdateMany(ctx context.Context, filter bson.M, update bson.D) (UpdateResult, error) {
+	result, err := c.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return UpdateResult{}, duplicateOr(err)
+	}
+	return UpdateResult(*result), nil
+}
+
+func (c mongoCollection) FindOneAndUpdate(ctx context.Context, filter bson.M, update bson.D, upsert bool, result interface{}) error {
+	opts := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	err := c.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result)
+	return notFoundOr(duplicateOr(err))
+}
+
+func (c mongoCollection) FindOneAndDelete(ctx context.Context, filter bson.M, result interface{}) error {
+	return notFoundOr(c.collection.FindOneAndDelete(ctx, filter).Decode(result))
+}
+
+func (c mongoCollection) DeleteOne(ctx context.Context, filter bson.M) (int64, error) {
+	result, err := c.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (c mongoCollection) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+	result, err := c.collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func notFoundOr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
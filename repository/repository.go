@@ -0,0 +1,232 @@
+// Package repository keeps the restaurant's entities, and everything else
+// the server stores, such as sessions and the audit log. Handlers get the
+// repositories they need injected and never see how they are stored;
+// NewMongo, NewSQLite and NewMemory provide the implementations.
+//
+// Every restaurantId argument limits a call to one restaurant. An empty one
+// matches every restaurant, for cross-site users who have not picked a site.
+package repository
+
+import (
+	"context"
+	"errors"
+	"restaurant_app/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNotFound is returned when no entity matches.
+var ErrNotFound = errors.New("not found")
+
+// ErrVersionConflict is returned when an entity has changed since the
+// version the caller last saw.
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrDuplicate is returned when a create or update would repeat a value that
+// has to be unique, such as a user's email. The Mongo backend relies on the
+// unique indexes of the migrations package for this.
+var ErrDuplicate = errors.New("duplicate")
+
+// ErrTransactionsUnsupported is returned by InTransaction when the database
+// cannot run transactions. Nothing has been written when it is returned.
+var ErrTransactionsUnsupported = errors.New("this operation needs MongoDB to run as a replica set or sharded cluster, which a standalone server is not")
+
+// UpdateResult reports what an update did. Its fields are named like the
+// driver's, which the API has always returned.
+type UpdateResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+	UpsertedCount int64
+	UpsertedID    interface{}
+}
+
+// Store holds one kind of entity, identified by its own id field such as
+// food_id. Changes are given as the fields to set, by their bson names.
+//
+// Every entity has a version, 0 when created, that each update bumps by one.
+//
+// Deleting an entity only marks it deleted. From then on it is left out of
+// everything, joins included, except Restore and Purge.
+type Store[T any] interface {
+	List(ctx context.Context, restaurantId string) ([]T, error)
+	Get(ctx context.Context, restaurantId string, id string) (T, error)
+	Create(ctx context.Context, entity T) error
+	// Update matches nothing, rather than failing, when there is no entity
+	Update(ctx context.Context, restaurantId string, id string, set bson.D) (UpdateResult, error)
+	// UpdateVersion is Update for an entity last seen at version. It returns
+	// ErrNotFound when there is no entity and ErrVersionConflict when it has
+	// changed since.
+	UpdateVersion(ctx context.Context, restaurantId string, id string, version int64, set bson.D) (UpdateResult, error)
+	// Delete records when and by whom the entity was deleted
+	Delete(ctx context.Context, restaurantId string, id string, deletedBy string) error
+	// Restore undoes Delete; it returns ErrNotFound unless the entity is deleted
+	Restore(ctx context.Context, restaurantId string, id string) error
+	// Purge removes a deleted entity for good; it returns ErrNotFound unless
+	// the entity is deleted
+	Purge(ctx context.Context, restaurantId string, id string) error
+	// AnyWith reports whether an entity that is not deleted has field, by its
+	// bson name, set to value. It is how references to an entity are found.
+	AnyWith(ctx context.Context, restaurantId string, field string, value string) (bool, error)
+}
+
+// Transactions make changes to several entities all or nothing.
+type Transactions interface {
+	// InTransaction runs fn in a transaction, committed when fn returns nil.
+	// Only calls made with the ctx fn is given take part. fn may run more
+	// than once when a transaction has to be retried, and joins the
+	// transaction of a ctx that is in one already.
+	InTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type Foods interface {
+	Store[models.Food]
+	// Page returns up to limit foods from startIndex on, and how many there are
+	Page(ctx context.Context, restaurantId string, startIndex int, limit int) ([]models.Food, int64, error)
+}
+
+type Menus interface {
+	Store[models.Menu]
+}
+
+type Tables interface {
+	Store[models.Table]
+}
+
+type Orders interface {
+	Store[models.Order]
+	ByTable(ctx context.Context, restaurantId string, tableId string) ([]models.Order, error)
+}
+
+type OrderItems interface {
+	Store[models.OrderItem]
+	CreateMany(ctx context.Context, orderItems []models.OrderItem) error
+	// ByOrder joins an order's items with their food and table
+	ByOrder(ctx context.Context, restaurantId string, orderId string) ([]OrderSummary, error)
+}
+
+type Invoices interface {
+	Store[models.Invoice]
+}
+
+type Users interface {
+	Store[models.User]
+	Search(ctx context.Context, query UserQuery) ([]models.User, int64, error)
+	GetByEmail(ctx context.Context, email string) (models.User, error)
+	GetByOidcSubject(ctx context.Context, subject string) (models.User, error)
+	EmailTaken(ctx context.Context, email string) (bool, error)
+	// PhoneTaken ignores exceptUserId, so users can keep their own number
+	PhoneTaken(ctx context.Context, phone string, exceptUserId string) (bool, error)
+	HasAdmin(ctx context.Context) (bool, error)
+	// PinStaff lists the active users of a restaurant who have set a PIN
+	PinStaff(ctx context.Context, restaurantId string) ([]models.User, error)
+	// AdvanceTotpStep records a used TOTP step and enables TOTP, unless the
+	// same or a later step has been used already
+	AdvanceTotpStep(ctx context.Context, userId string, step int64) (bool, error)
+	// UseRecoveryCode removes the code, reporting whether the user had it
+	UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error)
+}
+
+// UserQuery selects one page of the staff directory.
+type UserQuery struct {
+	RestaurantId string
+	// Every word has to appear in the name, email or phone
+	Search []string
+	Role   string
+	// Active picks active or deactivated users; nil picks both
+	Active *bool
+	// SortField is one of UserSortFields
+	SortField      string
+	SortDescending bool
+	StartIndex     int
+	Limit          int
+}
+
+// UserSortFields are the fields the staff directory can be sorted by.
+var UserSortFields = map[string]bool{
+	"first_name": true,
+	"last_name":  true,
+	"email":      true,
+	"role":       true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// OrderSummary is an order with its items, their food and its table.
+type OrderSummary struct {
+	Payment_due  float64            `json:"payment_due" bson:"payment_due"`
+	Total_count  int                `json:"total_count" bson:"total_count"`
+	Table_number *int               `json:"table_number" bson:"table_number"`
+	Order_items  []OrderSummaryItem `json:"order_items" bson:"order_items"`
+}
+
+type OrderSummaryItem struct {
+	Amount       *float64 `json:"amount" bson:"amount"`
+	Food_name    *string  `json:"food_name" bson:"food_name"`
+	Food_image   *string  `json:"food_image" bson:"food_image"`
+	Quantity     *string  `json:"quantity" bson:"quantity"`
+	Table_number *int     `json:"table_number" bson:"table_number"`
+	Table_id     *string  `json:"table_id" bson:"table_id"`
+	Order_id     *string  `json:"order_id" bson:"order_id"`
+}
+
+// Collection holds documents by their bson fields, as a MongoDB collection
+// does, for what the server keeps besides the entities: sessions, signing
+// keys, the audit log and the like. It offers the part of MongoDB's queries
+// those need.
+//
+// A filter maps fields to the value they must equal, where nil also matches
+// a missing field, or to a document of $ne, $in, $gt, $gte, $lt and $lte
+// conditions. An update is made of $set, $inc and, for the document an
+// upsert inserts, $setOnInsert. Documents get an _id when they have none.
+type Collection interface {
+	Insert(ctx context.Context, document interface{}) error
+	// FindOne decodes the first document matching filter into result, or
+	// returns ErrNotFound
+	FindOne(ctx context.Context, filter bson.M, result interface{}) error
+	// Find decodes the documents matching filter into results, a pointer to
+	// a slice
+	Find(ctx context.Context, filter bson.M, opts FindOptions, results interface{}) error
+	Count(ctx context.Context, filter bson.M) (int64, error)
+	// UpdateOne updates the first document matching filter. With upsert, a
+	// document is inserted when none matches, made of the filter's values
+	// and the update.
+	UpdateOne(ctx context.Context, filter bson.M, update bson.D, upsert bool) (UpdateResult, error)
+	UpdateMany(ctx context.Context, filter bson.M, update bson.D) (UpdateResult, error)
+	// FindOneAndUpdate is UpdateOne that decodes the document as it is after
+	// the update into result, or returns ErrNotFound
+	FindOneAndUpdate(ctx context.Context, filter bson.M, update bson.D, upsert bool, result interface{}) error
+	// FindOneAndDelete removes the first document matching filter and
+	// decodes it into result, or returns ErrNotFound
+	FindOneAndDelete(ctx context.Context, filter bson.M, result interface{}) error
+	DeleteOne(ctx context.Context, filter bson.M) (int64, error)
+	DeleteMany(ctx context.Context, filter bson.M) (int64, error)
+}
+
+// FindOptions sort and page what Find returns. Without a sort documents
+// come in the order they were inserted.
+type FindOptions struct {
+	// Fields to sort by, with 1 for ascending and -1 for descending
+	Sort  bson.D
+	Skip  int64
+	Limit int64
+}
+
+// Collections opens collections by name, like "session". The entities'
+// collections can be opened too, to read their documents as stored, deleted
+// ones included.
+type Collections interface {
+	Collection(name string) Collection
+}
+
+// Repositories is everything the handlers are given.
+type Repositories struct {
+	Transactions Transactions
+	Foods        Foods
+	Menus        Menus
+	Tables       Tables
+	Orders       Orders
+	OrderItems   OrderItems
+	Invoices     Invoices
+	Users        Users
+	Collections  Collections
+}
@@ -0,0 +1,286 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"restaurant_app/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Every backend has to keep the contract the handlers rely on. The Mongo one
+// is run through the handlers by the app's tests.
+
+func TestMemory(t *testing.T) {
+	testRepositories(t, NewMemory())
+}
+
+func TestSQLite(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "restaurant.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	testRepositories(t, NewSQLite(db))
+}
+
+func testRepositories(t *testing.T, repos *Repositories) {
+	t.Run("Store", func(t *testing.T) { testStore(t, repos) })
+	t.Run("Transactions", func(t *testing.T) { testTransactions(t, repos) })
+	t.Run("Users", func(t *testing.T) { testUsers(t, repos) })
+	t.Run("Invoices", func(t *testing.T) { testInvoices(t, repos) })
+	t.Run("Collections", func(t *testing.T) { testCollections(t, repos) })
+}
+
+func newFood(restaurantId string, menuId string) models.Food {
+	id := primitive.NewObjectID()
+	name, image := "Pizza", "pizza.png"
+	price := 10.0
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	return models.Food{
+		ID:            id,
+		Name:          &name,
+		Price:         &price,
+		Food_image:    &image,
+		Created_at:    now,
+		Updated_at:    now,
+		Food_id:       id.Hex(),
+		Menu_id:       &menuId,
+		Restaurant_id: restaurantId,
+	}
+}
+
+func testStore(t *testing.T, repos *Repositories) {
+	ctx := context.Background()
+	food := newFood("restaurant-1", "menu-1")
+	if err := repos.Foods.Create(ctx, food); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, restaurantId := range []string{"restaurant-1", ""} {
+		if got, err := repos.Foods.Get(ctx, restaurantId, food.Food_id); err != nil || got.Version != 0 || *got.Name != "Pizza" {
+			t.Fatalf("Get at %q found %+v (%v)", restaurantId, got, err)
+		}
+	}
+	if _, err := repos.Foods.Get(ctx, "restaurant-2", food.Food_id); err != ErrNotFound {
+		t.Fatalf("Get at another restaurant gave %v, want ErrNotFound", err)
+	}
+	if list, err := repos.Foods.List(ctx, "restaurant-2"); err != nil || len(list) != 0 {
+		t.Fatalf("List at another restaurant found %d (%v)", len(list), err)
+	}
+	if result, err := repos.Foods.Update(ctx, "restaurant-2", food.Food_id, bson.D{{Key: "name", Value: "Stolen"}}); err != nil || result.MatchedCount != 0 {
+		t.Fatalf("Update at another restaurant matched %d (%v)", result.MatchedCount, err)
+	}
+
+	if _, err := repos.Foods.Update(ctx, "restaurant-1", food.Food_id, bson.D{{Key: "name", Value: "Pasta"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Foods.UpdateVersion(ctx, "restaurant-1", food.Food_id, 0, bson.D{{Key: "name", Value: "Soup"}}); err != ErrVersionConflict {
+		t.Fatalf("a stale update gave %v, want ErrVersionConflict", err)
+	}
+	if _, err := repos.Foods.UpdateVersion(ctx, "restaurant-1", food.Food_id, 1, bson.D{{Key: "name", Value: "Soup"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Foods.UpdateVersion(ctx, "restaurant-1", primitive.NewObjectID().Hex(), 0, bson.D{{Key: "name", Value: "Soup"}}); err != ErrNotFound {
+		t.Fatalf("updating nothing gave %v, want ErrNotFound", err)
+	}
+	got, err := repos.Foods.Get(ctx, "restaurant-1", food.Food_id)
+	if err != nil || got.Version != 2 || *got.Name != "Soup" {
+		t.Fatalf("after two updates found %+v (%v)", got, err)
+	}
+
+	if found, err := repos.Foods.AnyWith(ctx, "restaurant-1", "menu_id", "menu-1"); err != nil || !found {
+		t.Fatalf("AnyWith missed the food (%v)", err)
+	}
+	if err := repos.Foods.Purge(ctx, "restaurant-1", food.Food_id); err != ErrNotFound {
+		t.Fatalf("purging a live food gave %v, want ErrNotFound", err)
+	}
+	if err := repos.Foods.Delete(ctx, "restaurant-1", food.Food_id, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Foods.Get(ctx, "restaurant-1", food.Food_id); err != ErrNotFound {
+		t.Fatalf("Get of a deleted food gave %v, want ErrNotFound", err)
+	}
+	if found, err := repos.Foods.AnyWith(ctx, "restaurant-1", "menu_id", "menu-1"); err != nil || found {
+		t.Fatalf("AnyWith found a deleted food (%v)", err)
+	}
+	if _, err := repos.Foods.UpdateVersion(ctx, "restaurant-1", food.Food_id, 3, bson.D{{Key: "name", Value: "Soup"}}); err != ErrNotFound {
+		t.Fatalf("updating a deleted food gave %v, want ErrNotFound", err)
+	}
+
+	if err := repos.Foods.Restore(ctx, "restaurant-1", food.Food_id); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Foods.Restore(ctx, "restaurant-1", food.Food_id); err != ErrNotFound {
+		t.Fatalf("restoring a live food gave %v, want ErrNotFound", err)
+	}
+	if _, err := repos.Foods.Get(ctx, "restaurant-1", food.Food_id); err != nil {
+		t.Fatalf("Get of a restored food gave %v", err)
+	}
+
+	if err := repos.Foods.Delete(ctx, "restaurant-1", food.Food_id, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Foods.Purge(ctx, "restaurant-1", food.Food_id); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Foods.Restore(ctx, "restaurant-1", food.Food_id); err != ErrNotFound {
+		t.Fatalf("restoring a purged food gave %v, want ErrNotFound", err)
+	}
+}
+
+func testTransactions(t *testing.T, repos *Repositories) {
+	ctx := context.Background()
+	kept := newFood("restaurant-1", "menu-2")
+	undone := newFood("restaurant-1", "menu-2")
+	if err := repos.Foods.Create(ctx, kept); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("failed")
+	err := repos.Transactions.InTransaction(ctx, func(ctx context.Context) error {
+		if err := repos.Foods.Create(ctx, undone); err != nil {
+			return err
+		}
+		if _, err := repos.Foods.Update(ctx, "restaurant-1", kept.Food_id, bson.D{{Key: "name", Value: "Changed"}}); err != nil {
+			return err
+		}
+		return repos.Transactions.InTransaction(ctx, func(ctx context.Context) error {
+			return failure
+		})
+	})
+	if err != failure {
+		t.Fatalf("InTransaction returned %v, want the error of fn", err)
+	}
+	if _, err := repos.Foods.Get(ctx, "restaurant-1", undone.Food_id); err != ErrNotFound {
+		t.Fatalf("a food created by a failed transaction is there (%v)", err)
+	}
+	if got, err := repos.Foods.Get(ctx, "restaurant-1", kept.Food_id); err != nil || *got.Name != "Pizza" || got.Version != 0 {
+		t.Fatalf("a failed transaction's update stuck: %+v (%v)", got, err)
+	}
+
+	err = repos.Transactions.InTransaction(ctx, func(ctx context.Context) error {
+		return repos.Foods.Create(ctx, undone)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Foods.Get(ctx, "restaurant-1", undone.Food_id); err != nil {
+		t.Fatalf("a committed transaction's food is missing (%v)", err)
+	}
+}
+
+func testUsers(t *testing.T, repos *Repositories) {
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+	email, phone, role := "Wendy@Example.com", "5550100", models.RoleWaiter
+	user := models.User{ID: id, User_id: id.Hex(), Email: &email, Phone: &phone, Role: &role, Restaurant_id: "restaurant-1"}
+	if err := repos.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	twin := user
+	twin.ID = primitive.NewObjectID()
+	twin.User_id = twin.ID.Hex()
+	otherPhone := "5550101"
+	twin.Phone = &otherPhone
+	if err := repos.Users.Create(ctx, twin); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("a second user with the email gave %v, want ErrDuplicate", err)
+	}
+	if taken, err := repos.Users.EmailTaken(ctx, email); err != nil || !taken {
+		t.Fatalf("EmailTaken missed the user (%v)", err)
+	}
+	if found, err := repos.Users.GetByEmail(ctx, email); err != nil || found.User_id != user.User_id {
+		t.Fatalf("GetByEmail found %q (%v)", found.User_id, err)
+	}
+
+	// Each TOTP step can be used once, and never one before the last
+	for _, step := range []struct {
+		step int64
+		want bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		advanced, err := repos.Users.AdvanceTotpStep(ctx, user.User_id, step.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advanced != step.want {
+			t.Fatalf("using step %d gave %v, want %v", step.step, advanced, step.want)
+		}
+	}
+	if found, err := repos.Users.Get(ctx, "", user.User_id); err != nil || !found.Totp_enabled {
+		t.Fatalf("TOTP is not enabled after a step was used (%v)", err)
+	}
+}
+
+// An order has one live invoice, and can be billed again once it is deleted.
+func testInvoices(t *testing.T, repos *Repositories) {
+	ctx := context.Background()
+	newInvoice := func() models.Invoice {
+		id := primitive.NewObjectID()
+		return models.Invoice{ID: id, Invoice_id: id.Hex(), Order_id: "order-1", Restaurant_id: "restaurant-1"}
+	}
+	first, second := newInvoice(), newInvoice()
+
+	if err := repos.Invoices.Create(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Invoices.Create(ctx, second); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("a second invoice for the order gave %v, want ErrDuplicate", err)
+	}
+	if err := repos.Invoices.Delete(ctx, "restaurant-1", first.Invoice_id, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Invoices.Create(ctx, second); err != nil {
+		t.Fatalf("billing the order again gave %v", err)
+	}
+	if err := repos.Invoices.Restore(ctx, "restaurant-1", first.Invoice_id); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("restoring the first invoice gave %v, want ErrDuplicate", err)
+	}
+}
+
+func testCollections(t *testing.T, repos *Repositories) {
+	ctx := context.Background()
+	attempts := repos.Collections.Collection("loginAttempt")
+	key := "account:" + primitive.NewObjectID().Hex()
+
+	var attempt models.LoginAttempt
+	for i := 1; i <= 2; i++ {
+		err := attempts.FindOneAndUpdate(
+			ctx,
+			bson.M{"key": key},
+			bson.D{
+				{Key: "$inc", Value: bson.D{{Key: "failures", Value: 1}}},
+				{Key: "$set", Value: bson.D{{Key: "last_failure", Value: time.Now()}}},
+				{Key: "$setOnInsert", Value: bson.D{{Key: "_id", Value: primitive.NewObjectID()}}},
+			},
+			true,
+			&attempt,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Failures != i {
+			t.Fatalf("after %d upserts failures is %d", i, attempt.Failures)
+		}
+	}
+	if count, err := attempts.Count(ctx, bson.M{"key": key}); err != nil || count != 1 {
+		t.Fatalf("the upserts stored %d documents (%v)", count, err)
+	}
+
+	result, err := attempts.UpdateOne(ctx, bson.M{"key": key, "last_failure": bson.M{"$lt": time.Now().Add(-time.Hour)}}, bson.D{{Key: "$set", Value: bson.D{{Key: "failures", Value: 0}}}}, false)
+	if err != nil || result.MatchedCount != 0 {
+		t.Fatalf("$lt matched a recent failure (%v)", err)
+	}
+
+	if _, err := attempts.DeleteOne(ctx, bson.M{"key": key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := attempts.FindOne(ctx, bson.M{"key": key}, &attempt); err != ErrNotFound {
+		t.Fatalf("FindOne after the delete gave %v, want ErrNotFound", err)
+	}
+}
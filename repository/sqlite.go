@@ -0,0 +1,927 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"restaurant_app/models"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sqliteTables are the SQLite tables, named like the Mongo collections, and
+// the id field each is keyed by.
+var sqliteTables = []struct{ name, idField string }{
+	{"food", "food_id"},
+	{"menu", "menu_id"},
+	{"table", "table_id"},
+	{"order", "order_id"},
+	{"orderItem", "order_item_id"},
+	{"invoice", "invoice_id"},
+	{"user", "user_id"},
+	{"apiKey", "_id"},
+	{"audit", "_id"},
+	{"device", "_id"},
+	{"loginAttempt", "_id"},
+	{"mfaChallenge", "_id"},
+	{"oidcLogin", "_id"},
+	{"passwordReset", "_id"},
+	{"restaurant", "_id"},
+	{"revocation", "_id"},
+	{"session", "_id"},
+	{"signingKey", "_id"},
+}
+
+// sqliteIndexes back the lookups the repositories make, and keep user
+// emails, phones and OIDC subjects, and the order of a live invoice, unique
+// as the Mongo indexes do.
+var sqliteIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS food_menu_id ON "food" (json_extract(doc, '$.menu_id'))`,
+	`CREATE INDEX IF NOT EXISTS order_table_id ON "order" (json_extract(doc, '$.table_id'))`,
+	`CREATE INDEX IF NOT EXISTS orderItem_order_id ON "orderItem" (json_extract(doc, '$.order_id'))`,
+	`CREATE INDEX IF NOT EXISTS orderItem_food_id ON "orderItem" (json_extract(doc, '$.food_id'))`,
+	`DROP INDEX IF EXISTS invoice_order_id`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS invoice_order_id_live_unique ON "invoice" (json_extract(doc, '$.order_id')) WHERE json_extract(doc, '$.deleted_at') IS NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS user_email_unique ON "user" (json_extract(doc, '$.email')) WHERE json_extract(doc, '$.email') IS NOT NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS user_phone_unique ON "user" (json_extract(doc, '$.phone')) WHERE json_extract(doc, '$.phone') IS NOT NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS user_oidc_subject_unique ON "user" (json_extract(doc, '$.oidc_subject')) WHERE json_extract(doc, '$.oidc_subject') IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS apiKey_api_key_id ON "apiKey" (json_extract(doc, '$.api_key_id'))`,
+	`CREATE INDEX IF NOT EXISTS device_device_id ON "device" (json_extract(doc, '$.device_id'))`,
+	`CREATE INDEX IF NOT EXISTS loginAttempt_key ON "loginAttempt" (json_extract(doc, '$.key'))`,
+	`CREATE INDEX IF NOT EXISTS mfaChallenge_token_id ON "mfaChallenge" (json_extract(doc, '$.token_id'))`,
+	`CREATE INDEX IF NOT EXISTS oidcLogin_state_hash ON "oidcLogin" (json_extract(doc, '$.state_hash'))`,
+	`CREATE INDEX IF NOT EXISTS passwordReset_user_id ON "passwordReset" (json_extract(doc, '$.user_id'))`,
+	`CREATE INDEX IF NOT EXISTS revocation_token_id ON "revocation" (json_extract(doc, '$.token_id'))`,
+	`CREATE INDEX IF NOT EXISTS revocation_user_id ON "revocation" (json_extract(doc, '$.user_id'))`,
+	`CREATE INDEX IF NOT EXISTS session_session_id ON "session" (json_extract(doc, '$.session_id'))`,
+	`CREATE INDEX IF NOT EXISTS session_user_id ON "session" (json_extract(doc, '$.user_id'))`,
+}
+
+// OpenSQLite opens, creating it when missing, the SQLite database at path
+// and sets up its tables.
+func OpenSQLite(path string) (*sql.DB, error) {
+	// Transactions take the write lock up front, so two of them can't both
+	// read and then fail to write
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := createSQLiteSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func createSQLiteSchema(db *sql.DB) error {
+	for _, table := range sqliteTables {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "` + table.name + `" (id TEXT PRIMARY KEY, doc TEXT NOT NULL)`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ` + table.name + `_restaurant_id ON "` + table.name + `" (json_extract(doc, '$.restaurant_id'))`)
+		if err != nil {
+			return err
+		}
+	}
+	for _, index := range sqliteIndexes {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSQLite keeps the entities in a SQLite database opened with OpenSQLite.
+// Each entity is a row holding the document Mongo would, as extended JSON,
+// so fields are set and queried by their bson names as in the Mongo
+// implementation.
+func NewSQLite(db *sql.DB) *Repositories {
+	return &Repositories{
+		Transactions: sqliteTransactions{db},
+		Foods:        sqliteFoods{newSQLiteStore[models.Food](db, "food", "food_id")},
+		Menus:        newSQLiteStore[models.Menu](db, "menu", "menu_id"),
+		Tables:       newSQLiteStore[models.Table](db, "table", "table_id"),
+		Orders:       sqliteOrders{newSQLiteStore[models.Order](db, "order", "order_id")},
+		OrderItems:   sqliteOrderItems{newSQLiteStore[models.OrderItem](db, "orderItem", "order_item_id")},
+		Invoices:     newSQLiteStore[models.Invoice](db, "invoice", "invoice_id"),
+		Users:        sqliteUsers{newSQLiteStore[models.User](db, "user", "user_id")},
+		Collections:  sqliteCollections{db},
+	}
+}
+
+// sqliteConn is what a *sql.DB and a *sql.Tx have in common.
+type sqliteConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqliteTransactionKey struct{}
+
+type sqliteTransactions struct {
+	db *sql.DB
+}
+
+func (t sqliteTransactions) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(sqliteTransactionKey{}) != nil {
+		return fn(ctx)
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(context.WithValue(ctx, sqliteTransactionKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteCollection is a table of documents keyed by their idField.
+type sqliteCollection struct {
+	db      *sql.DB
+	table   string
+	idField string
+}
+
+type sqliteStore[T any] struct {
+	sqliteCollection
+}
+
+func newSQLiteStore[T any](db *sql.DB, table string, idField string) sqliteStore[T] {
+	return sqliteStore[T]{sqliteCollection{db, table, idField}}
+}
+
+// conn is the transaction ctx is in, or the database.
+func (s sqliteCollection) conn(ctx context.Context) sqliteConn {
+	if tx, ok := ctx.Value(sqliteTransactionKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+const (
+	sqliteLive    = `json_extract(doc, '$.deleted_at') IS NULL`
+	sqliteDeleted = `json_extract(doc, '$.deleted_at') IS NOT NULL`
+)
+
+// sqliteScoped limits where to the restaurant, as scoped does for Mongo.
+func sqliteScoped(restaurantId string, where string, args ...interface{}) (string, []interface{}) {
+	if restaurantId != "" {
+		where += ` AND json_extract(doc, '$.restaurant_id') = ?`
+		args = append(args, restaurantId)
+	}
+	return where, args
+}
+
+// jsonPath is the path of a top level field, for json_extract and json_set.
+func jsonPath(field string) string {
+	return `$."` + field + `"`
+}
+
+// toJSON encodes a value as the extended JSON documents are kept in.
+func toJSON(value interface{}) (string, error) {
+	raw, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	var wrapper struct {
+		V json.RawMessage `json:"v"`
+	}
+	err = json.Unmarshal(raw, &wrapper)
+	return string(wrapper.V), err
+}
+
+func fromJSON[T any](doc string) (T, error) {
+	var entity T
+	err := bson.UnmarshalExtJSON([]byte(doc), false, &entity)
+	return entity, err
+}
+
+// sqliteDuplicateOr turns a unique constraint failure into ErrDuplicate.
+func sqliteDuplicateOr(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// find returns the entities matching where, in the order they were created.
+func (s sqliteStore[T]) find(ctx context.Context, where string, args ...interface{}) ([]T, error) {
+	rows, err := s.conn(ctx).QueryContext(ctx, `SELECT doc FROM "`+s.table+`" WHERE `+where+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDocs[T](rows)
+}
+
+// scanDocs decodes the documents rows select, and closes rows.
+func scanDocs[T any](rows *sql.Rows) ([]T, error) {
+	defer rows.Close()
+
+	entities := []T{}
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		entity, err := fromJSON[T](doc)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, rows.Err()
+}
+
+func (s sqliteStore[T]) findOne(ctx context.Context, where string, args ...interface{}) (T, error) {
+	var doc string
+	err := s.conn(ctx).QueryRowContext(ctx, `SELECT doc FROM "`+s.table+`" WHERE `+where+` ORDER BY rowid LIMIT 1`, args...).Scan(&doc)
+	if err == sql.ErrNoRows {
+		var entity T
+		return entity, ErrNotFound
+	}
+	if err != nil {
+		var entity T
+		return entity, err
+	}
+	return fromJSON[T](doc)
+}
+
+func (s sqliteStore[T]) exists(ctx context.Context, where string, args ...interface{}) (bool, error) {
+	var found bool
+	err := s.conn(ctx).QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "`+s.table+`" WHERE `+where+`)`, args...).Scan(&found)
+	return found, err
+}
+
+func (s sqliteStore[T]) List(ctx context.Context, restaurantId string) ([]T, error) {
+	where, args := sqliteScoped(restaurantId, sqliteLive)
+	return s.find(ctx, where, args...)
+}
+
+func (s sqliteStore[T]) Get(ctx context.Context, restaurantId string, id string) (T, error) {
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteLive, id)
+	return s.findOne(ctx, where, args...)
+}
+
+func (s sqliteStore[T]) Create(ctx context.Context, entity T) error {
+	raw, err := bson.MarshalExtJSON(entity, false, false)
+	if err != nil {
+		return err
+	}
+	id, err := s.idOf(raw)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, `INSERT INTO "`+s.table+`" (id, doc) VALUES (?, ?)`, id, string(raw))
+	return sqliteDuplicateOr(err)
+}
+
+// idOf reads the id field of a document.
+func (s sqliteStore[T]) idOf(doc []byte) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return "", err
+	}
+	id, _ := fields[s.idField].(string)
+	if id == "" {
+		return "", fmt.Errorf("cannot create without a %s", s.idField)
+	}
+	return id, nil
+}
+
+func (s sqliteStore[T]) Update(ctx context.Context, restaurantId string, id string, set bson.D) (UpdateResult, error) {
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteLive, id)
+	return s.update(ctx, set, where, args...)
+}
+
+func (s sqliteStore[T]) UpdateVersion(ctx context.Context, restaurantId string, id string, version int64, set bson.D) (UpdateResult, error) {
+	// Entities from before versions have none, which counts as 0
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteLive+` AND coalesce(json_extract(doc, '$.version'), 0) = ?`, id, version)
+	result, err := s.update(ctx, set, where, args...)
+	if err != nil || result.MatchedCount > 0 {
+		return result, err
+	}
+	where, args = sqliteScoped(restaurantId, `id = ? AND `+sqliteLive, id)
+	found, err := s.exists(ctx, where, args...)
+	if err != nil {
+		return result, err
+	}
+	if !found {
+		return result, ErrNotFound
+	}
+	return result, ErrVersionConflict
+}
+
+// update sets the fields of the entity matching where and bumps its version.
+func (s sqliteStore[T]) update(ctx context.Context, set bson.D, where string, whereArgs ...interface{}) (UpdateResult, error) {
+	expression := `json_set(doc`
+	var args []interface{}
+	for _, field := range set {
+		value, err := toJSON(field.Value)
+		if err != nil {
+			return UpdateResult{}, err
+		}
+		expression += `, ?, json(?)`
+		args = append(args, jsonPath(field.Key), value)
+	}
+	expression += `, '$.version', coalesce(json_extract(doc, '$.version'), 0) + 1)`
+
+	result, err := s.conn(ctx).ExecContext(ctx, `UPDATE "`+s.table+`" SET doc = `+expression+` WHERE `+where, append(args, whereArgs...)...)
+	if err != nil {
+		return UpdateResult{}, sqliteDuplicateOr(err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	return UpdateResult{MatchedCount: count, ModifiedCount: count}, nil
+}
+
+func (s sqliteStore[T]) Delete(ctx context.Context, restaurantId string, id string, deletedBy string) error {
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteLive, id)
+	result, err := s.update(ctx, bson.D{
+		{Key: "deleted_at", Value: time.Now().Truncate(time.Second)},
+		{Key: "deleted_by", Value: deletedBy},
+	}, where, args...)
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s sqliteStore[T]) Restore(ctx context.Context, restaurantId string, id string) error {
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteDeleted, id)
+	result, err := s.update(ctx, bson.D{
+		{Key: "deleted_at", Value: nil},
+		{Key: "deleted_by", Value: nil},
+	}, where, args...)
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s sqliteStore[T]) Purge(ctx context.Context, restaurantId string, id string) error {
+	where, args := sqliteScoped(restaurantId, `id = ? AND `+sqliteDeleted, id)
+	result, err := s.conn(ctx).ExecContext(ctx, `DELETE FROM "`+s.table+`" WHERE `+where, args...)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s sqliteStore[T]) AnyWith(ctx context.Context, restaurantId string, field string, value string) (bool, error) {
+	where, args := sqliteScoped(restaurantId, `json_extract(doc, ?) = ? AND `+sqliteLive, jsonPath(field), value)
+	return s.exists(ctx, where, args...)
+}
+
+type sqliteFoods struct {
+	sqliteStore[models.Food]
+}
+
+func (s sqliteFoods) Page(ctx context.Context, restaurantId string, startIndex int, limit int) ([]models.Food, int64, error) {
+	where, args := sqliteScoped(restaurantId, sqliteLive)
+
+	var totalCount int64
+	err := s.conn(ctx).QueryRowContext(ctx, `SELECT count(*) FROM "food" WHERE `+where, args...).Scan(&totalCount)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.conn(ctx).QueryContext(ctx, `SELECT doc FROM "food" WHERE `+where+` ORDER BY rowid LIMIT ? OFFSET ?`, append(args, limit, startIndex)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	foods, err := scanDocs[models.Food](rows)
+	return foods, totalCount, err
+}
+
+type sqliteOrders struct {
+	sqliteStore[models.Order]
+}
+
+func (s sqliteOrders) ByTable(ctx context.Context, restaurantId string, tableId string) ([]models.Order, error) {
+	where, args := sqliteScoped(restaurantId, `json_extract(doc, '$.table_id') = ? AND `+sqliteLive, tableId)
+	return s.find(ctx, where, args...)
+}
+
+type sqliteOrderItems struct {
+	sqliteStore[models.OrderItem]
+}
+
+func (s sqliteOrderItems) CreateMany(ctx context.Context, orderItems []models.OrderItem) error {
+	for _, orderItem := range orderItems {
+		if err := s.Create(ctx, orderItem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteByOrder is the join of the Mongo aggregation: items of a deleted
+// order are left out with it, deleted foods and tables are left empty.
+const sqliteByOrder = `
+SELECT
+	json_extract(item.doc, '$.quantity'),
+	json_extract(food.doc, '$.price'),
+	json_extract(food.doc, '$.name'),
+	json_extract(food.doc, '$.food_image'),
+	json_extract("order".doc, '$.order_id'),
+	json_extract("table".doc, '$.table_id'),
+	json_extract("table".doc, '$.table_number')
+FROM "orderItem" AS item
+JOIN "order"
+	ON "order".id = json_extract(item.doc, '$.order_id')
+	AND json_extract("order".doc, '$.deleted_at') IS NULL
+LEFT JOIN "food"
+	ON food.id = json_extract(item.doc, '$.food_id')
+	AND json_extract(food.doc, '$.deleted_at') IS NULL
+LEFT JOIN "table"
+	ON "table".id = json_extract("order".doc, '$.table_id')
+	AND json_extract("table".doc, '$.deleted_at') IS NULL
+WHERE json_extract(item.doc, '$.order_id') = ?
+	AND json_extract(item.doc, '$.deleted_at') IS NULL`
+
+func (s sqliteOrderItems) ByOrder(ctx context.Context, restaurantId string, orderId string) ([]OrderSummary, error) {
+	query, args := sqliteByOrder, []interface{}{orderId}
+	if restaurantId != "" {
+		query += ` AND json_extract(item.doc, '$.restaurant_id') = ?`
+		args = append(args, restaurantId)
+	}
+	rows, err := s.conn(ctx).QueryContext(ctx, query+` ORDER BY item.rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaryRows []summaryRow
+	for rows.Next() {
+		var quantity, foodName, foodImage, joinedOrderId, tableId sql.NullString
+		var price sql.NullFloat64
+		var tableNumber sql.NullInt64
+		if err := rows.Scan(&quantity, &price, &foodName, &foodImage, &joinedOrderId, &tableId, &tableNumber); err != nil {
+			return nil, err
+		}
+
+		row := summaryRow{item: OrderSummaryItem{
+			Quantity:   nullString(quantity),
+			Food_name:  nullString(foodName),
+			Food_image: nullString(foodImage),
+			Order_id:   nullString(joinedOrderId),
+			Table_id:   nullString(tableId),
+		}}
+		if price.Valid {
+			row.item.Amount = &price.Float64
+		}
+		if tableNumber.Valid {
+			number := int(tableNumber.Int64)
+			row.item.Table_number = &number
+			row.key.tableNumber, row.key.hasTable = number, true
+		}
+		row.key.orderId = joinedOrderId.String
+		row.key.tableId = tableId.String
+		summaryRows = append(summaryRows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groupSummaries(summaryRows), nil
+}
+
+func nullString(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+	return &value.String
+}
+
+type sqliteUsers struct {
+	sqliteStore[models.User]
+}
+
+// Search filters and sorts in Go, like the in-memory backend; a single
+// restaurant's staff is small.
+func (s sqliteUsers) Search(ctx context.Context, query UserQuery) ([]models.User, int64, error) {
+	where, args := sqliteScoped(query.RestaurantId, sqliteLive)
+	users, err := s.find(ctx, where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	var matched []models.User
+	for _, user := range users {
+		if query.matches(user) {
+			matched = append(matched, user)
+		}
+	}
+	matched, totalCount := query.page(matched)
+	if matched == nil {
+		matched = []models.User{}
+	}
+	return matched, totalCount, nil
+}
+
+func (s sqliteUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.findOne(ctx, `json_extract(doc, '$.email') = ? AND `+sqliteLive, email)
+}
+
+func (s sqliteUsers) GetByOidcSubject(ctx context.Context, subject string) (models.User, error) {
+	return s.findOne(ctx, `json_extract(doc, '$.oidc_subject') = ? AND `+sqliteLive, subject)
+}
+
+// Deleted users keep their email and phone, and still count as admins, as
+// in the Mongo implementation.
+
+func (s sqliteUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	return s.exists(ctx, `json_extract(doc, '$.email') = ?`, email)
+}
+
+func (s sqliteUsers) PhoneTaken(ctx context.Context, phone string, exceptUserId string) (bool, error) {
+	return s.exists(ctx, `json_extract(doc, '$.phone') = ? AND id != ?`, phone, exceptUserId)
+}
+
+func (s sqliteUsers) HasAdmin(ctx context.Context) (bool, error) {
+	return s.exists(ctx, `json_extract(doc, '$.role') = ?`, models.RoleAdmin)
+}
+
+func (s sqliteUsers) PinStaff(ctx context.Context, restaurantId string) ([]models.User, error) {
+	return s.find(ctx, `json_extract(doc, '$.restaurant_id') = ? AND json_extract(doc, '$.pin_hash') IS NOT NULL AND json_extract(doc, '$.deactivated_at') IS NULL AND `+sqliteLive, restaurantId)
+}
+
+func (s sqliteUsers) AdvanceTotpStep(ctx context.Context, userId string, step int64) (bool, error) {
+	// Guard on the stored step so the same code can't be used twice concurrently
+	result, err := s.conn(ctx).ExecContext(
+		ctx,
+		`UPDATE "user" SET doc = json_set(doc, '$.totp_last_step', ?, '$.totp_enabled', json('true'), '$.version', coalesce(json_extract(doc, '$.version'), 0) + 1)
+		WHERE id = ? AND coalesce(json_extract(doc, '$.totp_last_step'), 0) < ?`,
+		step, userId, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (s sqliteUsers) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	var path string
+	err := s.conn(ctx).QueryRowContext(
+		ctx,
+		`SELECT code.fullkey FROM "user", json_each("user".doc, '$.recovery_codes') AS code WHERE "user".id = ? AND code.value = ?`,
+		userId, codeHash,
+	).Scan(&path)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Removed only if still there, in case another request used it first
+	result, err := s.conn(ctx).ExecContext(
+		ctx,
+		`UPDATE "user" SET doc = json_set(json_remove(doc, ?), '$.version', coalesce(json_extract(doc, '$.version'), 0) + 1) WHERE id = ? AND json_extract(doc, ?) = ?`,
+		path, userId, path, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+type sqliteCollections struct {
+	db *sql.DB
+}
+
+func (c sqliteCollections) Collection(name string) Collection {
+	for _, table := range sqliteTables {
+		if table.name == name {
+			return sqliteCollection{c.db, name, table.idField}
+		}
+	}
+	// There is no such table, which the first query will report
+	return sqliteCollection{c.db, name, "_id"}
+}
+
+// sqliteRow is a document of a sqliteCollection and the id it is kept by.
+type sqliteRow struct {
+	id  string
+	doc bson.M
+}
+
+// sqliteField matches the field names json_extract can be given inline, as
+// the indexes need.
+var sqliteField = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// matching returns the documents matching filter, in the order they were
+// inserted. The plain strings and ids of filter narrow the rows down in SQL
+// and the rest of it is checked in Go.
+func (c sqliteCollection) matching(ctx context.Context, filter bson.M) ([]sqliteRow, bson.M, error) {
+	normalised, err := toDocument(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	where, args := `1`, []interface{}{}
+	for field, value := range normalised {
+		if id, isObjectId := value.(primitive.ObjectID); isObjectId && field == c.idField {
+			where += ` AND id = ?`
+			args = append(args, id.Hex())
+			continue
+		}
+		text, isString := value.(string)
+		switch {
+		case !isString:
+		case field == c.idField:
+			where += ` AND id = ?`
+			args = append(args, text)
+		case sqliteField.MatchString(field):
+			where += ` AND json_extract(doc, '$.` + field + `') = ?`
+			args = append(args, text)
+		}
+	}
+
+	rows, err := c.conn(ctx).QueryContext(ctx, `SELECT id, doc FROM "`+c.table+`" WHERE `+where+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var matched []sqliteRow
+	for rows.Next() {
+		var row sqliteRow
+		var doc string
+		if err := rows.Scan(&row.id, &doc); err != nil {
+			return nil, nil, err
+		}
+		if err := bson.UnmarshalExtJSON([]byte(doc), false, &row.doc); err != nil {
+			return nil, nil, err
+		}
+		if matches(row.doc, normalised) {
+			matched = append(matched, row)
+		}
+	}
+	return matched, normalised, rows.Err()
+}
+
+// write runs fn in a transaction, so what it reads can't change before it
+// writes.
+func (c sqliteCollection) write(ctx context.Context, fn func(ctx context.Context) error) error {
+	return sqliteTransactions{c.db}.InTransaction(ctx, fn)
+}
+
+func (c sqliteCollection) insert(ctx context.Context, doc bson.M) error {
+	id, err := documentKey(doc, c.idField)
+	if err != nil {
+		return err
+	}
+	raw, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn(ctx).ExecContext(ctx, `INSERT INTO "`+c.table+`" (id, doc) VALUES (?, ?)`, id, string(raw))
+	return sqliteDuplicateOr(err)
+}
+
+func (c sqliteCollection) replace(ctx context.Context, id string, doc bson.M) error {
+	raw, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn(ctx).ExecContext(ctx, `UPDATE "`+c.table+`" SET doc = ? WHERE id = ?`, string(raw), id)
+	return sqliteDuplicateOr(err)
+}
+
+func (c sqliteCollection) Insert(ctx context.Context, document interface{}) error {
+	doc, err := toDocument(document)
+	if err != nil {
+		return err
+	}
+	return c.insert(ctx, doc)
+}
+
+func (c sqliteCollection) FindOne(ctx context.Context, filter bson.M, result interface{}) error {
+	rows, _, err := c.matching(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return ErrNotFound
+	}
+	return decodeDocument(rows[0].doc, result)
+}
+
+func (c sqliteCollection) Find(ctx context.Context, filter bson.M, opts FindOptions, results interface{}) error {
+	rows, _, err := c.matching(ctx, filter)
+	if err != nil {
+		return err
+	}
+	docs := make([]bson.M, 0, len(rows))
+	for _, row := range rows {
+		docs = append(docs, row.doc)
+	}
+	sortDocuments(docs, opts.Sort)
+	return decodeDocuments(opts.page(docs), results)
+}
+
+func (c sqliteCollection) Count(ctx context.Context, filter bson.M) (int64, error) {
+	rows, _, err := c.matching(ctx, filter)
+	return int64(len(rows)), err
+}
+
+func (c sqliteCollection) UpdateOne(ctx context.Context, filter bson.M, update bson.D, upsert bool) (UpdateResult, error) {
+	result, _, err := c.update(ctx, filter, update, upsert, false)
+	return result, err
+}
+
+func (c sqliteCollection) UpdateMany(ctx context.Context, filter bson.M, update bson.D) (UpdateResult, error) {
+	result, _, err := c.update(ctx, filter, update, false, true)
+	return result, err
+}
+
+func (c sqliteCollection) FindOneAndUpdate(ctx context.Context, filter bson.M, update bson.D, upsert bool, result interface{}) error {
+	_, updated, err := c.update(ctx, filter, update, upsert, false)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		return ErrNotFound
+	}
+	return decodeDocument(updated, result)
+}
+
+// update applies update to the first document matching filter, or to all of
+// them, returning the last one it wrote.
+func (c sqliteCollection) update(ctx context.Context, filter bson.M, update bson.D, upsert bool, many bool) (UpdateResult, bson.M, error) {
+	var result UpdateResult
+	var updated bson.M
+	err := c.write(ctx, func(ctx context.Context) error {
+		result, updated = UpdateResult{}, nil
+		rows, normalised, err := c.matching(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			if !upsert {
+				return nil
+			}
+			if updated, err = upsertDocument(normalised, update); err != nil {
+				return err
+			}
+			if err := c.insert(ctx, updated); err != nil {
+				return err
+			}
+			result = UpdateResult{UpsertedCount: 1, UpsertedID: updated[c.idField]}
+			return nil
+		}
+
+		if !many {
+			rows = rows[:1]
+		}
+		for _, row := range rows {
+			previous, err := bson.MarshalExtJSON(row.doc, false, false)
+			if err != nil {
+				return err
+			}
+			if err := applyUpdate(row.doc, update, false); err != nil {
+				return err
+			}
+			raw, err := bson.MarshalExtJSON(row.doc, false, false)
+			if err != nil {
+				return err
+			}
+			result.MatchedCount++
+			updated = row.doc
+			if string(raw) == string(previous) {
+				continue
+			}
+			result.ModifiedCount++
+			if err := c.replace(ctx, row.id, row.doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return UpdateResult{}, nil, err
+	}
+	return result, updated, nil
+}
+
+func (c sqliteCollection) FindOneAndDelete(ctx context.Context, filter bson.M, result interface{}) error {
+	return c.write(ctx, func(ctx context.Context) error {
+		rows, _, err := c.matching(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return ErrNotFound
+		}
+		if err := decodeDocument(rows[0].doc, result); err != nil {
+			return err
+		}
+		_, err = c.conn(ctx).ExecContext(ctx, `DELETE FROM "`+c.table+`" WHERE id = ?`, rows[0].id)
+		return err
+	})
+}
+
+func (c sqliteCollection) DeleteOne(ctx context.Context, filter bson.M) (int64, error) {
+	return c.delete(ctx, filter, false)
+}
+
+func (c sqliteCollection) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+	return c.delete(ctx, filter, true)
+}
+
+func (c sqliteCollection) delete(ctx context.Context, filter bson.M, many bool) (int64, error) {
+	var deleted int64
+	err := c.write(ctx, func(ctx context.Context) error {
+		deleted = 0
+		rows, _, err := c.matching(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if !many && len(rows) > 1 {
+			rows = rows[:1]
+		}
+		for _, row := range rows {
+			if _, err := c.conn(ctx).ExecContext(ctx, `DELETE FROM "`+c.table+`" WHERE id = ?`, row.id); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// CopyFromMongo copies every entity, deleted ones included, and what else
+// the server keeps, such as sessions and signing keys, from a MongoDB
+// database into an empty SQLite one, all or nothing. It returns how many
+// documents each table got, and refuses when any table has rows already.
+func CopyFromMongo(ctx context.Context, from *mongo.Database, to *sql.DB) (map[string]int, error) {
+	tx, err := to.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	copied := map[string]int{}
+	for _, table := range sqliteTables {
+		var rows int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM "`+table.name+`"`).Scan(&rows); err != nil {
+			return nil, err
+		}
+		if rows > 0 {
+			return nil, fmt.Errorf("the SQLite %s table has %d rows already; copy into a new database", table.name, rows)
+		}
+
+		cursor, err := from.Collection(table.name).Find(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(ctx) {
+			doc, err := bson.MarshalExtJSON(cursor.Current, false, false)
+			if err != nil {
+				cursor.Close(ctx)
+				return nil, err
+			}
+			id, ok := cursor.Current.Lookup(table.idField).StringValueOK()
+			if objectId, isObjectId := cursor.Current.Lookup(table.idField).ObjectIDOK(); isObjectId {
+				id, ok = objectId.Hex(), true
+			}
+			if !ok || id == "" {
+				cursor.Close(ctx)
+				return nil, fmt.Errorf("a %s document has no %s: %s", table.name, table.idField, strings.TrimSpace(cursor.Current.String()))
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO "`+table.name+`" (id, doc) VALUES (?, ?)`, id, string(doc)); err != nil {
+				cursor.Close(ctx)
+				return nil, fmt.Errorf("copying %s %s: %w", table.name, id, sqliteDuplicateOr(err))
+			}
+			copied[table.name]++
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return copied, tx.Commit()
+}
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ApiKeyRoutes(incomingRoutes *gin.Engine){
+	incomingRoutes.GET("/apiKeys", middleware.Authorize(admins...), controller.GetApiKeys())
+	incomingRoutes.POST("/apiKeys", middleware.Authorize(admins...), controller.CreateApiKey())
+	incomingRoutes.POST("/apiKeys/:api_key_id/revoke", middleware.Authorize(admins...), controller.RevokeApiKey())
+}
\ No newline at end of file
@@ -0,0 +1,12 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func AuditRoutes(incomingRoutes *gin.Engine){
+	incomingRoutes.GET("/audit", middleware.Authorize(managers...), controller.GetAuditEntries())
+}
\ No newline at end of file
@@ -0,0 +1,21 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceRoutes must be registered before middleware.Authentication: the
+// terminal endpoints authenticate the device rather than a user.
+func DeviceRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/devices", middleware.Authentication(), middleware.Authorize(admins...), controller.GetDevices())
+	incomingRoutes.POST("/devices", middleware.Authentication(), middleware.Authorize(admins...), controller.RegisterDevice())
+	incomingRoutes.POST("/devices/:device_id/revoke", middleware.Authentication(), middleware.Authorize(admins...), controller.RevokeDevice())
+	incomingRoutes.POST("/terminal/authenticate", controller.AuthenticateDevice())
+	incomingRoutes.GET("/terminal/staff", middleware.DeviceAuthentication(), controller.GetTerminalStaff(repos.Users))
+	incomingRoutes.POST("/terminal/pin-login", middleware.DeviceAuthentication(), controller.PinLogin(repos.Users))
+	incomingRoutes.POST("/terminal/lock", middleware.DeviceAuthentication(), controller.LockTerminal())
+}
\ No newline at end of file
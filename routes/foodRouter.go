@@ -2,13 +2,18 @@ package routes
 
 import (
 	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
-func FoodRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/foods", controller.GetFoods())
-	incomingRoutes.GET("/foods/:food_id", controller.GetFood())
-	incomingRoutes.POST("/foods", controller.CreateFood())
-	incomingRoutes.PATCH("/foods/:food_id", controller.UpdateFood())
+func FoodRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/foods", middleware.Authorize(allStaff...), controller.GetFoods(repos.Foods))
+	incomingRoutes.GET("/foods/:food_id", middleware.Authorize(allStaff...), controller.GetFood(repos.Foods))
+	incomingRoutes.POST("/foods", middleware.Authorize(managers...), controller.CreateFood(repos.Foods, repos.Menus))
+	incomingRoutes.PATCH("/foods/:food_id", middleware.Authorize(managers...), controller.UpdateFood(repos.Foods, repos.Menus))
+	incomingRoutes.DELETE("/foods/:food_id", middleware.Authorize(managers...), controller.DeleteFood(repos.Transactions, repos.Foods, repos.OrderItems))
+	incomingRoutes.POST("/foods/:food_id/restore", middleware.Authorize(managers...), controller.RestoreFood(repos.Transactions, repos.Foods, repos.Menus))
+	incomingRoutes.DELETE("/foods/:food_id/purge", middleware.Authorize(admins...), controller.PurgeFood(repos.Foods))
 }
\ No newline at end of file
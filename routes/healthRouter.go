@@ -0,0 +1,12 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+
+	"github.com/gin-gonic/gin"
+)
+
+func HealthRoutes(incomingRoutes *gin.Engine, readiness *controller.Readiness){
+	incomingRoutes.GET("/healthz", controller.Healthz())
+	incomingRoutes.GET("/readyz", controller.Readyz(readiness))
+}
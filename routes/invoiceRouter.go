@@ -2,13 +2,18 @@ package routes
 
 import (
 	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
-func InvoiceRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/invoices", controller.GetInvoices())
-	incomingRoutes.GET("/invoices/:invoice_id", controller.GetInvoice())
-	incomingRoutes.POST("/invoices", controller.CreateInvoice())
-	incomingRoutes.PATCH("/invoices/:invoice_id", controller.UpdateInvoice())
+func InvoiceRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/invoices", middleware.Authorize(billingStaff...), controller.GetInvoices(repos.Invoices))
+	incomingRoutes.GET("/invoices/:invoice_id", middleware.Authorize(billingStaff...), controller.GetInvoice(repos.Invoices, repos.OrderItems))
+	incomingRoutes.POST("/invoices", middleware.Authorize(billingStaff...), controller.CreateInvoice(repos.Transactions, repos.Invoices, repos.Orders, repos.Tables))
+	incomingRoutes.PATCH("/invoices/:invoice_id", middleware.Authorize(cashiers...), controller.UpdateInvoice(repos.Transactions, repos.Invoices, repos.Orders, repos.Tables))
+	incomingRoutes.DELETE("/invoices/:invoice_id", middleware.Authorize(managers...), controller.DeleteInvoice(repos.Transactions, repos.Invoices, repos.Orders))
+	incomingRoutes.POST("/invoices/:invoice_id/restore", middleware.Authorize(managers...), controller.RestoreInvoice(repos.Transactions, repos.Invoices, repos.Orders, repos.Tables))
+	incomingRoutes.DELETE("/invoices/:invoice_id/purge", middleware.Authorize(admins...), controller.PurgeInvoice(repos.Invoices))
 }
@@ -0,0 +1,11 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+
+	"github.com/gin-gonic/gin"
+)
+
+func JwksRoutes(incomingRoutes *gin.Engine){
+	incomingRoutes.GET("/.well-known/jwks.json", controller.GetJWKS())
+}
\ No newline at end of file
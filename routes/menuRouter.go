@@ -2,12 +2,17 @@ package routes
 
 import (
 	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
-func MenuRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/menus", controller.GetMenus())
-	incomingRoutes.GET("/menus/:menu_id", controller.GetMenu())
-	incomingRoutes.POST("/menus", controller.CreateMenu())
-	incomingRoutes.PATCH("/menus/:menu_id", controller.UpdateMenu())
+func MenuRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/menus", middleware.Authorize(allStaff...), controller.GetMenus(repos.Menus))
+	incomingRoutes.GET("/menus/:menu_id", middleware.Authorize(allStaff...), controller.GetMenu(repos.Menus))
+	incomingRoutes.POST("/menus", middleware.Authorize(managers...), controller.CreateMenu(repos.Menus))
+	incomingRoutes.PATCH("/menus/:menu_id", middleware.Authorize(managers...), controller.UpdateMenu(repos.Menus))
+	incomingRoutes.DELETE("/menus/:menu_id", middleware.Authorize(managers...), controller.DeleteMenu(repos.Transactions, repos.Menus, repos.Foods))
+	incomingRoutes.POST("/menus/:menu_id/restore", middleware.Authorize(managers...), controller.RestoreMenu(repos.Transactions, repos.Menus))
+	incomingRoutes.DELETE("/menus/:menu_id/purge", middleware.Authorize(admins...), controller.PurgeMenu(repos.Menus))
 }
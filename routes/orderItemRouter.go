@@ -2,15 +2,20 @@ package routes
 
 import (
 	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
 
-func OrderItemRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/orderItems", controller.GetOrderItems())
-	incomingRoutes.GET("/orderItems/:orderItem_id", controller.GetOrderItem())
-	incomingRoutes.GET("/orderItems-order/:order_id", controller.GetOrderItemsByOrder())
-	incomingRoutes.POST("orderItems", controller.CreateOrderItem())
-	incomingRoutes.PATCH("/orderItems/:orderItem_id", controller.UpdateOrderItem())
+func OrderItemRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/orderItems", middleware.Authorize(allStaff...), controller.GetOrderItems(repos.OrderItems))
+	incomingRoutes.GET("/orderItems/:order_item_id", middleware.Authorize(allStaff...), controller.GetOrderItem(repos.OrderItems))
+	incomingRoutes.GET("/orderItems-order/:order_id", middleware.Authorize(allStaff...), controller.GetOrderItemsByOrder(repos.OrderItems))
+	incomingRoutes.POST("orderItems", middleware.Authorize(floorStaff...), controller.CreateOrderItem(repos.Transactions, repos.OrderItems, repos.Orders, repos.Foods, repos.Tables))
+	incomingRoutes.PATCH("/orderItems/:order_item_id", middleware.Authorize(kitchenStaff...), controller.UpdateOrderItem(repos.Transactions, repos.OrderItems, repos.Orders, repos.Foods))
+	incomingRoutes.DELETE("/orderItems/:order_item_id", middleware.Authorize(managers...), controller.DeleteOrderItem(repos.Transactions, repos.OrderItems, repos.Orders))
+	incomingRoutes.POST("/orderItems/:order_item_id/restore", middleware.Authorize(managers...), controller.RestoreOrderItem(repos.Transactions, repos.OrderItems, repos.Orders, repos.Foods))
+	incomingRoutes.DELETE("/orderItems/:order_item_id/purge", middleware.Authorize(admins...), controller.PurgeOrderItem(repos.OrderItems))
 }
\ No newline at end of file
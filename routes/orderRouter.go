@@ -1,14 +1,19 @@
 package routes
 
 import (
-	controller "restuarant_app/controllers"
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
-func OrderRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/orders", controller.GetOrders())
-	incomingRoutes.GET("/orders/:order_id", controller.GetOrder())
-	incomingRoutes.POST("orders", controller.CreateOrder())
-	incomingRoutes.PATCH("/order/:order_id", controller.UpdateOrder())
+func OrderRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/orders", middleware.Authorize(allStaff...), controller.GetOrders(repos.Orders))
+	incomingRoutes.GET("/orders/:order_id", middleware.Authorize(allStaff...), controller.GetOrder(repos.Orders))
+	incomingRoutes.POST("orders", middleware.Authorize(floorStaff...), controller.CreateOrder(repos.Transactions, repos.Orders, repos.Tables))
+	incomingRoutes.PATCH("/order/:order_id", middleware.Authorize(floorStaff...), controller.UpdateOrder(repos.Transactions, repos.Orders, repos.Tables))
+	incomingRoutes.DELETE("/orders/:order_id", middleware.Authorize(managers...), controller.DeleteOrder(repos.Transactions, repos.Orders, repos.OrderItems, repos.Invoices, repos.Tables))
+	incomingRoutes.POST("/orders/:order_id/restore", middleware.Authorize(managers...), controller.RestoreOrder(repos.Transactions, repos.Orders, repos.Tables))
+	incomingRoutes.DELETE("/orders/:order_id/purge", middleware.Authorize(admins...), controller.PurgeOrder(repos.Orders))
 }
\ No newline at end of file
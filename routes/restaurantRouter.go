@@ -0,0 +1,15 @@
+package routes
+
+import (
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RestaurantRoutes(incomingRoutes *gin.Engine){
+	incomingRoutes.GET("/restaurants", middleware.Authorize(admins...), middleware.CrossSite(), controller.GetRestaurants())
+	incomingRoutes.GET("/restaurants/:restaurant_id", middleware.Authorize(admins...), middleware.CrossSite(), controller.GetRestaurant())
+	incomingRoutes.POST("/restaurants", middleware.Authorize(admins...), middleware.CrossSite(), controller.CreateRestaurant())
+	incomingRoutes.PATCH("/restaurants/:restaurant_id", middleware.Authorize(admins...), middleware.CrossSite(), controller.UpdateRestaurant())
+}
\ No newline at end of file
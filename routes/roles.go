@@ -0,0 +1,14 @@
+package routes
+
+import "restaurant_app/models"
+
+// Role groups shared by the route files, passed to middleware.Authorize.
+var (
+	allStaff     = []string{models.RoleAdmin, models.RoleManager, models.RoleWaiter, models.RoleKitchen, models.RoleCashier}
+	managers     = []string{models.RoleAdmin, models.RoleManager}
+	admins       = []string{models.RoleAdmin}
+	floorStaff   = []string{models.RoleAdmin, models.RoleManager, models.RoleWaiter}
+	kitchenStaff = []string{models.RoleAdmin, models.RoleManager, models.RoleWaiter, models.RoleKitchen}
+	billingStaff = []string{models.RoleAdmin, models.RoleManager, models.RoleWaiter, models.RoleCashier}
+	cashiers     = []string{models.RoleAdmin, models.RoleManager, models.RoleCashier}
+)
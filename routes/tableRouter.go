@@ -1,15 +1,20 @@
 package routes
 
 import (
-	controller "restuarant_app/controllers"
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
 
-func TableRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/tables", controller.GetTables())
-	incomingRoutes.GET("/tables/:table_id", controller.GetTable())
-	incomingRoutes.POST("tables", controller.CreateTable())
-	incomingRoutes.PATCH("/table/:table_id", controller.UpdateTable())
+func TableRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/tables", middleware.Authorize(allStaff...), controller.GetTables(repos.Tables))
+	incomingRoutes.GET("/tables/:table_id", middleware.Authorize(allStaff...), controller.GetTable(repos.Tables))
+	incomingRoutes.POST("tables", middleware.Authorize(managers...), controller.CreateTable(repos.Tables))
+	incomingRoutes.PATCH("/table/:table_id", middleware.Authorize(floorStaff...), controller.UpdateTable(repos.Tables))
+	incomingRoutes.DELETE("/tables/:table_id", middleware.Authorize(managers...), controller.DeleteTable(repos.Transactions, repos.Tables, repos.Orders))
+	incomingRoutes.POST("/tables/:table_id/restore", middleware.Authorize(managers...), controller.RestoreTable(repos.Transactions, repos.Tables))
+	incomingRoutes.DELETE("/tables/:table_id/purge", middleware.Authorize(admins...), controller.PurgeTable(repos.Tables))
 }
\ No newline at end of file
@@ -1,15 +1,44 @@
 package routes
 
 import (
-	controller "restuarant_app/controllers"
+	controller "restaurant_app/controllers"
+	"restaurant_app/middlewares"
+	"restaurant_app/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
 
-func UserRoutes(incomingRoutes *gin.Engine){
-	incomingRoutes.GET("/users", controller.GetUsers())
-	incomingRoutes.GET("/users/:user_id", controller.GetUser())
-	incomingRoutes.POST("/users/singup", controller.SingUp)
-	incomingRoutes.POST("/users/login", controller.Login())
+func UserRoutes(incomingRoutes *gin.Engine, repos *repository.Repositories){
+	incomingRoutes.GET("/users", middleware.Authentication(), middleware.Authorize(managers...), controller.GetUsers(repos.Users))
+	incomingRoutes.GET("/users/:user_id", middleware.Authentication(), middleware.Authorize(allStaff...), controller.GetUser(repos.Users))
+	incomingRoutes.PATCH("/users/:user_id", middleware.Authentication(), middleware.Authorize(allStaff...), controller.UpdateUser(repos.Users))
+	incomingRoutes.POST("/users/password", middleware.Authentication(), middleware.Authorize(allStaff...), controller.ChangePassword(repos.Users))
+	incomingRoutes.GET("/users/sessions", middleware.Authentication(), middleware.Authorize(allStaff...), controller.GetSessions())
+	incomingRoutes.POST("/users/sessions/:session_id/revoke", middleware.Authentication(), middleware.Authorize(allStaff...), controller.RevokeSession())
+	incomingRoutes.POST("/users/pin", middleware.Authentication(), middleware.Authorize(allStaff...), controller.SetPin(repos.Users))
+	incomingRoutes.POST("/users/:user_id/deactivate", middleware.Authentication(), middleware.Authorize(admins...), controller.DeactivateUser(repos.Users))
+	incomingRoutes.POST("/users/:user_id/reactivate", middleware.Authentication(), middleware.Authorize(admins...), controller.ReactivateUser(repos.Users))
+	incomingRoutes.DELETE("/users/:user_id", middleware.Authentication(), middleware.Authorize(admins...), controller.DeleteUser(repos.Transactions, repos.Users))
+	incomingRoutes.POST("/users/:user_id/restore", middleware.Authentication(), middleware.Authorize(admins...), controller.RestoreUser(repos.Transactions, repos.Users))
+	incomingRoutes.DELETE("/users/:user_id/purge", middleware.Authentication(), middleware.Authorize(admins...), controller.PurgeUser(repos.Users))
+	incomingRoutes.PATCH("/users/:user_id/role", middleware.Authentication(), middleware.Authorize(admins...), controller.UpdateUserRole(repos.Users))
+	incomingRoutes.PATCH("/users/:user_id/restaurant", middleware.Authentication(), middleware.Authorize(admins...), middleware.CrossSite(), controller.UpdateUserRestaurant(repos.Users))
+	incomingRoutes.POST("/users/:user_id/revoke-sessions", middleware.Authentication(), middleware.Authorize(admins...), controller.RevokeUserSessions(repos.Users))
+	incomingRoutes.POST("/users/:user_id/approve", middleware.Authentication(), middleware.Authorize(managers...), controller.ApproveUser(repos.Users))
+	incomingRoutes.POST("/users/:user_id/unlock", middleware.Authentication(), middleware.Authorize(admins...), controller.UnlockUser(repos.Users))
+	incomingRoutes.POST("/users/:user_id/2fa/reset", middleware.Authentication(), middleware.Authorize(admins...), controller.ResetUserTotp(repos.Users))
+	incomingRoutes.POST("/users/2fa/enroll", middleware.Authentication(), controller.EnrollTotp(repos.Users))
+	incomingRoutes.POST("/users/2fa/activate", middleware.Authentication(), controller.ActivateTotp(repos.Users))
+	incomingRoutes.POST("/users/2fa/disable", middleware.Authentication(), controller.DisableTotp(repos.Users))
+	incomingRoutes.POST("/users/logout", middleware.Authentication(), controller.Logout())
+	incomingRoutes.POST("/users/signup", controller.SignUp(repos.Users))
+	incomingRoutes.POST("/users/login", controller.Login(repos.Users))
+	incomingRoutes.POST("/users/login/2fa", controller.LoginSecondFactor(repos.Users))
+	incomingRoutes.POST("/users/login/2fa/enroll", controller.EnrollTotpAtLogin(repos.Users))
+	incomingRoutes.POST("/users/refresh", controller.Refresh(repos.Users))
+	incomingRoutes.GET("/users/oidc/login", controller.OidcLogin())
+	incomingRoutes.GET("/users/oidc/callback", controller.OidcCallback(repos.Users))
+	incomingRoutes.POST("/users/password-reset/request", controller.RequestPasswordReset(repos.Users))
+	incomingRoutes.POST("/users/password-reset/confirm", controller.ConfirmPasswordReset(repos.Users))
 }
\ No newline at end of file